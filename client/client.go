@@ -0,0 +1,186 @@
+// Package client provides a service-proxy client that can be embedded in Go
+// programs to register services on a server at runtime
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/hwipl/service-proxy/internal/pclient"
+)
+
+// ServiceSpec is the specification of a service with protocol ("tcp" or
+// "udp"), port on the server, destination port on the client and an optional
+// pool name
+type ServiceSpec = pclient.ServiceSpec
+
+// Registration is a service registration on the server
+type Registration = pclient.Registration
+
+// RequestError is the error of a request to the server, it wraps one of the
+// errors ErrRejected, ErrClosed or ErrInvalidReply
+type RequestError = pclient.RequestError
+
+// Event is a state change of a service or the client
+type Event = pclient.Event
+
+// EventType is the type of a client event
+type EventType = pclient.EventType
+
+// event types
+const (
+	EventActive       = pclient.EventActive
+	EventRemoved      = pclient.EventRemoved
+	EventHealthy      = pclient.EventHealthy
+	EventUnhealthy    = pclient.EventUnhealthy
+	EventDisconnected = pclient.EventDisconnected
+)
+
+var (
+	// ErrRejected is returned if the server rejects a request
+	ErrRejected = pclient.ErrRejected
+	// ErrClosed is returned if the connection to the server is closed
+	ErrClosed = pclient.ErrClosed
+	// ErrInvalidReply is returned if the server sends an invalid reply
+	ErrInvalidReply = pclient.ErrInvalidReply
+)
+
+// Options are the options of a client
+type Options struct {
+	// Addr is the address of the server, e.g., "192.168.1.1:32323", or
+	// the url of its websocket listener, e.g., "wss://example.com/"; it
+	// can be empty if ProxyCommand is set
+	Addr string
+	// ProxyURL is the url of an http or socks5 proxy the client connects
+	// to the server through; if it is empty, no proxy is used
+	ProxyURL string
+	// ProxyCommand is a command the client starts in a shell, the control
+	// connection runs over its stdin and stdout
+	ProxyCommand string
+	// TLSConfig is the tls configuration of the client; if it is nil,
+	// tls is not used
+	TLSConfig *tls.Config
+}
+
+// Client is a service-proxy client
+type Client struct {
+	c *pclient.Client
+}
+
+// Register registers the service spec on the server, errors of the server
+// are returned as *RequestError
+func (c *Client) Register(spec ServiceSpec) (Registration, error) {
+	return c.c.Register(&spec)
+}
+
+// Listen registers a service on the server and returns a listener for its
+// peer connections, which are forwarded over the control connection to the
+// client. Only the network "tcp" is supported and the host in address is
+// ignored; if the port in address is 0, e.g., ":0", the server chooses a
+// free port, see the Addr of the listener
+func (c *Client) Listen(ctx context.Context, network, address string) (
+	net.Listener, error) {
+	return c.c.Listen(ctx, network, address)
+}
+
+// Unregister removes the registration r from the server
+func (c *Client) Unregister(r Registration) error {
+	return c.c.Unregister(r)
+}
+
+// Events returns the channel of the client's events. Events are dropped if
+// the channel is full, it is closed after the client is disconnected
+func (c *Client) Events() <-chan Event {
+	return c.c.Events()
+}
+
+// Done returns a channel that is closed when the client is disconnected
+func (c *Client) Done() <-chan struct{} {
+	return c.c.Done()
+}
+
+// Close closes the connection to the server, which removes all services of
+// the client
+func (c *Client) Close() error {
+	return c.c.Close()
+}
+
+// ParseServiceSpec parses spec as a service specification with the format
+// "<protocol>:<port>:<destPort>[:<pool>]"
+func ParseServiceSpec(spec string) (ServiceSpec, error) {
+	s, err := pclient.ParseServiceSpec(spec)
+	if err != nil {
+		return ServiceSpec{}, err
+	}
+	return *s, nil
+}
+
+// parseAddr parses addr as address or websocket url of the server and
+// returns the address as host:port without resolving the host, so a proxy
+// can resolve it
+func parseAddr(addr string) (string, *url.URL, error) {
+	if !strings.HasPrefix(addr, "ws://") &&
+		!strings.HasPrefix(addr, "wss://") {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return "", nil, err
+		}
+		return addr, nil, nil
+	}
+
+	// get address of the websocket url, use default http or https port
+	// if there is no port
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Hostname() == "" {
+		return "", nil, errors.New("missing host in websocket url")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), u, nil
+}
+
+// Connect connects a new client with options opts to the server, ctx limits
+// the time for connecting
+func Connect(ctx context.Context, opts *Options) (*Client, error) {
+	var config pclient.Config
+	switch {
+	case opts.Addr != "":
+		addr, u, err := parseAddr(opts.Addr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerAddr, config.WebSocketURL = addr, u
+	case opts.ProxyCommand == "":
+		return nil, errors.New("missing server address")
+	}
+	if opts.ProxyURL != "" {
+		u, err := pclient.ParseProxyURL(opts.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		config.ProxyURL = u
+	}
+	config.ProxyCommand = opts.ProxyCommand
+	config.TLSConfig = opts.TLSConfig
+
+	c, err := pclient.Connect(ctx, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c: c}, nil
+}
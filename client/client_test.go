@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/server"
+)
+
+// expectEvent checks if the next event of c has type want
+func expectEvent(t *testing.T, c *Client, want EventType) {
+	select {
+	case e := <-c.Events():
+		if e.Type != want {
+			t.Errorf("got %s, want %s", e.Type, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("got no event, want %s", want)
+	}
+}
+
+func TestParseServiceSpec(t *testing.T) {
+	want := ServiceSpec{Protocol: "tcp", Port: 8000, DestPort: 80}
+	got, err := ParseServiceSpec("tcp:8000:80")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := ParseServiceSpec("tcp:8000"); err == nil {
+		t.Errorf("got nil, want error")
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	for _, opts := range []*Options{
+		{},
+		{Addr: "invalid"},
+		{Addr: "ws://"},
+		{Addr: "127.0.0.1:1", ProxyURL: "ftp://proxy"},
+	} {
+		if _, err := Connect(context.Background(), opts); err == nil {
+			t.Errorf("got nil, want error for %+v", opts)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	// start echo server as destination of the services
+	dest, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	destPort := uint16(dest.Addr().(*net.TCPAddr).Port)
+
+	// start server
+	s, err := server.New(&server.Options{
+		Addr:         "127.0.0.1:0",
+		AllowedIPs:   []string{"127.0.0.1"},
+		AllowedPorts: []string{"tcp:52537"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	// connect clients
+	ctx, cancel := context.WithTimeout(context.Background(),
+		5*time.Second)
+	defer cancel()
+	opts := &Options{Addr: s.Addr().String()}
+	c1, err := Connect(ctx, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := Connect(ctx, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c2.Close()
+
+	// register not allowed port
+	_, err = c1.Register(ServiceSpec{
+		Protocol: "tcp",
+		Port:     52538,
+		DestPort: destPort,
+	})
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || !errors.Is(err, ErrRejected) {
+		t.Errorf("got %v, want %v", err, ErrRejected)
+	}
+
+	// register service and standby service
+	spec := ServiceSpec{Protocol: "tcp", Port: 52537, DestPort: destPort}
+	r1, err := c1.Register(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r1.Standby {
+		t.Errorf("got %t, want false", r1.Standby)
+	}
+	r2, err := c2.Register(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !r2.Standby {
+		t.Errorf("got %t, want true", r2.Standby)
+	}
+
+	// test service
+	conn, err := net.Dial("tcp", "127.0.0.1:52537")
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+
+	// unregister service, standby service should become active
+	if err := c1.Unregister(r1); err != nil {
+		t.Error(err)
+	}
+	expectEvent(t, c2, EventActive)
+	if err := c1.Unregister(r1); !errors.Is(err, ErrRejected) {
+		t.Errorf("got %v, want %v", err, ErrRejected)
+	}
+
+	// unregister invalid service
+	if err := c1.Unregister(Registration{}); err == nil {
+		t.Errorf("got nil, want error")
+	}
+
+	// shut down server, clients should be disconnected
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	expectEvent(t, c2, EventDisconnected)
+	<-c1.Done()
+	if _, err := c1.Register(spec); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestListen(t *testing.T) {
+	// start server
+	s, err := server.New(&server.Options{
+		Addr:         "127.0.0.1:0",
+		AllowedIPs:   []string{"127.0.0.1"},
+		AllowedPorts: []string{"tcp:52539-52540"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		5*time.Second)
+	defer cancel()
+	defer s.Shutdown(ctx)
+
+	// connect client and listen on free port
+	c, err := Connect(ctx, &Options{Addr: s.Addr().String()})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Listen(ctx, "udp", ":0"); err == nil {
+		t.Errorf("got nil, want error")
+	}
+	l, err := c.Listen(ctx, "tcp", ":0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	if addr.Port != 52539 {
+		t.Errorf("got %d, want %d", addr.Port, 52539)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// connect to listener through server
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	want := []byte("hello")
+	conn.Write(want)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Error(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	conn.Close()
+
+	// close listener, service should be removed
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, want %v", err, net.ErrClosed)
+	}
+	if conn, err := net.Dial("tcp", addr.String()); err == nil {
+		conn.Close()
+		t.Errorf("got nil, want error")
+	}
+}
@@ -1,11 +1,16 @@
 package cmd
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseTCPAddr(t *testing.T) {
@@ -31,6 +36,32 @@ func TestParseTCPAddr(t *testing.T) {
 	}
 }
 
+func TestParseServerAddr(t *testing.T) {
+	var got []string
+	addrs := []string{
+		"127.0.0.1",
+		"example.com",
+		"example.com:3232",
+		"[::1]",
+		"::1",
+		"[2000::1]:2323",
+	}
+	want := []string{
+		"127.0.0.1:32323",
+		"example.com:32323",
+		"example.com:3232",
+		"[::1]:32323",
+		"[::1]:32323",
+		"[2000::1]:2323",
+	}
+	for _, i := range addrs {
+		got = append(got, parseServerAddr(i))
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func createTestFile(name string, content []byte) *os.File {
 	tmpFile, err := ioutil.TempFile("", name)
 	if err != nil {
@@ -97,3 +128,71 @@ func TestParseCACertFiles(t *testing.T) {
 	caCertFiles += "," + cf.Name() + "," + cf.Name()
 	parseCACertFiles()
 }
+
+func TestNewLogHandler(t *testing.T) {
+	// test levels and formats, messages end with the level, message
+	// and attributes after the time
+	var b bytes.Buffer
+	for _, test := range []struct {
+		level, format, want string
+	}{
+		{"info", "text", " level=WARN msg=test port=80\n"},
+		{"warn", "json", `,"level":"WARN","msg":"test","port":80}` +
+			"\n"},
+		{"error", "text", ""},
+	} {
+		b.Reset()
+		h, err := newLogHandler(&b, test.level, test.format,
+			"stderr")
+		if err != nil {
+			log.Fatal(err)
+		}
+		l := slog.New(h)
+		l.Debug("test")
+		l.Warn("test", "port", 80)
+		got := b.String()
+		if !strings.HasSuffix(got, test.want) ||
+			(test.want == "" && got != "") {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+
+	// test syslog output over udp
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	b.Reset()
+	h, err := newLogHandler(&b, "info", "text",
+		"syslog:"+conn.LocalAddr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.New(h).Warn("test", "port", 80)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	want := `[attrs@32473 port="80"] test`
+	if got := string(buf[:n]); !strings.HasSuffix(got, want) ||
+		b.Len() != 0 {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// test invalid level, format and output
+	for _, test := range [][3]string{
+		{"verbose", "text", "stderr"},
+		{"info", "xml", "stderr"},
+		{"info", "text", "file"},
+		{"info", "text", "stderr:x"},
+	} {
+		_, err := newLogHandler(&b, test[0], test[1], test[2])
+		if err == nil {
+			t.Errorf("got nil, want error for %v", test)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package logsink
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// field is an attribute of a log record with the names of its groups as
+// key prefix, e.g., "group.key"
+type field struct {
+	key   string
+	value string
+}
+
+// appendField appends the attribute a with key prefix to fields, attributes
+// in groups are flattened
+func appendField(fields []field, prefix string, a slog.Attr) []field {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		// ignore empty attributes
+		return fields
+	}
+	if a.Value.Kind() != slog.KindGroup {
+		return append(fields, field{prefix + a.Key, a.Value.String()})
+	}
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	for _, ga := range a.Value.Group() {
+		fields = appendField(fields, prefix, ga)
+	}
+	return fields
+}
+
+// severity returns the syslog severity of level
+func severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// writeFunc writes a log record with its fields to a sink
+type writeFunc func(t time.Time, level slog.Level, msg string,
+	fields []field) error
+
+// handler is a slog handler that passes log records with their attributes
+// as fields to a sink
+type handler struct {
+	level  slog.Leveler
+	write  writeFunc
+	fields []field
+	prefix string
+}
+
+// Enabled checks if log messages with level are handled
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.level != nil {
+		minLevel = h.level.Level()
+	}
+	return level >= minLevel
+}
+
+// Handle writes the log record r to the sink
+func (h *handler) Handle(_ context.Context, r slog.Record) error {
+	fields := slices.Clip(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendField(fields, h.prefix, a)
+		return true
+	})
+	return h.write(r.Time, r.Level, r.Message, fields)
+}
+
+// WithAttrs returns a handler that adds attrs to all log records
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.fields = slices.Clip(h.fields)
+	for _, a := range attrs {
+		n.fields = appendField(n.fields, h.prefix, a)
+	}
+	return &n
+}
+
+// WithGroup returns a handler that puts all following attributes into the
+// group name
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	n := *h
+	n.prefix += name + "."
+	return &n
+}
+
+// datagramConn sends datagrams to a unix or udp socket, it reconnects once if
+// a write fails, e.g., because the receiver has been restarted
+type datagramConn struct {
+	mutex   sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+// dialDatagram connects to the unix or udp socket addr
+func dialDatagram(network, addr string) (*datagramConn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{network: network, addr: addr, conn: conn}, nil
+}
+
+// Write sends the datagram b
+func (d *datagramConn) Write(b []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if d.conn == nil {
+			d.conn, err = net.Dial(d.network, d.addr)
+			if err != nil {
+				continue
+			}
+		}
+		var n int
+		if n, err = d.conn.Write(b); err == nil {
+			return n, nil
+		}
+		d.conn.Close()
+		d.conn = nil
+	}
+	return 0, err
+}
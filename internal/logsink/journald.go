@@ -0,0 +1,105 @@
+package logsink
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultJournaldSocket is the default socket of journald
+	DefaultJournaldSocket = "/run/systemd/journal/socket"
+
+	// maxJournaldFieldName is the maximum length of journald field names
+	maxJournaldFieldName = 64
+)
+
+var (
+	// journaldFields maps keys of log attributes to journald field names,
+	// other keys are converted to upper case
+	journaldFields = map[string]string{
+		"client":    "CLIENT_ADDR",
+		"port":      "SERVICE_PORT",
+		"dest_port": "DEST_PORT",
+		"peer":      "PEER_ADDR",
+		"session":   "SESSION_ID",
+	}
+)
+
+// journaldFieldName returns the journald field name of the attribute key;
+// field names only consist of upper case letters, digits and underscores
+// and must not start with a digit or an underscore
+func journaldFieldName(key string) string {
+	if name, ok := journaldFields[key]; ok {
+		return name
+	}
+	name := make([]byte, 0, len(key))
+	for i := 0; i < len(key) && len(name) < maxJournaldFieldName; i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		case c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9':
+		default:
+			c = '_'
+		}
+		if len(name) == 0 && (c == '_' || (c >= '0' && c <= '9')) {
+			continue
+		}
+		name = append(name, c)
+	}
+	return string(name)
+}
+
+// appendJournaldField appends the field name with value in the journald
+// native protocol to b, values with newlines are sent with their length
+func appendJournaldField(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	if !strings.Contains(value, "\n") {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// journald sends log messages to journald
+type journald struct {
+	conn       *datagramConn
+	identifier string
+}
+
+// write sends the log message msg with level and fields as a journal entry
+func (j *journald) write(_ time.Time, level slog.Level, msg string,
+	fields []field) error {
+	b := appendJournaldField(nil, "MESSAGE", msg)
+	b = appendJournaldField(b, "PRIORITY", strconv.Itoa(severity(level)))
+	b = appendJournaldField(b, "SYSLOG_IDENTIFIER", j.identifier)
+	for _, f := range fields {
+		if name := journaldFieldName(f.key); name != "" {
+			b = appendJournaldField(b, name, f.value)
+		}
+	}
+	_, err := j.conn.Write(b)
+	return err
+}
+
+// NewJournaldHandler returns a handler that sends log messages with level or
+// higher to the journald socket path in the native protocol; entries get the
+// syslog identifier and a field for each attribute, e.g., CLIENT_ADDR and
+// SERVICE_PORT. If level is nil, info is used
+func NewJournaldHandler(path, identifier string, level slog.Leveler) (
+	slog.Handler, error) {
+	conn, err := dialDatagram("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+	j := &journald{conn: conn, identifier: identifier}
+	return &handler{level: level, write: j.write}, nil
+}
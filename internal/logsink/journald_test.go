@@ -0,0 +1,86 @@
+package logsink
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testUnixgramListener creates a unix datagram socket in a temporary
+// directory and returns it with its path
+func testUnixgramListener(t *testing.T) (*net.UnixConn, string) {
+	path := filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn, path
+}
+
+// testReadDatagram reads a datagram from conn
+func testReadDatagram(conn net.Conn) []byte {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestJournaldFieldName(t *testing.T) {
+	for _, test := range [][2]string{
+		{"client", "CLIENT_ADDR"},
+		{"port", "SERVICE_PORT"},
+		{"error", "ERROR"},
+		{"group.key-1", "GROUP_KEY_1"},
+		{"_1key", "KEY"},
+		{"__", ""},
+	} {
+		got := journaldFieldName(test[0])
+		if got != test[1] {
+			t.Errorf("got %s, want %s", got, test[1])
+		}
+	}
+}
+
+func TestJournaldHandler(t *testing.T) {
+	conn, path := testUnixgramListener(t)
+	defer conn.Close()
+
+	h, err := NewJournaldHandler(path, "test", slog.LevelDebug)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := slog.New(h).With("client", "127.0.0.1:1234")
+	l.WithGroup("g").Warn("test", "port", 8000, "error", "a\nb")
+
+	// fields with newlines are sent with their length
+	want := []byte("MESSAGE=test\nPRIORITY=4\nSYSLOG_IDENTIFIER=test\n" +
+		"CLIENT_ADDR=127.0.0.1:1234\nG_PORT=8000\n" +
+		"G_ERROR\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n")
+	got := testReadDatagram(conn)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// debug messages are sent with debug priority
+	l.Debug("debug")
+	want = []byte("MESSAGE=debug\nPRIORITY=7\nSYSLOG_IDENTIFIER=test\n" +
+		"CLIENT_ADDR=127.0.0.1:1234\n")
+	got = testReadDatagram(conn)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// missing socket
+	_, err = NewJournaldHandler(path+"-missing", "test", nil)
+	if err == nil {
+		t.Errorf("got nil, want error")
+	}
+}
@@ -0,0 +1,126 @@
+package logsink
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultSyslogSocket is the default unix socket of syslog
+	DefaultSyslogSocket = "/dev/log"
+
+	// syslogFacility is the facility of log messages, i.e., daemon
+	syslogFacility = 3
+
+	// syslogSDID is the id of the structured data element with the
+	// attributes of log messages, 32473 is the private enterprise number
+	// reserved for documentation
+	syslogSDID = "attrs@32473"
+
+	// syslogTimeFormat is the time format of log messages with at most
+	// microseconds
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+	// maximum lengths of header fields and structured data parameter
+	// names
+	maxSyslogHostname  = 255
+	maxSyslogAppName   = 48
+	maxSyslogParamName = 32
+)
+
+// appendSyslogName appends the header field or parameter name s with at
+// most maxLen printable ASCII characters to b; invalid characters are
+// replaced with underscores and an empty name is replaced with "-"
+func appendSyslogName(b []byte, s string, maxLen int, param bool) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	for i := 0; i < len(s) && i < maxLen; i++ {
+		c := s[i]
+		if c < 33 || c > 126 ||
+			(param && (c == '=' || c == ']' || c == '"')) {
+			c = '_'
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// appendSyslogParamValue appends the structured data parameter value s to b,
+// the characters '"', '\' and ']' are escaped with a backslash
+func appendSyslogParamValue(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\\', ']':
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// syslog sends log messages to syslog
+type syslog struct {
+	conn     *datagramConn
+	hostname string
+	appName  string
+	pid      int
+}
+
+// write sends the log message msg with time t, level and fields as RFC 5424
+// message, the fields are sent as structured data
+func (s *syslog) write(t time.Time, level slog.Level, msg string,
+	fields []field) error {
+	b := fmt.Appendf(nil, "<%d>1 ", syslogFacility*8+severity(level))
+	if t.IsZero() {
+		b = append(b, '-')
+	} else {
+		b = t.AppendFormat(b, syslogTimeFormat)
+	}
+	b = append(b, ' ')
+	b = appendSyslogName(b, s.hostname, maxSyslogHostname, false)
+	b = append(b, ' ')
+	b = appendSyslogName(b, s.appName, maxSyslogAppName, false)
+	b = fmt.Appendf(b, " %d - ", s.pid)
+	if len(fields) == 0 {
+		b = append(b, '-')
+	} else {
+		b = append(b, "["+syslogSDID...)
+		for _, f := range fields {
+			b = append(b, ' ')
+			b = appendSyslogName(b, f.key, maxSyslogParamName, true)
+			b = append(b, `="`...)
+			b = appendSyslogParamValue(b, f.value)
+			b = append(b, '"')
+		}
+		b = append(b, ']')
+	}
+	if msg != "" {
+		b = append(b, ' ')
+		b = append(b, msg...)
+	}
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// NewSyslogHandler returns a handler that sends log messages with level or
+// higher as RFC 5424 messages with appName to the syslog address addr on
+// network "unixgram" or "udp"; the attributes of log messages are sent as
+// structured data. If level is nil, info is used
+func NewSyslogHandler(network, addr, appName string, level slog.Leveler) (
+	slog.Handler, error) {
+	conn, err := dialDatagram(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	s := &syslog{
+		conn:     conn,
+		hostname: hostname,
+		appName:  appName,
+		pid:      os.Getpid(),
+	}
+	return &handler{level: level, write: s.write}, nil
+}
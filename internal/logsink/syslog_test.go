@@ -0,0 +1,66 @@
+package logsink
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestSyslogHandler(t *testing.T) {
+	conn, path := testUnixgramListener(t)
+	defer conn.Close()
+
+	h, err := NewSyslogHandler("unixgram", path, "test app", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := slog.New(h)
+	l.Debug("debug")
+	l.Error("test", "client", "127.0.0.1:1234", "reason", `"a]b\`)
+
+	// debug message is filtered, attributes are sent as structured data
+	hostname, _ := os.Hostname()
+	want := regexp.MustCompile(fmt.Sprintf(`^<27>1 \d{4}-\d\d-\d\dT`+
+		`\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) %s test_app %d - `+
+		`\[attrs@32473 client="127\.0\.0\.1:1234" `+
+		`reason="\\"a\\]b\\\\"\] test$`, regexp.QuoteMeta(hostname),
+		os.Getpid()))
+	got := testReadDatagram(conn)
+	if !want.Match(got) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// message without attributes
+	l.Info("info")
+	want = regexp.MustCompile(` - - info$`)
+	got = testReadDatagram(conn)
+	if !want.Match(got) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSyslogHandlerUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	h, err := NewSyslogHandler("udp", conn.LocalAddr().String(), "test",
+		slog.LevelWarn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.New(h).Warn("test", slog.Group("g", "key", 1))
+	want := regexp.MustCompile(`^<28>1 .* test \d+ - ` +
+		`\[attrs@32473 g\.key="1"\] test$`)
+	got := testReadDatagram(conn)
+	if !want.Match(got) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
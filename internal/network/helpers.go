@@ -1,19 +1,63 @@
 package network
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
 	"net"
 )
 
+// NewSessionID returns a new random ID that identifies the log messages of
+// a session, e.g., of a control connection
+func NewSessionID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 // ReadFromConn reads messageLen bytes from conn
 func ReadFromConn(conn net.Conn) []byte {
-	buf := make([]byte, MessageLen)
+	return readFromConn(conn, MessageLen)
+}
+
+// ReadMessageFromConn reads a message and, if messages of its type are
+// followed by data, the data from conn; it returns nil if reading fails
+func ReadMessageFromConn(conn net.Conn) (*Message, []byte) {
+	buf := ReadFromConn(conn)
+	if buf == nil {
+		return nil, nil
+	}
+	var msg Message
+	msg.Parse(buf)
+	if !HasData(msg.Op) {
+		return &msg, nil
+	}
+	data := ReadDataFromConn(conn)
+	if data == nil {
+		return nil, nil
+	}
+	return &msg, data
+}
+
+// ReadDataFromConn reads data with a length prefix from conn
+func ReadDataFromConn(conn net.Conn) []byte {
+	buf := readFromConn(conn, DataLenLen)
+	if buf == nil {
+		return nil
+	}
+	return readFromConn(conn, int(binary.BigEndian.Uint16(buf)))
+}
+
+// readFromConn reads length bytes from conn
+func readFromConn(conn net.Conn, length int) []byte {
+	buf := make([]byte, length)
 	count := 0
-	for count < MessageLen {
+	for count < length {
 		n, err := conn.Read(buf[count:])
 		if err != nil {
-			log.Printf("Connection to %s: %s\n",
-				conn.RemoteAddr(), err)
+			slog.Debug("Could not read from connection", "addr",
+				conn.RemoteAddr().String(), "error", err)
 			return nil
 		}
 		count += n
@@ -21,3 +21,25 @@ func TestWriteToReadFromConn(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestReadDataFromConn(t *testing.T) {
+	in, out := net.Pipe()
+	data := []byte{1, 2, 3, 4, 5, 6}
+	go func() {
+		if !WriteToConn(in, SerializeData(data)) {
+			log.Fatal("error writing to conn")
+		}
+	}()
+	want := data
+	got := ReadDataFromConn(out)
+	if bytes.Compare(got, want) != 0 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNewSessionID(t *testing.T) {
+	a, b := NewSessionID(), NewSessionID()
+	if len(a) != 8 || a == b {
+		t.Errorf("got %s and %s, want different IDs", a, b)
+	}
+}
@@ -4,17 +4,56 @@ import (
 	"bytes"
 	"encoding/binary"
 	"log"
+	"log/slog"
 )
 
 const (
 	MessageLen = 6
 
+	// DataLenLen is the length of the length prefix of data following a
+	// message
+	DataLenLen = 2
+
 	// message types
 	MessageOK  = 1
 	MessageAdd = 2
 	MessageDel = 3
 	MessageErr = 4
 	MessageNop = 5
+	// MessageAddPool is an add message followed by the name of a pool as
+	// data
+	MessageAddPool = 6
+	// MessageStandby is the reply to an add message if the port is in use
+	// and the service is queued as standby
+	MessageStandby = 7
+	// MessageActive tells the client that its standby service is active
+	MessageActive = 8
+	// MessageHealthy and MessageUnhealthy tell the client that the health
+	// checks of its service succeed or fail
+	MessageHealthy   = 9
+	MessageUnhealthy = 10
+	// MessageAddForward registers a local forward on the client to the
+	// target port and the target host in the following data
+	MessageAddForward = 11
+	// messages of streams, the port field contains the stream id
+	// MessageConnect opens a stream to the target port and the target
+	// host in the following data
+	MessageConnect = 12
+	// MessageConnected is the reply to a successful connect message
+	MessageConnected = 13
+	// MessageData is followed by data of the stream
+	MessageData = 14
+	// MessageAck acknowledges the number of data messages in the dest
+	// port field
+	MessageAck = 15
+	// MessageClose closes the stream for writing (dest port 0) or
+	// completely (dest port 1)
+	MessageClose = 16
+	// MessageAddStream is an add message for a tcp service whose peer
+	// connections are carried in streams over the control connection
+	// instead of connections to the destination port; it is followed by
+	// the name of a pool as data, which can be empty
+	MessageAddStream = 17
 
 	// protocol numbers
 	ProtocolTCP = 6
@@ -39,11 +78,28 @@ func (m *Message) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// SerializeWithData writes message and, if messages of its type are followed
+// by data, data with a length prefix to a byte slice
+func (m *Message) SerializeWithData(data []byte) []byte {
+	buf := m.Serialize()
+	if HasData(m.Op) {
+		buf = append(buf, SerializeData(data)...)
+	}
+	return buf
+}
+
 // Parse reads message from byte slice b
 func (m *Message) Parse(b []byte) {
 	buf := bytes.NewBuffer(b)
 	err := binary.Read(buf, binary.BigEndian, m)
 	if err != nil {
-		log.Println("error reading message:", err)
+		slog.Warn("Could not read message", "error", err)
 	}
 }
+
+// SerializeData writes data with a length prefix to a byte slice
+func SerializeData(data []byte) []byte {
+	buf := make([]byte, DataLenLen, DataLenLen+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	return append(buf, data...)
+}
@@ -35,3 +35,11 @@ func TestMessageParse(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestSerializeData(t *testing.T) {
+	want := []byte{0, 3, 'w', 'e', 'b'}
+	got := SerializeData([]byte("web"))
+	if bytes.Compare(got, want) != 0 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// PipeAddr is the address of a pipe connection, e.g., the name of the pipes
+type PipeAddr string
+
+// Network returns the network of the pipe address
+func (p PipeAddr) Network() string {
+	return "pipe"
+}
+
+// String converts the pipe address to a string
+func (p PipeAddr) String() string {
+	return string(p)
+}
+
+// readDeadliner and writeDeadliner are readers and writers with deadlines
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// PipeConn is a connection that reads from a reader and writes to a writer,
+// e.g., stdin and stdout or the pipes of a process
+type PipeConn struct {
+	io.Reader
+	io.Writer
+	close      func() error
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// Close closes the pipe connection
+func (p *PipeConn) Close() error {
+	return p.close()
+}
+
+// LocalAddr returns the local address of the pipe connection
+func (p *PipeConn) LocalAddr() net.Addr {
+	return p.localAddr
+}
+
+// RemoteAddr returns the remote address of the pipe connection
+func (p *PipeConn) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+// SetDeadline sets the read and write deadlines of the pipe connection
+func (p *PipeConn) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the pipe connection, if the
+// reader supports deadlines
+func (p *PipeConn) SetReadDeadline(t time.Time) error {
+	if r, ok := p.Reader.(readDeadliner); ok {
+		return r.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the pipe connection, if the
+// writer supports deadlines
+func (p *PipeConn) SetWriteDeadline(t time.Time) error {
+	if w, ok := p.Writer.(writeDeadliner); ok {
+		return w.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// NewPipeConn creates a new pipe connection that reads from r, writes to w
+// and is closed with close; localAddr and remoteAddr are its addresses
+func NewPipeConn(r io.Reader, w io.Writer, close func() error,
+	localAddr, remoteAddr net.Addr) *PipeConn {
+	return &PipeConn{
+		Reader:     r,
+		Writer:     w,
+		close:      close,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+	}
+}
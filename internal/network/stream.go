@@ -0,0 +1,545 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// StreamWindow is the number of data messages of a stream that can
+	// be sent without acknowledgment from the receiver
+	StreamWindow = 16
+	// StreamDataLen is the maximum length of data in a data message
+	StreamDataLen = 32 * 1024
+
+	// values of the DestPort field in close messages
+	streamCloseWrite = 0
+	streamCloseAll   = 1
+)
+
+var (
+	// ErrStreamRefused is returned when opening a stream is refused
+	ErrStreamRefused = errors.New("stream refused by remote side")
+	// ErrStreamClosed is returned when using a closed stream
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+// HasData checks if messages of type op are followed by data
+func HasData(op uint8) bool {
+	switch op {
+	case MessageAddPool, MessageAddForward, MessageConnect, MessageData,
+		MessageAddStream:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsStreamMessage checks if messages of type op belong to a stream
+func IsStreamMessage(op uint8) bool {
+	switch op {
+	case MessageConnect, MessageConnected, MessageData, MessageAck,
+		MessageClose:
+		return true
+	default:
+		return false
+	}
+}
+
+// StreamAddr is the address of a stream
+type StreamAddr struct {
+	Addr net.Addr
+	ID   uint16
+}
+
+// Network returns the network of the stream address
+func (s *StreamAddr) Network() string {
+	return "stream"
+}
+
+// String converts the stream address to a string
+func (s *StreamAddr) String() string {
+	return fmt.Sprintf("%s/%d", s.Addr, s.ID)
+}
+
+// Stream is a tcp connection or an udp association that is carried over a
+// control connection. For udp, each write is sent as one datagram and each
+// read returns one datagram
+type Stream struct {
+	streams  *Streams
+	id       uint16
+	protocol uint8
+	// Host and Port are the target of the stream
+	Host string
+	Port uint16
+
+	// recv contains received data, it is closed when the remote side
+	// closes the stream for writing
+	recv chan []byte
+	buf  []byte
+	// credits contains a token for each data message that can be sent
+	credits chan struct{}
+	// connected receives the result of opening the stream
+	connected chan bool
+	// done is closed when the stream is closed locally and remoteDone
+	// is closed when the stream is closed by the remote side
+	done       chan struct{}
+	remoteDone chan struct{}
+
+	// mutex protects the following fields
+	mutex        sync.Mutex
+	sentEOF      bool
+	recvEOF      bool
+	closed       bool
+	remoteClosed bool
+	acks         int
+	readDeadline time.Time
+}
+
+// sendClose sends a close message with the close type how, if the stream is
+// not closed for writing yet, and removes the stream if it is done
+func (s *Stream) sendClose(how uint16) {
+	s.mutex.Lock()
+	if s.sentEOF {
+		s.mutex.Unlock()
+		return
+	}
+	s.sentEOF = true
+	s.mutex.Unlock()
+
+	s.streams.send(&Message{
+		Op:       MessageClose,
+		Protocol: s.protocol,
+		Port:     s.id,
+		DestPort: how,
+	}, nil)
+	s.streams.removeIfDone(s)
+}
+
+// Read reads data from the stream
+func (s *Stream) Read(b []byte) (int, error) {
+	if len(s.buf) == 0 {
+		var timeout <-chan time.Time
+		s.mutex.Lock()
+		deadline := s.readDeadline
+		s.mutex.Unlock()
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case data, ok := <-s.recv:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.buf = data
+			s.ack()
+		case <-s.done:
+			return 0, ErrStreamClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	if s.protocol == ProtocolUDP {
+		// do not return the rest of the datagram in the next read
+		s.buf = nil
+	}
+	return n, nil
+}
+
+// ack acknowledges a received data message; acknowledgments are sent for
+// half of the window at once
+func (s *Stream) ack() {
+	s.mutex.Lock()
+	s.acks++
+	acks := s.acks
+	if acks < StreamWindow/2 {
+		s.mutex.Unlock()
+		return
+	}
+	s.acks = 0
+	s.mutex.Unlock()
+
+	s.streams.send(&Message{
+		Op:       MessageAck,
+		Protocol: s.protocol,
+		Port:     s.id,
+		DestPort: uint16(acks),
+	}, nil)
+}
+
+// writeData sends b in a data message
+func (s *Stream) writeData(b []byte) bool {
+	return s.streams.send(&Message{
+		Op:       MessageData,
+		Protocol: s.protocol,
+		Port:     s.id,
+	}, b)
+}
+
+// writeDatagram sends the datagram b; if the window is full, the datagram is
+// dropped
+func (s *Stream) writeDatagram(b []byte) (int, error) {
+	if len(b) > StreamDataLen {
+		return 0, fmt.Errorf("datagram too large")
+	}
+	select {
+	case <-s.done:
+		return 0, ErrStreamClosed
+	case <-s.remoteDone:
+		return 0, ErrStreamClosed
+	default:
+	}
+	select {
+	case <-s.credits:
+	default:
+		// drop datagram
+		return len(b), nil
+	}
+	if !s.writeData(b) {
+		return 0, ErrStreamClosed
+	}
+	return len(b), nil
+}
+
+// Write writes data to the stream
+func (s *Stream) Write(b []byte) (int, error) {
+	if s.protocol == ProtocolUDP {
+		return s.writeDatagram(b)
+	}
+
+	count := 0
+	for count < len(b) {
+		n := min(len(b)-count, StreamDataLen)
+		select {
+		case <-s.credits:
+		case <-s.done:
+			return count, ErrStreamClosed
+		case <-s.remoteDone:
+			return count, ErrStreamClosed
+		}
+		if !s.writeData(b[count : count+n]) {
+			return count, ErrStreamClosed
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// CloseWrite closes the writing side of the stream
+func (s *Stream) CloseWrite() error {
+	s.sendClose(streamCloseWrite)
+	return nil
+}
+
+// Close closes the stream
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mutex.Unlock()
+
+	s.sendClose(streamCloseAll)
+	return nil
+}
+
+// LocalAddr returns the local address of the stream
+func (s *Stream) LocalAddr() net.Addr {
+	return &StreamAddr{Addr: s.streams.localAddr, ID: s.id}
+}
+
+// RemoteAddr returns the remote address of the stream
+func (s *Stream) RemoteAddr() net.Addr {
+	return &StreamAddr{Addr: s.streams.remoteAddr, ID: s.id}
+}
+
+// SetDeadline sets the read deadline of the stream, write deadlines are not
+// supported
+func (s *Stream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline is not supported and does nothing
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Accept accepts the stream opened by the remote side
+func (s *Stream) Accept() bool {
+	return s.streams.send(&Message{
+		Op:       MessageConnected,
+		Protocol: s.protocol,
+		Port:     s.id,
+	}, nil)
+}
+
+// Protocol returns the protocol of the stream
+func (s *Stream) Protocol() uint8 {
+	return s.protocol
+}
+
+// Streams stores the streams of a control connection. Streams opened by the
+// server have even ids and streams opened by the client have odd ids, so
+// both sides can open streams
+type Streams struct {
+	mutex   sync.Mutex
+	send    func(msg *Message, data []byte) bool
+	streams map[uint16]*Stream
+	nextID  uint16
+	// parity is the parity of the ids of locally opened streams
+	parity     uint16
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	// accept is called in a new goroutine for streams opened by the remote
+	// side, it must accept or close the stream
+	accept func(s *Stream)
+}
+
+// newStream creates a new stream with id, protocol and target host and port
+func (s *Streams) newStream(id uint16, protocol uint8, host string,
+	port uint16) *Stream {
+	stream := &Stream{
+		streams:    s,
+		id:         id,
+		protocol:   protocol,
+		Host:       host,
+		Port:       port,
+		recv:       make(chan []byte, StreamWindow),
+		credits:    make(chan struct{}, StreamWindow),
+		connected:  make(chan bool, 1),
+		done:       make(chan struct{}),
+		remoteDone: make(chan struct{}),
+	}
+	for i := 0; i < StreamWindow; i++ {
+		stream.credits <- struct{}{}
+	}
+	return stream
+}
+
+// removeIfDone removes stream if it is closed in both directions
+func (s *Streams) removeIfDone(stream *Stream) {
+	stream.mutex.Lock()
+	done := stream.sentEOF && stream.recvEOF
+	stream.mutex.Unlock()
+	if !done {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams[stream.id] == stream {
+		delete(s.streams, stream.id)
+	}
+}
+
+// Open opens a new stream with protocol to the target host and port on the
+// remote side
+func (s *Streams) Open(protocol uint8, host string, port uint16) (*Stream,
+	error) {
+	return s.OpenContext(context.Background(), protocol, host, port)
+}
+
+// OpenContext opens a new stream like Open, but stops waiting for the reply
+// of the remote side and closes the stream when ctx is done
+func (s *Streams) OpenContext(ctx context.Context, protocol uint8,
+	host string, port uint16) (*Stream, error) {
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+
+	// allocate stream id
+	s.mutex.Lock()
+	if len(s.streams) >= 1<<15-1 {
+		s.mutex.Unlock()
+		return nil, errors.New("too many streams")
+	}
+	for {
+		s.nextID += 2
+		if s.nextID != 0 && s.streams[s.nextID] == nil {
+			break
+		}
+	}
+	stream := s.newStream(s.nextID, protocol, host, port)
+	s.streams[stream.id] = stream
+	s.mutex.Unlock()
+
+	// send connect message and wait for reply
+	if !s.send(&Message{
+		Op:       MessageConnect,
+		Protocol: protocol,
+		Port:     stream.id,
+		DestPort: port,
+	}, []byte(host)) {
+		stream.Close()
+		return nil, ErrStreamClosed
+	}
+	select {
+	case ok := <-stream.connected:
+		if !ok {
+			stream.Close()
+			return nil, ErrStreamRefused
+		}
+	case <-ctx.Done():
+		stream.Close()
+		return nil, ctx.Err()
+	}
+	return stream, nil
+}
+
+// Handle handles the stream message msg with data and returns false if the
+// message is invalid
+func (s *Streams) Handle(msg *Message, data []byte) bool {
+	s.mutex.Lock()
+	stream := s.streams[msg.Port]
+	if msg.Op == MessageConnect {
+		if stream != nil || s.accept == nil || len(data) == 0 ||
+			msg.Port%2 == s.parity {
+			s.mutex.Unlock()
+			return false
+		}
+		stream = s.newStream(msg.Port, msg.Protocol, string(data),
+			msg.DestPort)
+		s.streams[msg.Port] = stream
+		s.mutex.Unlock()
+		go s.accept(stream)
+		return true
+	}
+	s.mutex.Unlock()
+	if stream == nil {
+		// stream has been removed, ignore message
+		return true
+	}
+
+	switch msg.Op {
+	case MessageConnected:
+		select {
+		case stream.connected <- true:
+		default:
+		}
+	case MessageData:
+		stream.mutex.Lock()
+		defer stream.mutex.Unlock()
+		if stream.recvEOF {
+			return false
+		}
+		if stream.closed {
+			// stream is closed locally, drop data
+			return true
+		}
+		select {
+		case stream.recv <- data:
+		default:
+			// remote side does not respect the window
+			return false
+		}
+	case MessageAck:
+		for i := 0; i < int(msg.DestPort); i++ {
+			select {
+			case stream.credits <- struct{}{}:
+			default:
+			}
+		}
+	case MessageClose:
+		stream.mutex.Lock()
+		if stream.recvEOF {
+			stream.mutex.Unlock()
+			return false
+		}
+		stream.recvEOF = true
+		close(stream.recv)
+		if msg.DestPort == streamCloseAll {
+			stream.remoteClosed = true
+			close(stream.remoteDone)
+		}
+		stream.mutex.Unlock()
+
+		// opening the stream failed
+		select {
+		case stream.connected <- false:
+		default:
+		}
+		s.removeIfDone(stream)
+	}
+	return true
+}
+
+// CloseAll closes all streams, e.g., because the control connection is
+// closed
+func (s *Streams) CloseAll() {
+	s.mutex.Lock()
+	streams := s.streams
+	s.streams = make(map[uint16]*Stream)
+	s.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.mutex.Lock()
+		if !stream.recvEOF {
+			stream.recvEOF = true
+			close(stream.recv)
+		}
+		if !stream.remoteClosed {
+			stream.remoteClosed = true
+			close(stream.remoteDone)
+		}
+		stream.sentEOF = true
+		stream.mutex.Unlock()
+		select {
+		case stream.connected <- false:
+		default:
+		}
+	}
+}
+
+// Count returns the number of streams
+func (s *Streams) Count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.streams)
+}
+
+// NewStreams creates new streams for the control connection conn on the
+// server, if server is true, or on the client. Messages are sent with send
+// and streams opened by the remote side are passed to accept; if accept is
+// nil, the remote side cannot open streams
+func NewStreams(conn net.Conn, server bool,
+	send func(msg *Message, data []byte) bool,
+	accept func(s *Stream)) *Streams {
+	s := &Streams{
+		send:       send,
+		streams:    make(map[uint16]*Stream),
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+		accept:     accept,
+	}
+	if !server {
+		// the first id of the client is 1
+		s.parity = 1
+		s.nextID = 1<<16 - 1
+	}
+	return s
+}
@@ -0,0 +1,187 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStreams creates two connected streams of a client (local) and a
+// server (remote), both sides accept streams with accept
+func testStreams(accept func(s *Stream)) (*Streams, *Streams, func()) {
+	localConn, remoteConn := net.Pipe()
+	var localMutex, remoteMutex sync.Mutex
+	send := func(conn net.Conn, mutex *sync.Mutex) func(*Message,
+		[]byte) bool {
+		return func(msg *Message, data []byte) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return WriteToConn(conn, msg.SerializeWithData(data))
+		}
+	}
+	local := NewStreams(localConn, false, send(localConn, &localMutex),
+		accept)
+	remote := NewStreams(remoteConn, true, send(remoteConn, &remoteMutex),
+		accept)
+	read := func(conn net.Conn, streams *Streams) {
+		for {
+			msg, data := ReadMessageFromConn(conn)
+			if msg == nil || !streams.Handle(msg, data) {
+				streams.CloseAll()
+				return
+			}
+		}
+	}
+	go read(localConn, local)
+	go read(remoteConn, remote)
+	return local, remote, func() {
+		localConn.Close()
+		remoteConn.Close()
+	}
+}
+
+// echoStream accepts s and echoes data until s is closed for writing
+func echoStream(s *Stream) {
+	if s.Host != "echo" {
+		s.Close()
+		return
+	}
+	s.Accept()
+	io.Copy(s, s)
+	s.CloseWrite()
+}
+
+func TestStreamEcho(t *testing.T) {
+	local, remote, stop := testStreams(echoStream)
+	defer stop()
+
+	s, err := local.Open(ProtocolTCP, "echo", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send more data than fits into the window
+	want := bytes.Repeat([]byte("0123456789abcdef"),
+		2*StreamWindow*StreamDataLen/16)
+	go func() {
+		s.Write(want)
+		s.CloseWrite()
+	}()
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	// stream is removed on both sides when it is closed, give the
+	// remote side some time to handle the close message
+	s.Close()
+	if n := local.Count(); n != 0 {
+		t.Errorf("got %d, want 0", n)
+	}
+	for i := 0; i < 100 && remote.Count() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := remote.Count(); n != 0 {
+		t.Errorf("got %d, want 0", n)
+	}
+}
+
+func TestStreamRefused(t *testing.T) {
+	local, _, stop := testStreams(echoStream)
+	defer stop()
+
+	if _, err := local.Open(ProtocolTCP, "other", 7); err !=
+		ErrStreamRefused {
+		t.Errorf("got %v, want %v", err, ErrStreamRefused)
+	}
+}
+
+func TestStreamOpenContext(t *testing.T) {
+	// remote side never accepts or refuses streams
+	local, _, stop := testStreams(func(s *Stream) {})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, err := local.OpenContext(ctx, ProtocolTCP, "echo", 7)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStreamUDP(t *testing.T) {
+	local, _, stop := testStreams(echoStream)
+	defer stop()
+
+	s, err := local.Open(ProtocolUDP, "echo", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// each read returns one datagram
+	for _, want := range [][]byte{{1, 2, 3}, {4}, {5, 6}} {
+		s.Write(want)
+		buf := make([]byte, 16)
+		n, err := s.Read(buf)
+		if err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("got %v, want %v", buf[:n], want)
+		}
+	}
+}
+
+func TestStreamsCloseAll(t *testing.T) {
+	local, _, stop := testStreams(echoStream)
+	s, err := local.Open(ProtocolTCP, "echo", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the control connection closes the stream
+	stop()
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+	if _, err := s.Write([]byte{1}); err != ErrStreamClosed {
+		t.Errorf("got %v, want %v", err, ErrStreamClosed)
+	}
+}
+
+func TestStreamBothSides(t *testing.T) {
+	local, remote, stop := testStreams(echoStream)
+	defer stop()
+
+	// open streams on both sides at the same time, ids must not clash
+	var wg sync.WaitGroup
+	for _, streams := range []*Streams{local, remote, local, remote} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := streams.Open(ProtocolTCP, "echo", 7)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			want := []byte("hello")
+			s.Write(want)
+			s.CloseWrite()
+			got, err := io.ReadAll(s)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+			s.Close()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,305 @@
+package network
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// websocket opcodes
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xa
+
+	// webSocketGUID is used to compute the accept key in handshakes
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	// errWebSocketFrame is returned for invalid websocket frames
+	errWebSocketFrame = errors.New("invalid websocket frame")
+)
+
+// webSocketAccept returns the accept key for the websocket key
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains checks if the comma-separated list in header contains
+// token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketConn is a websocket connection that carries a byte stream in
+// binary messages. Reads return the data of received messages and each
+// write is sent as one binary message
+type WebSocketConn struct {
+	net.Conn
+	r *bufio.Reader
+	// client specifies if this is the client side of the connection,
+	// clients mask their frames
+	client bool
+
+	// writeMutex serializes frames, because control frames are sent
+	// while reading
+	writeMutex sync.Mutex
+
+	// state of the current data frame
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+}
+
+// writeFrame sends a frame with opcode and payload
+func (w *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	buf := make([]byte, 0, len(payload)+14)
+	buf = append(buf, 0x80|opcode)
+	maskBit := byte(0)
+	if w.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+	if w.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range payload {
+			buf[start+i] ^= mask[i%4]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	_, err := w.Conn.Write(buf)
+	return err
+}
+
+// unmask unmasks the data b of the current frame
+func (w *WebSocketConn) unmask(b []byte) {
+	if !w.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= w.mask[w.maskPos%4]
+		w.maskPos++
+	}
+}
+
+// readFrame reads the next frame header and handles control frames. For
+// data frames, the payload is read by the caller
+func (w *WebSocketConn) readFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(w.r, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	w.masked = header[1]&0x80 != 0
+	if w.masked == w.client {
+		// only clients mask their frames
+		return errWebSocketFrame
+	}
+
+	// get payload length and mask
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(w.r, header); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(header))
+	case 127:
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(w.r, buf); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(buf)
+	}
+	if w.masked {
+		if _, err := io.ReadFull(w.r, w.mask[:]); err != nil {
+			return err
+		}
+	}
+	w.maskPos = 0
+
+	// handle data frames
+	switch opcode {
+	case webSocketOpContinuation, webSocketOpText, webSocketOpBinary:
+		w.remaining = length
+		return nil
+	}
+
+	// handle control frames
+	if length > 125 {
+		return errWebSocketFrame
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(w.r, payload); err != nil {
+		return err
+	}
+	w.unmask(payload)
+	switch opcode {
+	case webSocketOpClose:
+		w.writeFrame(webSocketOpClose, nil)
+		return io.EOF
+	case webSocketOpPing:
+		return w.writeFrame(webSocketOpPong, payload)
+	case webSocketOpPong:
+		return nil
+	default:
+		return errWebSocketFrame
+	}
+}
+
+// Read reads data from the websocket connection
+func (w *WebSocketConn) Read(b []byte) (int, error) {
+	for w.remaining == 0 {
+		if err := w.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > w.remaining {
+		b = b[:w.remaining]
+	}
+	n, err := w.r.Read(b)
+	w.unmask(b[:n])
+	w.remaining -= uint64(n)
+	return n, err
+}
+
+// Write writes b as one binary message to the websocket connection
+func (w *WebSocketConn) Write(b []byte) (int, error) {
+	if err := w.writeFrame(webSocketOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close frame and closes the websocket connection
+func (w *WebSocketConn) Close() error {
+	w.writeFrame(webSocketOpClose, []byte{0x03, 0xe8})
+	return w.Conn.Close()
+}
+
+// DialWebSocket opens a websocket connection to u over conn
+func DialWebSocket(conn net.Conn, u *url.URL) (*WebSocketConn, error) {
+	// send upgrade request
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(buf)
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	// check response
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade failed: %s",
+			resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("websocket upgrade failed: invalid " +
+			"accept key")
+	}
+	return &WebSocketConn{
+		Conn:   conn,
+		r:      r,
+		client: true,
+	}, nil
+}
+
+// AcceptWebSocket accepts the websocket upgrade request r and returns the
+// websocket connection; if the request is invalid, it sends an error to w
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn,
+	error) {
+	// check upgrade request
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "websocket upgrade required",
+			http.StatusBadRequest)
+		return nil, errors.New("invalid websocket upgrade request")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported",
+			http.StatusInternalServerError)
+		return nil, errors.New("websocket upgrade not supported")
+	}
+
+	// take over connection and send response
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if !WriteToConn(conn, []byte(resp)) {
+		conn.Close()
+		return nil, errors.New("websocket upgrade failed")
+	}
+	return &WebSocketConn{
+		Conn: conn,
+		r:    rw.Reader,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// example from rfc 6455
+	want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	got := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWebSocketConn(t *testing.T) {
+	// start http server that echoes data in websocket connections
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := AcceptWebSocket(w, r)
+			if err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+		}))
+	defer server.Close()
+
+	// plain http requests are rejected
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", resp.StatusCode,
+			http.StatusBadRequest)
+	}
+
+	// open websocket connection
+	u, err := url.Parse(server.URL + "/control")
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.Scheme = "ws"
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ws, err := DialWebSocket(conn, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// send messages with all payload length encodings and a ping
+	for _, n := range []int{1, 125, 126, 65535, 65536, 100000} {
+		want := bytes.Repeat([]byte{byte(n)}, n)
+		if _, err := ws.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		if n == 126 {
+			ws.writeFrame(webSocketOpPing, []byte("ping"))
+		}
+		got := make([]byte, n)
+		if _, err := io.ReadFull(ws, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %d bytes, want %d bytes", len(got),
+				len(want))
+		}
+	}
+}
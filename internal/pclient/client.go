@@ -0,0 +1,176 @@
+package pclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	// eventsLen is the length of the events channel of clients
+	eventsLen = 64
+)
+
+var (
+	// ErrRejected is returned if the server rejects a request
+	ErrRejected = errors.New("rejected by server")
+	// ErrClosed is returned if the connection to the server is closed
+	ErrClosed = errors.New("connection to server closed")
+	// ErrInvalidReply is returned if the server sends an invalid reply,
+	// the connection to the server is closed
+	ErrInvalidReply = errors.New("invalid reply from server")
+)
+
+// RequestError is the error of a request to the server
+type RequestError struct {
+	// Op is the operation of the request, e.g., "register"
+	Op string
+	// Spec is the service specification of the request
+	Spec ServiceSpec
+	// Err is the reason of the error, e.g., ErrRejected
+	Err error
+}
+
+// Error returns the error as string
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, &e.Spec, e.Err)
+}
+
+// Unwrap returns the reason of the error
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// EventType is the type of a client event
+type EventType uint8
+
+// event types
+const (
+	// EventActive is sent if a standby service becomes active
+	EventActive EventType = iota + 1
+	// EventRemoved is sent if the server removes a service
+	EventRemoved
+	// EventHealthy is sent if the health check of a service succeeds
+	EventHealthy
+	// EventUnhealthy is sent if the health check of a service fails
+	EventUnhealthy
+	// EventDisconnected is sent if the connection to the server is closed
+	EventDisconnected
+)
+
+// String converts the event type to a string
+func (e EventType) String() string {
+	switch e {
+	case EventActive:
+		return "active"
+	case EventRemoved:
+		return "removed"
+	case EventHealthy:
+		return "healthy"
+	case EventUnhealthy:
+		return "unhealthy"
+	case EventDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a state change of a service or the client
+type Event struct {
+	Type EventType
+	// Service is the service of the event, it is empty for
+	// EventDisconnected
+	Service ServiceSpec
+}
+
+// Registration is a service registration on the server
+type Registration struct {
+	Service ServiceSpec
+	// Standby specifies if the service is queued as standby, because
+	// the port is used by another client
+	Standby bool
+}
+
+// Client is a control client that registers services at runtime, e.g., as
+// part of another program
+type Client struct {
+	c *controlClient
+}
+
+// Register registers the service spec on the server
+func (c *Client) Register(spec *ServiceSpec) (Registration, error) {
+	s, standby, err := c.c.register(spec)
+	if err != nil {
+		return Registration{}, err
+	}
+	return Registration{Service: *s, Standby: standby}, nil
+}
+
+// Listen registers a service on the server and returns a listener for its
+// peer connections, which are forwarded over the control connection. Only
+// the network "tcp" is supported, the port in address is the port on the
+// server, if it is 0, the server chooses a free port. ctx limits the time
+// for registering
+func (c *Client) Listen(ctx context.Context, network, address string) (
+	net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("network %s not supported", network)
+	}
+	_, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", p)
+	}
+	l, err := c.c.listen(ctx, uint16(port))
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Unregister removes the registration r from the server
+func (c *Client) Unregister(r Registration) error {
+	return c.c.unregister(&r.Service)
+}
+
+// Events returns the channel of the client's events. Events are dropped if
+// the channel is full, it is closed after the client is disconnected
+func (c *Client) Events() <-chan Event {
+	return c.c.events
+}
+
+// Done returns a channel that is closed when the client is disconnected
+func (c *Client) Done() <-chan struct{} {
+	return c.c.done
+}
+
+// Close closes the connection to the server, which removes all services of
+// the client
+func (c *Client) Close() error {
+	c.c.close()
+	return nil
+}
+
+// Connect connects a new client to the server with configuration config;
+// the services, local forwards and socks5 proxy in config are not used. ctx
+// limits the time for connecting
+func Connect(ctx context.Context, config *Config) (*Client, error) {
+	c := controlClient{
+		serverAddr: config.ServerAddr,
+		wsURL:      config.WebSocketURL,
+		proxyURL:   config.ProxyURL,
+		proxyCmd:   config.ProxyCommand,
+		tlsConfig:  config.TLSConfig,
+		events:     make(chan Event, eventsLen),
+	}
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return &Client{c: &c}, nil
+}
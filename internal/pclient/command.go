@@ -0,0 +1,37 @@
+package pclient
+
+import (
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// dialCommand starts command in a shell and returns a connection over the
+// command's stdin and stdout; stderr of the command is passed through
+func dialCommand(command string) (net.Conn, error) {
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// closing the connection stops the command
+	close := func() error {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil
+	}
+	return network.NewPipeConn(stdout, stdin, close,
+		network.PipeAddr("stdio"), network.PipeAddr(command)), nil
+}
@@ -0,0 +1,31 @@
+package pclient
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDialCommand(t *testing.T) {
+	// cat echoes data written to the connection
+	conn, err := dialCommand("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := []byte("hello world")
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := conn.RemoteAddr().String(); got != "cat" {
+		t.Errorf("got %s, want cat", got)
+	}
+}
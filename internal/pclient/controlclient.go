@@ -1,129 +1,613 @@
 package pclient
 
 import (
+	"context"
 	"crypto/tls"
-	"fmt"
+	"errors"
 	"log"
+	"log/slog"
 	"net"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hwipl/service-proxy/internal/network"
 )
 
+// Config stores the configuration of the control client
+type Config struct {
+	// ServerAddr is the address of the control server as host and port,
+	// the host is resolved when connecting or, with ProxyURL, by the
+	// proxy; it can be empty if ProxyCommand is set
+	ServerAddr string
+	// WebSocketURL is the url of the control server's websocket listener,
+	// if it is not nil, the control connection is a websocket connection
+	// to ServerAddr
+	WebSocketURL *url.URL
+	// ProxyURL is the url of an http or socks5 proxy the client connects
+	// to the server through, if it is nil, no proxy is used
+	ProxyURL *url.URL
+	// ProxyCommand is a command the client starts in a shell, the control
+	// connection runs over its stdin and stdout instead of a connection
+	// to ServerAddr
+	ProxyCommand string
+	// TLSConfig is the tls configuration of the control client, if it
+	// is nil, tls is not used
+	TLSConfig *tls.Config
+	// Services is a comma-separated list of service specifications
+	Services string
+	// Forwards is a comma-separated list of local forward specifications
+	Forwards string
+	// Socks is the address of a local socks5 proxy that forwards its
+	// connections through the server, if it is empty, no proxy is started
+	Socks string
+}
+
 // controlClient stores control client information
 type controlClient struct {
-	serverAddr *net.TCPAddr
+	serverAddr string
+	wsURL      *url.URL
+	proxyURL   *url.URL
+	proxyCmd   string
 	tlsConfig  *tls.Config
 	specs      []*ServiceSpec
+	forwards   []*ForwardSpec
+	socks      string
 	conn       net.Conn
+	streams    *network.Streams
+	// session is the ID of the control connection in log messages
+	session string
+	// events receives the events of the client, if it is not nil
+	events chan Event
+	// done is closed when the control connection is closed
+	done chan struct{}
+	// sendMutex serializes messages to the server, because streams send
+	// messages from their own goroutines
+	sendMutex sync.Mutex
+	// requestMutex serializes requests, so that replies arrive in the
+	// order of the pending requests
+	requestMutex sync.Mutex
+
+	// mutex protects the following fields
+	mutex sync.Mutex
+	// registered are the services registered on the server
+	registered []*ServiceSpec
+	// pending are the channels of the requests waiting for a reply
+	pending []chan *network.Message
+	closed  bool
+	// listeners are the listeners for peer connections in streams,
+	// identified by the destination ports of their services
+	listeners    map[uint16]*streamListener
+	nextListener uint16
 }
 
-// runClient runs the control client
-func (c *controlClient) runClient() {
-	// connect to server
-	conn, err := net.DialTCP("tcp", nil, c.serverAddr)
+// send sends buf to the server, it is safe for concurrent use
+func (c *controlClient) send(buf []byte) bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	return network.WriteToConn(c.conn, buf)
+}
+
+// sendWithData sends msg and, if messages of its type are followed by data,
+// data to the server, it is safe for concurrent use
+func (c *controlClient) sendWithData(msg *network.Message, data []byte) bool {
+	return c.send(msg.SerializeWithData(data))
+}
+
+// sendEvent sends an event with type t and service spec to the events
+// channel, if there is one; if the channel is full, the event is dropped
+func (c *controlClient) sendEvent(t EventType, spec *ServiceSpec) {
+	if c.events == nil {
+		return
+	}
+	e := Event{Type: t}
+	if spec != nil {
+		e.Service = *spec
+	}
+	select {
+	case c.events <- e:
+	default:
+	}
+}
+
+// findRegistered returns the index of the registered service with protocol
+// and port or -1 if there is none. The caller must hold the mutex
+func (c *controlClient) findRegistered(protocol string, port uint16) int {
+	for i, s := range c.registered {
+		if s.Protocol == protocol && s.Port == port {
+			return i
+		}
+	}
+	return -1
+}
+
+// addRegistered adds spec to the registered services
+func (c *controlClient) addRegistered(spec *ServiceSpec) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.registered = append(c.registered, spec)
+}
+
+// delRegistered removes the service with protocol and port from the
+// registered services
+func (c *controlClient) delRegistered(protocol string, port uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if i := c.findRegistered(protocol, port); i >= 0 {
+		c.registered = append(c.registered[:i], c.registered[i+1:]...)
+	}
+}
+
+// log returns the logger for log messages of the client, it adds the
+// session ID of the control connection
+func (c *controlClient) log() *slog.Logger {
+	return slog.Default().With("session", c.session)
+}
+
+// handleNotification handles msg if it is a notification from the server
+// about a standby service or the health of a service and returns whether msg
+// has been handled
+func (c *controlClient) handleNotification(msg *network.Message) bool {
+	var spec ServiceSpec
+	spec.FromMessage(msg)
+	c.mutex.Lock()
+	if i := c.findRegistered(spec.Protocol, spec.Port); i >= 0 {
+		spec.Pool = c.registered[i].Pool
+	}
+	c.mutex.Unlock()
+	log := c.log().With(spec.logArgs()...)
+	switch msg.Op {
+	case network.MessageActive:
+		log.Info("Server: standby service registration ACTIVE")
+		c.sendEvent(EventActive, &spec)
+		return true
+	case network.MessageDel:
+		log.Warn("Server: service registration REMOVED")
+		c.delRegistered(spec.Protocol, spec.Port)
+		c.sendEvent(EventRemoved, &spec)
+		return true
+	case network.MessageHealthy:
+		log.Info("Server: health check of service registration " +
+			"HEALTHY")
+		c.sendEvent(EventHealthy, &spec)
+		return true
+	case network.MessageUnhealthy:
+		log.Warn("Server: health check of service registration " +
+			"UNHEALTHY")
+		c.sendEvent(EventUnhealthy, &spec)
+		return true
+	default:
+		return false
+	}
+}
+
+// handleReply passes the reply msg to the oldest pending request, it returns
+// false if there is no pending request
+func (c *controlClient) handleReply(msg *network.Message) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.pending) == 0 {
+		return false
+	}
+	c.pending[0] <- msg
+	c.pending = c.pending[1:]
+	return true
+}
+
+// runReader reads messages from the server until the connection is closed.
+// It handles notifications and stream messages and passes other messages as
+// replies to the pending requests
+func (c *controlClient) runReader() {
+	defer func() {
+		c.close()
+		c.log().Info("Closing connection to server")
+		if c.events != nil {
+			c.sendEvent(EventDisconnected, nil)
+			close(c.events)
+		}
+	}()
+	for {
+		msg, data := network.ReadMessageFromConn(c.conn)
+		if msg == nil {
+			return
+		}
+		if network.IsStreamMessage(msg.Op) {
+			if !c.streams.Handle(msg, data) {
+				c.log().Warn("Invalid stream message from " +
+					"server")
+				return
+			}
+			continue
+		}
+		if c.handleNotification(msg) {
+			continue
+		}
+		if !c.handleReply(msg) {
+			c.log().Warn("Unexpected message from server")
+			return
+		}
+	}
+}
+
+// runKeepAlive sends keep-alive messages to the server until the connection
+// is closed
+func (c *controlClient) runKeepAlive() {
+	for {
+		// send a keep-alive/NOP message every 15 seconds
+		select {
+		case <-time.After(15 * time.Second):
+		case <-c.done:
+			return
+		}
+		keepAlive := network.Message{Op: network.MessageNop}
+		if !c.send(keepAlive.Serialize()) {
+			return
+		}
+	}
+}
+
+// close closes the control connection and its streams and fails all pending
+// requests
+func (c *controlClient) close() {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	for _, p := range c.pending {
+		close(p)
+	}
+	c.pending = nil
+	c.mutex.Unlock()
+
+	c.conn.Close()
+	c.streams.CloseAll()
+	close(c.done)
+}
+
+// request sends the request in buf to the server and returns the reply
+func (c *controlClient) request(buf []byte) (*network.Message, error) {
+	reply := make(chan *network.Message, 1)
+	c.requestMutex.Lock()
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		c.requestMutex.Unlock()
+		return nil, ErrClosed
+	}
+	c.pending = append(c.pending, reply)
+	c.mutex.Unlock()
+	ok := c.send(buf)
+	c.requestMutex.Unlock()
+	if !ok {
+		c.close()
+	}
+
+	msg, ok := <-reply
+	if !ok {
+		return nil, ErrClosed
+	}
+	return msg, nil
+}
+
+// register registers the service spec on the server. It returns the
+// registered service, with the port chosen by the server if the port in spec
+// is 0, and whether the service is queued as standby
+func (c *controlClient) register(spec *ServiceSpec) (*ServiceSpec, bool,
+	error) {
+	if err := spec.check(); err != nil {
+		return nil, false, err
+	}
+	data, err := spec.Serialize()
 	if err != nil {
-		log.Fatal(err)
+		return nil, false, err
+	}
+	log := c.log().With(spec.logArgs()...)
+	log.Info("Sending service registration to server")
+	msg, err := c.request(data)
+	if err != nil {
+		return nil, false, &RequestError{Op: "register", Spec: *spec,
+			Err: err}
+	}
+
+	// handle message types
+	reply := *spec
+	reply.FromMessage(msg)
+	log = c.log().With(reply.logArgs()...)
+	switch msg.Op {
+	case network.MessageOK:
+		log.Info("Server reply: service registration OK")
+		c.addRegistered(&reply)
+		return &reply, false, nil
+	case network.MessageStandby:
+		log.Info("Server reply: service registration STANDBY")
+		c.addRegistered(&reply)
+		return &reply, true, nil
+	case network.MessageErr:
+		log.Warn("Server reply: service registration ERROR")
+		err = ErrRejected
+	default:
+		// unknown message, stop here
+		log.Error("Unknown reply from server, closing connection")
+		c.close()
+		err = ErrInvalidReply
+	}
+	return nil, false, &RequestError{Op: "register", Spec: *spec,
+		Err: err}
+}
+
+// unregister removes the registration of the service spec from the server
+func (c *controlClient) unregister(spec *ServiceSpec) error {
+	if err := spec.check(); err != nil {
+		return err
+	}
+	msg, err := spec.ToMessage()
+	if err != nil {
+		return err
+	}
+	msg.Op = network.MessageDel
+	log := c.log().With(spec.logArgs()...)
+	log.Info("Sending service removal to server")
+	reply, err := c.request(msg.Serialize())
+	if err != nil {
+		return &RequestError{Op: "unregister", Spec: *spec, Err: err}
+	}
+
+	// handle message types
+	switch reply.Op {
+	case network.MessageOK:
+		log.Info("Server reply: service removal OK")
+		c.delRegistered(spec.Protocol, spec.Port)
+		return nil
+	case network.MessageErr:
+		log.Warn("Server reply: service removal ERROR")
+		err = ErrRejected
+	default:
+		// unknown message, stop here
+		log.Error("Unknown reply from server, closing connection")
+		c.close()
+		err = ErrInvalidReply
+	}
+	return &RequestError{Op: "unregister", Spec: *spec, Err: err}
+}
+
+// addForward registers the local forward spec on the server
+func (c *controlClient) addForward(spec *ForwardSpec) error {
+	log := c.log().With(spec.logArgs()...)
+	log.Info("Sending local forward registration to server")
+	msg, err := c.request(spec.Serialize())
+	if err != nil {
+		return err
+	}
+
+	// handle message types
+	switch msg.Op {
+	case network.MessageOK:
+		log.Info("Server reply: local forward registration OK")
+		return nil
+	case network.MessageErr:
+		log.Warn("Server reply: local forward registration ERROR")
+		return ErrRejected
+	default:
+		// unknown message, stop here
+		log.Error("Unknown reply from server, closing connection")
+		c.close()
+		return ErrInvalidReply
+	}
+}
+
+// serverIP returns the IP address of the server, i.e., the host in the
+// server address if it is an IP address or the remote address of a direct
+// control connection; it returns nil if the IP address is unknown
+func (c *controlClient) serverIP() net.IP {
+	host, _, _ := net.SplitHostPort(c.serverAddr)
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	if c.proxyURL != nil {
+		// the proxy resolved the host
+		return nil
+	}
+	if a, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
+
+// dial connects to the server and returns the connection that carries the
+// control connection, ctx limits the time for connecting
+func (c *controlClient) dial(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case c.proxyCmd != "":
+		conn, err = dialCommand(c.proxyCmd)
+	case c.proxyURL != nil:
+		conn, err = dialProxy(ctx, c.proxyURL, c.serverAddr)
+	default:
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", c.serverAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.wsURL == nil {
+		return conn, nil
+	}
+
+	// open websocket connection, with tls for wss urls
+	var wsConn net.Conn = conn
+	if c.wsURL.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: c.wsURL.Hostname(),
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		wsConn = tlsConn
+	}
+	ws, err := network.DialWebSocket(wsConn, c.wsURL)
+	if err != nil {
+		wsConn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// connect connects to the server and starts handling the control
+// connection, ctx limits the time for connecting
+func (c *controlClient) connect(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
 	}
 	c.conn = conn
 	if c.tlsConfig != nil {
-		c.conn = tls.Client(conn, c.tlsConfig)
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		c.conn = tlsConn
+	}
+	server := conn.RemoteAddr().String()
+	if c.serverAddr != "" {
+		server = c.serverAddr
+	}
+	c.session = network.NewSessionID()
+	c.log().Info("Connected to server", "server", server)
+	c.streams = network.NewStreams(c.conn, false, c.sendWithData,
+		c.acceptStream)
+	c.done = make(chan struct{})
+	go c.runReader()
+	go c.runKeepAlive()
+	return nil
+}
+
+// runClient runs the control client
+func (c *controlClient) runClient() {
+	// connect to server
+	if err := c.connect(context.Background()); err != nil {
+		log.Fatal(err)
 	}
-	defer c.conn.Close()
-	log.Println("Connected to server", c.serverAddr)
+	defer c.close()
 
 	// send service specs to server
 	active := 0
 	for _, spec := range c.specs {
-		log.Printf("Sending service registration %s to server", spec)
-		m := spec.ToMessage()
-		network.WriteToConn(c.conn, m.Serialize())
-
-		// read reply messages from server
-		var msg network.Message
-		buf := network.ReadFromConn(c.conn)
-		if buf == nil {
-			log.Println("Closing connection to server")
+		_, _, err := c.register(spec)
+		if errors.Is(err, ErrClosed) ||
+			errors.Is(err, ErrInvalidReply) {
 			return
 		}
-		msg.Parse(buf)
-
-		// handle message types
-		var spec ServiceSpec
-		replyFmt := "Server reply: service registration %s %s\n"
-		switch msg.Op {
-		case network.MessageOK:
-			spec.FromMessage(&msg)
-			log.Printf(replyFmt, &spec, "OK")
+		if err == nil {
 			active++
-		case network.MessageErr:
-			spec.FromMessage(&msg)
-			log.Printf(replyFmt, &spec, "ERROR")
-		default:
-			// unknown message, stop here
-			log.Println("Unknown reply from server, " +
-				"closing connection")
+		}
+	}
+
+	// send forward specs to server and start local forwards
+	for _, spec := range c.forwards {
+		err := c.addForward(spec)
+		if errors.Is(err, ErrClosed) ||
+			errors.Is(err, ErrInvalidReply) {
 			return
 		}
+		if err != nil {
+			continue
+		}
+		l, err := startLocalForward(spec, c.streams)
+		if err != nil {
+			c.log().Error("Could not start local forward",
+				append(spec.logArgs(), "error", err)...)
+			continue
+		}
+		defer l.stop()
+		active++
 	}
 
-	// are any services active on the server?
+	// start socks5 proxy
+	if c.socks != "" {
+		p, err := startSocksProxy(c.socks, c.streams)
+		if err != nil {
+			c.log().Error("Could not start SOCKS5 proxy", "addr",
+				c.socks, "error", err)
+		} else {
+			c.log().Info("Started SOCKS5 proxy", "addr",
+				p.listener.Addr().String())
+			defer p.stop()
+			active++
+		}
+	}
+
+	// are any services, local forwards or proxies active on the server?
 	if active == 0 {
-		log.Println("Could not register any service on the server, " +
-			"closing connection")
+		c.log().Error("Could not register any service on the " +
+			"server, closing connection")
 		return
 	}
-	log.Printf("Registered %d service(s) on the server, "+
-		"keeping connection open", active)
+	c.log().Info("Registered services on the server, keeping "+
+		"connection open", "services", active)
 
 	// keep connection open
-	go func() {
-		for {
-			// send a keep-alive/NOP message every 15 seconds
-			time.Sleep(15 * time.Second)
-			keepAlive := network.Message{Op: network.MessageNop}
-			if !network.WriteToConn(c.conn,
-				keepAlive.Serialize()) {
-				return
-			}
-		}
-	}()
-	for {
-		if network.ReadFromConn(c.conn) == nil {
-			log.Println("Closing connection to server")
-			return
-		}
-	}
+	<-c.done
 }
 
-// RunControlClient runs the control client
-func RunControlClient(cntrlAddr *net.TCPAddr, tlsConfig *tls.Config,
-	serviceSpecs string) {
+// RunControlClient runs the control client with configuration config
+func RunControlClient(config *Config) {
 	// parse service specifications (format "<protocol>:<port>:<destPort>")
-	services := strings.Split(serviceSpecs, ",")
 	var specs []*ServiceSpec
-	for _, s := range services {
-		specs = append(specs, ParseServiceSpec(s))
+	if config.Services != "" {
+		for _, s := range strings.Split(config.Services, ",") {
+			spec, err := ParseServiceSpec(s)
+			if err != nil {
+				log.Fatal(err)
+			}
+			specs = append(specs, spec)
+		}
+	}
+
+	// parse forward specifications (format
+	// "<protocol>:[<address>:]<port>:<host>:<hostPort>")
+	var forwards []*ForwardSpec
+	if config.Forwards != "" {
+		for _, f := range strings.Split(config.Forwards, ",") {
+			forwards = append(forwards, ParseForwardSpec(f))
+		}
 	}
 
 	// print info and run control client
-	ip := ""
-	if cntrlAddr.IP != nil {
-		ip = fmt.Sprintf("%s", cntrlAddr.IP)
+	cntrlAddr := config.ServerAddr
+	args := []any{"tls", config.TLSConfig != nil}
+	if cntrlAddr != "" {
+		args = append(args, "server", cntrlAddr)
+	}
+	if config.WebSocketURL != nil {
+		args = append(args, "websocket", config.WebSocketURL.String())
 	}
-	tlsInfo := ""
-	if tlsConfig != nil {
-		tlsInfo = "in mTLS mode "
+	if config.ProxyCommand != "" {
+		args = append(args, "command", config.ProxyCommand)
+	} else if config.ProxyURL != nil {
+		args = append(args, "proxy", config.ProxyURL.Redacted())
 	}
-	log.Printf("Starting client %sand connecting to server %s:%d\n",
-		tlsInfo, ip, cntrlAddr.Port)
+	slog.Info("Starting client and connecting to server", args...)
 
 	// create and run control client
 	c := controlClient{
 		serverAddr: cntrlAddr,
-		tlsConfig:  tlsConfig,
+		wsURL:      config.WebSocketURL,
+		proxyURL:   config.ProxyURL,
+		proxyCmd:   config.ProxyCommand,
+		tlsConfig:  config.TLSConfig,
 		specs:      specs,
+		forwards:   forwards,
+		socks:      config.Socks,
 	}
 	c.runClient()
 }
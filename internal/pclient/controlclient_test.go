@@ -1,7 +1,12 @@
 package pclient
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"net/url"
 	"testing"
 	"time"
 
@@ -17,16 +22,106 @@ func TestRunControlClient(t *testing.T) {
 	}
 
 	// start a control server and give it some time to complete startup
-	go pserver.RunControlServer(&addr, nil, "127.0.0.1", "tcp:52526")
+	config := pserver.Config{
+		Addr:         &addr,
+		AllowedIPs:   "127.0.0.1",
+		AllowedPorts: "tcp:52526",
+	}
+	go pserver.RunControlServer(&config)
 	time.Sleep(1 * time.Second)
 
 	// start a control client with a not allowed port registration and give
 	// it some time to complete
-	go RunControlClient(&addr, nil, "tcp:52527:52527")
+	go RunControlClient(&Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:52527:52527",
+	})
 	time.Sleep(1 * time.Second)
 
 	// start a control client with an allowed port registration and give it
 	// some time to complete
-	go RunControlClient(&addr, nil, "tcp:52526:52526")
+	go RunControlClient(&Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:52526:52526",
+	})
+	time.Sleep(1 * time.Second)
+
+	// start a control client with a registration of the same port, that
+	// is queued as standby, and give it some time to complete
+	go RunControlClient(&Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:52526:52528",
+	})
 	time.Sleep(1 * time.Second)
 }
+
+// TestWebSocketControlClient tests a local forward over a websocket control
+// connection
+func TestWebSocketControlClient(t *testing.T) {
+	// start echo server as target of the local forward
+	target, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	// start control server with websocket listener
+	addr := net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 52532,
+	}
+	wsAddr := net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 52533,
+	}
+	go pserver.RunControlServer(&pserver.Config{
+		Addr:          &addr,
+		WebSocketAddr: &wsAddr,
+		AllowedIPs:    "127.0.0.1",
+		ForwardIPs:    "127.0.0.1",
+		ForwardPorts:  fmt.Sprintf("tcp:%d", targetPort),
+	})
+	time.Sleep(1 * time.Second)
+
+	// start control client with websocket url and local forward
+	u, err := url.Parse("ws://127.0.0.1:52533/control")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go RunControlClient(&Config{
+		ServerAddr:   wsAddr.String(),
+		WebSocketURL: u,
+		Forwards:     fmt.Sprintf("tcp:52534:127.0.0.1:%d", targetPort),
+	})
+	time.Sleep(1 * time.Second)
+
+	// send data through local forward and read it back
+	conn, err := net.Dial("tcp", "127.0.0.1:52534")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	want := []byte("hello world")
+	conn.Write(want)
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("got %s %v, want %s nil", got, err, want)
+	}
+}
@@ -0,0 +1,142 @@
+package pclient
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+const (
+	// defaultForwardAddress is the default address of local listeners
+	defaultForwardAddress = "127.0.0.1"
+)
+
+// ForwardSpec stores the specification of a local forward: connections to
+// the local listener are forwarded through the server to the target host
+// and port
+type ForwardSpec struct {
+	Protocol  string
+	Address   string
+	LocalPort uint16
+	Host      string
+	Port      uint16
+}
+
+// LocalAddr returns the address of the local listener
+func (f *ForwardSpec) LocalAddr() string {
+	return net.JoinHostPort(f.Address, strconv.Itoa(int(f.LocalPort)))
+}
+
+// Target returns the address of the target
+func (f *ForwardSpec) Target() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(int(f.Port)))
+}
+
+// ToMessage converts a forward specification to a message
+func (f *ForwardSpec) ToMessage() *network.Message {
+	m := network.Message{
+		Op:       network.MessageAddForward,
+		Port:     f.LocalPort,
+		DestPort: f.Port,
+	}
+	switch f.Protocol {
+	case "tcp":
+		m.Protocol = network.ProtocolTCP
+	case "udp":
+		m.Protocol = network.ProtocolUDP
+	default:
+		log.Fatalf("unknown protocol \"%s\" in forward "+
+			"specification\n", f.Protocol)
+	}
+	return &m
+}
+
+// Serialize converts the forward specification to a message with the target
+// host as data and writes it to a byte slice
+func (f *ForwardSpec) Serialize() []byte {
+	return f.ToMessage().SerializeWithData([]byte(f.Host))
+}
+
+// String converts the forward specification to a string
+func (f *ForwardSpec) String() string {
+	return fmt.Sprintf("%s:%s:%s", f.Protocol, f.LocalAddr(), f.Target())
+}
+
+// logArgs returns the local forward specification as key-value pairs for
+// log messages
+func (f *ForwardSpec) logArgs() []any {
+	return []any{"protocol", f.Protocol, "addr", f.LocalAddr(), "target",
+		f.Target()}
+}
+
+// splitSpec splits spec at colons outside of brackets and removes the
+// brackets around IPv6 addresses
+func splitSpec(spec string) []string {
+	var parts []string
+	start := 0
+	inBrackets := false
+	for i, c := range spec {
+		switch c {
+		case '[':
+			inBrackets = true
+		case ']':
+			inBrackets = false
+		case ':':
+			if !inBrackets {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, spec[start:])
+	for i, p := range parts {
+		if strings.HasPrefix(p, "[") && strings.HasSuffix(p, "]") {
+			parts[i] = p[1 : len(p)-1]
+		}
+	}
+	return parts
+}
+
+// ParseForwardSpec parses spec as a forward specification with the format
+// "<protocol>:[<address>:]<port>:<host>:<hostPort>"; IPv6 addresses must be
+// enclosed in brackets
+func ParseForwardSpec(spec string) *ForwardSpec {
+	errFmt := "Error parsing forward specification %s"
+	parts := splitSpec(spec)
+	if len(parts) != 4 && len(parts) != 5 {
+		log.Fatalf(errFmt, spec)
+	}
+
+	// parse protocol and optional address
+	f := ForwardSpec{
+		Protocol: parts[0],
+		Address:  defaultForwardAddress,
+	}
+	if len(parts) == 5 {
+		f.Address = parts[1]
+		parts = append(parts[:1], parts[2:]...)
+	}
+
+	// parse local port
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		log.Fatalf(errFmt, spec)
+	}
+	f.LocalPort = uint16(port)
+
+	// parse target host and port
+	f.Host = parts[2]
+	if f.Host == "" || len(f.Host) > 255 {
+		log.Fatalf(errFmt, spec)
+	}
+	port, err = strconv.ParseUint(parts[3], 10, 16)
+	if err != nil {
+		log.Fatalf(errFmt, spec)
+	}
+	f.Port = uint16(port)
+	return &f
+}
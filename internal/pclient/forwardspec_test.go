@@ -0,0 +1,77 @@
+package pclient
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		want ForwardSpec
+		str  string
+	}{
+		{
+			spec: "tcp:8080:example.com:80",
+			want: ForwardSpec{
+				Protocol:  "tcp",
+				Address:   "127.0.0.1",
+				LocalPort: 8080,
+				Host:      "example.com",
+				Port:      80,
+			},
+			str: "tcp:127.0.0.1:8080:example.com:80",
+		},
+		{
+			spec: "tcp:[::1]:8080:[fd00::1]:80",
+			want: ForwardSpec{
+				Protocol:  "tcp",
+				Address:   "::1",
+				LocalPort: 8080,
+				Host:      "fd00::1",
+				Port:      80,
+			},
+			str: "tcp:[::1]:8080:[fd00::1]:80",
+		},
+	} {
+		got := ParseForwardSpec(test.spec)
+		if *got != test.want {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+		if got.String() != test.str {
+			t.Errorf("got %s, want %s", got, test.str)
+		}
+	}
+}
+
+func TestForwardSpecSerialize(t *testing.T) {
+	f := ForwardSpec{
+		Protocol:  "tcp",
+		Address:   "127.0.0.1",
+		LocalPort: 1024,
+		Host:      "db",
+		Port:      5432,
+	}
+
+	// test message
+	want := network.Message{
+		Op:       network.MessageAddForward,
+		Protocol: network.ProtocolTCP,
+		Port:     1024,
+		DestPort: 5432,
+	}
+	got := f.ToMessage()
+	if *got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// test serialization of message and target host
+	wantBytes := []byte{network.MessageAddForward, network.ProtocolTCP,
+		4, 0, 21, 56, 0, 2, 'd', 'b'}
+	gotBytes := f.Serialize()
+	if !bytes.Equal(gotBytes, wantBytes) {
+		t.Errorf("got %v, want %v", gotBytes, wantBytes)
+	}
+}
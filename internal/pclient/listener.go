@@ -0,0 +1,210 @@
+package pclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+const (
+	// listenerBacklog is the number of accepted peer connections that are
+	// queued in a listener
+	listenerBacklog = 16
+)
+
+// streamConn is a peer connection that is carried in a stream over the
+// control connection
+type streamConn struct {
+	*network.Stream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// LocalAddr returns the address of the service on the server
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+// RemoteAddr returns the address of the peer
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// streamListener is a listener for the peer connections of a service that
+// the server forwards in streams over the control connection
+type streamListener struct {
+	c     *controlClient
+	spec  *ServiceSpec
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Accept waits for and returns the next peer connection
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+	case <-l.c.done:
+	}
+	return nil, net.ErrClosed
+}
+
+// Close closes the listener and removes its service from the server
+func (l *streamListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		err = nil
+		close(l.done)
+		l.c.delListener(l.spec.DestPort)
+		l.c.unregister(l.spec)
+		for {
+			select {
+			case conn := <-l.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the service on the server
+func (l *streamListener) Addr() net.Addr {
+	return l.addr
+}
+
+// deliver passes the peer connection in stream s to the listener with its
+// address addr, it returns false if the listener is closed
+func (l *streamListener) deliver(s *network.Stream, addr net.Addr) bool {
+	// get peer address from stream target, see server
+	var remoteAddr net.Addr = s.RemoteAddr()
+	if a, err := net.ResolveTCPAddr("tcp", s.Host); err == nil {
+		remoteAddr = a
+	}
+	conn := &streamConn{
+		Stream:     s,
+		localAddr:  addr,
+		remoteAddr: remoteAddr,
+	}
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+	case <-l.c.done:
+	}
+	return false
+}
+
+// addListener adds a new listener and returns it, its id is used as
+// destination port of its service
+func (c *controlClient) addListener() (*streamListener, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if len(c.listeners) >= 1<<16-1 {
+		return nil, errors.New("too many listeners")
+	}
+	if c.listeners == nil {
+		c.listeners = make(map[uint16]*streamListener)
+	}
+	for {
+		c.nextListener++
+		if c.nextListener != 0 &&
+			c.listeners[c.nextListener] == nil {
+			break
+		}
+	}
+	l := &streamListener{
+		c:     c,
+		spec:  &ServiceSpec{Protocol: "tcp", DestPort: c.nextListener},
+		conns: make(chan net.Conn, listenerBacklog),
+		done:  make(chan struct{}),
+	}
+	c.listeners[c.nextListener] = l
+	return l, nil
+}
+
+// delListener removes the listener with id
+func (c *controlClient) delListener(id uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.listeners, id)
+}
+
+// acceptStream accepts the stream s opened by the server if it is a peer
+// connection of a listener's service, other streams are closed
+func (c *controlClient) acceptStream(s *network.Stream) {
+	c.mutex.Lock()
+	l := c.listeners[s.Port]
+	var addr net.Addr
+	if l != nil {
+		addr = l.addr
+	}
+	c.mutex.Unlock()
+
+	if l == nil || s.Protocol() != network.ProtocolTCP || !s.Accept() {
+		s.Close()
+		return
+	}
+	if !l.deliver(s, addr) {
+		s.Close()
+	}
+}
+
+// listen registers a tcp service with port on the server and returns a
+// listener for its peer connections, ctx limits the time for registering
+func (c *controlClient) listen(ctx context.Context, port uint16) (
+	*streamListener, error) {
+	l, err := c.addListener()
+	if err != nil {
+		return nil, err
+	}
+	l.spec.Port = port
+	l.spec.stream = true
+
+	// register service, remove it later if ctx is done first
+	type result struct {
+		spec *ServiceSpec
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		spec, _, err := c.register(l.spec)
+		results <- result{spec, err}
+	}()
+	var r result
+	select {
+	case r = <-results:
+	case <-ctx.Done():
+		c.delListener(l.spec.DestPort)
+		go func() {
+			if r := <-results; r.err == nil {
+				c.unregister(r.spec)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		c.delListener(l.spec.DestPort)
+		return nil, r.err
+	}
+
+	// use address of the server with the registered port
+	addr := &net.TCPAddr{IP: c.serverIP(), Port: int(r.spec.Port)}
+	c.mutex.Lock()
+	l.spec = r.spec
+	l.addr = addr
+	c.mutex.Unlock()
+	return l, nil
+}
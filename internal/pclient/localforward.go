@@ -0,0 +1,89 @@
+package pclient
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// localForward runs the local listener of a forward specification and
+// forwards its connections in streams through the server
+type localForward struct {
+	spec     *ForwardSpec
+	streams  *network.Streams
+	listener net.Listener
+}
+
+// handleConn forwards the local connection conn through the server
+func (l *localForward) handleConn(conn net.Conn) {
+	log := slog.With("peer", conn.RemoteAddr().String(), "target",
+		l.spec.Target())
+	stream, err := l.streams.Open(network.ProtocolTCP, l.spec.Host,
+		l.spec.Port)
+	if err != nil {
+		log.Warn("Could not forward connection", "error", err)
+		conn.Close()
+		return
+	}
+	log.Info("Forwarding connection")
+	forwardStream(conn, stream)
+	log.Info("Closing forwarded connection")
+}
+
+// run accepts local connections until the listener is closed
+func (l *localForward) run() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.handleConn(conn)
+	}
+}
+
+// stop stops the local forward
+func (l *localForward) stop() {
+	l.listener.Close()
+}
+
+// startLocalForward starts a local forward with the forward specification
+// spec and the streams of the control connection
+func startLocalForward(spec *ForwardSpec,
+	streams *network.Streams) (*localForward, error) {
+	listener, err := net.Listen("tcp", spec.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+	l := localForward{
+		spec:     spec,
+		streams:  streams,
+		listener: listener,
+	}
+	go l.run()
+	return &l, nil
+}
+
+// forwardStream copies data between conn and stream in both directions until
+// both directions are closed
+func forwardStream(conn net.Conn, stream *network.Stream) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stream, conn)
+		stream.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, stream)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	conn.Close()
+	stream.Close()
+}
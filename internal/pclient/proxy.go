@@ -0,0 +1,229 @@
+package pclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyTimeout is the timeout for connecting through a proxy
+	proxyTimeout = 30 * time.Second
+
+	// socks5 username/password authentication
+	socksMethodPassword  = 2
+	socksPasswordVersion = 1
+)
+
+// ProxyFromEnvironment returns the proxy url in the environment variables
+// HTTPS_PROXY and ALL_PROXY or their lowercase versions, or an empty string
+// if they are not set
+func ProxyFromEnvironment() string {
+	for _, env := range []string{"HTTPS_PROXY", "https_proxy",
+		"ALL_PROXY", "all_proxy"} {
+		if proxy := os.Getenv(env); proxy != "" {
+			return proxy
+		}
+	}
+	return ""
+}
+
+// ParseProxyURL parses proxy as url of an http, https or socks5 proxy; urls
+// without scheme are http proxies
+func ParseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing proxy host in %s", u.Redacted())
+	}
+	return u, nil
+}
+
+// proxyAddr returns the address of proxy u with the default port of its
+// scheme if there is no port
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bufferedConn is a connection with data that has already been read into a
+// buffered reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads data from the connection
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// connectHTTPProxy opens a tunnel to addr on the http proxy u over conn
+func connectHTTPProxy(conn net.Conn, u *url.URL, addr string) (net.Conn,
+	error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString(
+			[]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused connection: %s",
+			resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// connectSocksProxy opens a connection to addr on the socks5 proxy u over
+// conn
+func connectSocksProxy(conn net.Conn, u *url.URL, addr string) (net.Conn,
+	error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	// send authentication methods and check the selected one
+	methods := []byte{socksVersion, 1, socksMethodNone}
+	if u.User != nil {
+		methods = []byte{socksVersion, 2, socksMethodNone,
+			socksMethodPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	switch {
+	case buf[0] != socksVersion:
+		return nil, errors.New("invalid socks5 proxy reply")
+	case buf[1] == socksMethodNone:
+	case buf[1] == socksMethodPassword && u.User != nil:
+		password, _ := u.User.Password()
+		user := u.User.Username()
+		auth := []byte{socksPasswordVersion, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, errors.New("socks5 proxy authentication " +
+				"failed")
+		}
+	default:
+		return nil, errors.New("no acceptable socks5 proxy " +
+			"authentication method")
+	}
+
+	// send connect request and check reply
+	req := appendSocksAddr([]byte{socksVersion, socksCmdConnect, 0}, host,
+		uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if _, _, err := readSocksAddr(conn); err != nil {
+		return nil, err
+	}
+	if buf[1] != socksReplySuccess {
+		return nil, fmt.Errorf("socks5 proxy refused connection with "+
+			"reply %d", buf[1])
+	}
+	return conn, nil
+}
+
+// dialProxy connects to addr through the http or socks5 proxy u, ctx limits
+// the time for connecting
+func dialProxy(ctx context.Context, u *url.URL, addr string) (net.Conn,
+	error) {
+	d := net.Dialer{Timeout: proxyTimeout}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr(u))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(proxyTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	proxyConn := conn
+	if u.Scheme == "https" {
+		proxyConn = tls.Client(conn, &tls.Config{
+			ServerName: u.Hostname(),
+		})
+	}
+
+	// open connection through proxy
+	var tunnel net.Conn
+	switch u.Scheme {
+	case "http", "https":
+		tunnel, err = connectHTTPProxy(proxyConn, u, addr)
+	default:
+		tunnel, err = connectSocksProxy(proxyConn, u, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
@@ -2,7 +2,6 @@ package pclient
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 
@@ -14,25 +13,57 @@ type ServiceSpec struct {
 	Protocol string
 	Port     uint16
 	DestPort uint16
+	// Pool is the name of the pool of services the service joins on
+	// the server, if it is not empty
+	Pool string
+	// stream specifies if peer connections are carried in streams over
+	// the control connection instead of connections to DestPort
+	stream bool
 }
 
-// ToMessage converts a service specification to a message
-func (s *ServiceSpec) ToMessage() *network.Message {
+// check checks the protocol and pool of the service specification
+func (s *ServiceSpec) check() error {
+	switch s.Protocol {
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("unknown protocol \"%s\" in service "+
+			"specification", s.Protocol)
+	}
+	if s.stream && s.Protocol != "tcp" {
+		return fmt.Errorf("streams not supported for protocol \"%s\" "+
+			"in service specification", s.Protocol)
+	}
+	if len(s.Pool) > 255 {
+		return fmt.Errorf("pool name too long in service "+
+			"specification %s", s)
+	}
+	return nil
+}
+
+// ToMessage converts a service specification to a message, it returns an
+// error if the protocol is unknown
+func (s *ServiceSpec) ToMessage() (*network.Message, error) {
 	m := network.Message{
 		Op:       network.MessageAdd,
 		Port:     s.Port,
 		DestPort: s.DestPort,
 	}
+	if s.Pool != "" {
+		m.Op = network.MessageAddPool
+	}
+	if s.stream {
+		m.Op = network.MessageAddStream
+	}
 	switch s.Protocol {
 	case "tcp":
 		m.Protocol = network.ProtocolTCP
 	case "udp":
 		m.Protocol = network.ProtocolUDP
 	default:
-		log.Fatalf("unknown protocol \"%s\" in service "+
-			"specification\n", s.Protocol)
+		return nil, fmt.Errorf("unknown protocol \"%s\" in service "+
+			"specification", s.Protocol)
 	}
-	return &m
+	return &m, nil
 }
 
 // FromMessage fills this service specification from a message
@@ -49,18 +80,43 @@ func (s *ServiceSpec) FromMessage(msg *network.Message) {
 	}
 }
 
+// Serialize converts the service specification to a message and writes it
+// to a byte slice, the pool name is appended as data if necessary
+func (s *ServiceSpec) Serialize() ([]byte, error) {
+	m, err := s.ToMessage()
+	if err != nil {
+		return nil, err
+	}
+	return m.SerializeWithData([]byte(s.Pool)), nil
+}
+
 // String converts the service spec to a string
 func (s *ServiceSpec) String() string {
+	if s.Pool != "" {
+		return fmt.Sprintf("%s:%d:%d:%s", s.Protocol, s.Port,
+			s.DestPort, s.Pool)
+	}
 	return fmt.Sprintf("%s:%d:%d", s.Protocol, s.Port, s.DestPort)
 }
 
+// logArgs returns the service specification as key-value pairs for log
+// messages
+func (s *ServiceSpec) logArgs() []any {
+	args := []any{"protocol", s.Protocol, "port", s.Port, "dest_port",
+		s.DestPort}
+	if s.Pool != "" {
+		args = append(args, "pool", s.Pool)
+	}
+	return args
+}
+
 // ParseServiceSpec parses spec as a service specification with the format
-// "<protocol>:<port>:<destPort>"
-func ParseServiceSpec(spec string) *ServiceSpec {
-	errFmt := "Error parsing service specification %s"
+// "<protocol>:<port>:<destPort>[:<pool>]"
+func ParseServiceSpec(spec string) (*ServiceSpec, error) {
+	errFmt := "error parsing service specification %s"
 	parts := strings.Split(spec, ":")
-	if len(parts) != 3 {
-		log.Fatalf(errFmt, spec)
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, fmt.Errorf(errFmt, spec)
 	}
 
 	// parse protocol
@@ -69,13 +125,22 @@ func ParseServiceSpec(spec string) *ServiceSpec {
 	// parse port
 	port, err := strconv.ParseUint(parts[1], 10, 16)
 	if err != nil {
-		log.Fatalf(errFmt, spec)
+		return nil, fmt.Errorf(errFmt, spec)
 	}
 
 	// parse destination port
 	destPort, err := strconv.ParseUint(parts[2], 10, 16)
 	if err != nil {
-		log.Fatalf(errFmt, spec)
+		return nil, fmt.Errorf(errFmt, spec)
+	}
+
+	// parse optional pool name
+	pool := ""
+	if len(parts) == 4 {
+		pool = parts[3]
+		if pool == "" {
+			return nil, fmt.Errorf(errFmt, spec)
+		}
 	}
 
 	// return as serviceSpec
@@ -83,6 +148,10 @@ func ParseServiceSpec(spec string) *ServiceSpec {
 		Protocol: protocol,
 		Port:     uint16(port),
 		DestPort: uint16(destPort),
+		Pool:     pool,
+	}
+	if err := s.check(); err != nil {
+		return nil, err
 	}
-	return &s
+	return &s, nil
 }
@@ -1,6 +1,8 @@
 package pclient
 
 import (
+	"bytes"
+	"log"
 	"testing"
 
 	"github.com/hwipl/service-proxy/internal/network"
@@ -18,10 +20,16 @@ func TestServiceSpecToMessage(t *testing.T) {
 		Port:     1024,
 		DestPort: 1024,
 	}
-	got := s.ToMessage()
-	if *got != want {
+	got, err := s.ToMessage()
+	if err != nil || *got != want {
 		t.Errorf("got %v, want %v", got, want)
 	}
+
+	// unknown protocol
+	s.Protocol = "sctp"
+	if _, err := s.ToMessage(); err == nil {
+		t.Errorf("got nil, want error")
+	}
 }
 
 func TestServiceSpecFromMessage(t *testing.T) {
@@ -63,8 +71,53 @@ func TestParseServiceSpec(t *testing.T) {
 		Port:     1024,
 		DestPort: 1024,
 	}
-	got := ParseServiceSpec(s)
+	got, err := ParseServiceSpec(s)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if *got != want {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestServiceSpecPool(t *testing.T) {
+	s := "udp:1024:53:dns"
+	want := ServiceSpec{
+		Protocol: "udp",
+		Port:     1024,
+		DestPort: 53,
+		Pool:     "dns",
+	}
+	got, err := ParseServiceSpec(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got.String() != s {
+		t.Errorf("got %s, want %s", got, s)
+	}
+
+	// test serialization of message and pool name
+	wantBytes := []byte{network.MessageAddPool, network.ProtocolUDP,
+		4, 0, 0, 53, 0, 3, 'd', 'n', 's'}
+	gotBytes, err := got.Serialize()
+	if err != nil || !bytes.Equal(gotBytes, wantBytes) {
+		t.Errorf("got %v, want %v", gotBytes, wantBytes)
+	}
+}
+
+func TestParseServiceSpecInvalid(t *testing.T) {
+	for _, s := range []string{
+		"tcp:1024",
+		"sctp:1024:1024",
+		"tcp:port:1024",
+		"tcp:1024:65536",
+		"udp:1024:53:",
+	} {
+		if _, err := ParseServiceSpec(s); err == nil {
+			t.Errorf("got nil, want error for %s", s)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package pclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+const (
+	// socks5 version, authentication methods, commands, address types and
+	// replies
+	socksVersion              = 5
+	socksMethodNone           = 0
+	socksMethodNoAcceptable   = 0xff
+	socksCmdConnect           = 1
+	socksCmdUDPAssociate      = 3
+	socksAddrIPv4             = 1
+	socksAddrDomain           = 3
+	socksAddrIPv6             = 4
+	socksReplySuccess         = 0
+	socksReplyFailure         = 1
+	socksReplyRefused         = 5
+	socksReplyCmdUnsupported  = 7
+	socksReplyAddrUnsupported = 8
+
+	// socksHandshakeTimeout is the timeout for socks5 handshakes
+	socksHandshakeTimeout = 30 * time.Second
+
+	// socksOpenTimeout is the timeout for opening streams to targets
+	socksOpenTimeout = 10 * time.Second
+
+	// socksQueueLen is the maximum number of datagrams queued for an udp
+	// target while its stream is opened
+	socksQueueLen = 16
+)
+
+var (
+	// errSocksAddrType is returned for unknown address types
+	errSocksAddrType = errors.New("address type not supported")
+	// errSocksDatagram is returned for invalid udp datagrams
+	errSocksDatagram = errors.New("invalid datagram")
+)
+
+// readSocksAddr reads a socks5 address with address type, address and port
+// from r and returns its host and port
+func readSocksAddr(r io.Reader) (string, uint16, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, err
+	}
+	addrType := buf[0]
+	addrLen := 0
+	switch addrType {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", 0, err
+		}
+		addrLen = int(buf[0])
+	default:
+		return "", 0, errSocksAddrType
+	}
+
+	addr := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	host := string(addr[:addrLen])
+	if addrType != socksAddrDomain {
+		host = net.IP(addr[:addrLen]).String()
+	}
+	return host, binary.BigEndian.Uint16(addr[addrLen:]), nil
+}
+
+// appendSocksAddr appends host and port as socks5 address to b
+func appendSocksAddr(b []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(b, socksAddrDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+// parseSocksDatagram parses the socks5 udp datagram b and returns its target
+// host and port and its data
+func parseSocksDatagram(b []byte) (string, uint16, []byte, error) {
+	// fragmented datagrams are not supported
+	if len(b) < 3 || b[2] != 0 {
+		return "", 0, nil, errSocksDatagram
+	}
+	r := bytes.NewReader(b[3:])
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return "", 0, nil, errSocksDatagram
+	}
+	return host, port, b[len(b)-r.Len():], nil
+}
+
+// socksAssociation forwards the udp datagrams of a socks5 client through
+// the server, with a stream for each target
+type socksAssociation struct {
+	streams  *network.Streams
+	conn     *net.UDPConn
+	clientIP net.IP
+	// client is the address of the first datagram from the client,
+	// datagrams from other addresses are dropped
+	client *net.UDPAddr
+
+	// mutex protects the following fields
+	mutex   sync.Mutex
+	targets map[string]*socksTarget
+	closed  bool
+}
+
+// socksTarget is an udp target of a socks5 association, its stream is nil
+// while it is opened and datagrams for the target are queued in the meantime
+type socksTarget struct {
+	stream *network.Stream
+	queue  [][]byte
+}
+
+// runTarget forwards the datagrams from the stream s of target t with host
+// and port to the client
+func (a *socksAssociation) runTarget(t *socksTarget, s *network.Stream,
+	host string, port uint16) {
+	header := appendSocksAddr([]byte{0, 0, 0}, host, port)
+	buf := make([]byte, network.StreamDataLen)
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			break
+		}
+		datagram := append(header[:len(header):len(header)],
+			buf[:n]...)
+		a.conn.WriteToUDP(datagram, a.client)
+	}
+	s.Close()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if a.targets[key] == t {
+		delete(a.targets, key)
+	}
+}
+
+// openTarget opens the stream of target t with host and port, sends the
+// queued datagrams and forwards the datagrams of the target to the client
+func (a *socksAssociation) openTarget(t *socksTarget, host string,
+	port uint16) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	ctx, cancel := context.WithTimeout(context.Background(),
+		socksOpenTimeout)
+	s, err := a.streams.OpenContext(ctx, network.ProtocolUDP, host, port)
+	cancel()
+	if err != nil {
+		slog.Warn("Could not forward SOCKS5 datagrams", "peer",
+			a.client.String(), "target", key, "error", err)
+		a.mutex.Lock()
+		if a.targets[key] == t {
+			delete(a.targets, key)
+		}
+		a.mutex.Unlock()
+		return
+	}
+	slog.Info("Forwarding SOCKS5 datagrams", "peer", a.client.String(),
+		"target", key)
+
+	// send queued datagrams in order until the queue is empty, then
+	// datagrams are sent directly
+	for {
+		a.mutex.Lock()
+		if a.closed {
+			a.mutex.Unlock()
+			s.Close()
+			return
+		}
+		queue := t.queue
+		t.queue = nil
+		if len(queue) == 0 {
+			t.stream = s
+			a.mutex.Unlock()
+			break
+		}
+		a.mutex.Unlock()
+		for _, datagram := range queue {
+			s.Write(datagram)
+		}
+	}
+	a.runTarget(t, s, host, port)
+}
+
+// forward forwards the datagram data to host and port; if the stream to the
+// target is not open yet, it is opened in the background and data is queued
+// or dropped if the queue is full
+func (a *socksAssociation) forward(host string, port uint16, data []byte) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return
+	}
+	t := a.targets[key]
+	if t == nil {
+		t = &socksTarget{}
+		a.targets[key] = t
+		go a.openTarget(t, host, port)
+	}
+	s := t.stream
+	if s == nil {
+		if len(t.queue) < socksQueueLen {
+			t.queue = append(t.queue, bytes.Clone(data))
+		}
+		a.mutex.Unlock()
+		return
+	}
+	a.mutex.Unlock()
+	s.Write(data)
+}
+
+// run forwards datagrams from the client until the association is stopped
+func (a *socksAssociation) run() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(a.clientIP) {
+			continue
+		}
+		if a.client == nil {
+			a.client = addr
+		} else if a.client.Port != addr.Port {
+			continue
+		}
+		host, port, data, err := parseSocksDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		a.forward(host, port, data)
+	}
+}
+
+// stop stops the association and closes its streams
+func (a *socksAssociation) stop() {
+	a.conn.Close()
+
+	a.mutex.Lock()
+	a.closed = true
+	targets := a.targets
+	a.targets = nil
+	a.mutex.Unlock()
+
+	for _, t := range targets {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}
+}
+
+// socksProxy is a local socks5 proxy that forwards its connections and
+// datagrams in streams through the server
+type socksProxy struct {
+	streams  *network.Streams
+	listener net.Listener
+}
+
+// reply sends the socks5 reply rep with host and port to conn
+func (p *socksProxy) reply(conn net.Conn, rep byte, host string,
+	port uint16) bool {
+	buf := appendSocksAddr([]byte{socksVersion, rep, 0}, host, port)
+	return network.WriteToConn(conn, buf)
+}
+
+// connect handles the connect request of conn to host and port
+func (p *socksProxy) connect(conn net.Conn, host string, port uint16) {
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	log := slog.With("peer", conn.RemoteAddr().String(), "target", target)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		socksOpenTimeout)
+	stream, err := p.streams.OpenContext(ctx, network.ProtocolTCP, host,
+		port)
+	cancel()
+	if err != nil {
+		log.Warn("Could not forward SOCKS5 connection", "error", err)
+		rep := byte(socksReplyFailure)
+		if err == network.ErrStreamRefused {
+			rep = socksReplyRefused
+		}
+		p.reply(conn, rep, "0.0.0.0", 0)
+		conn.Close()
+		return
+	}
+	if !p.reply(conn, socksReplySuccess, "0.0.0.0", 0) {
+		conn.Close()
+		stream.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Info("Forwarding SOCKS5 connection")
+	forwardStream(conn, stream)
+	log.Info("Closing SOCKS5 connection")
+}
+
+// associate handles the udp associate request of conn
+func (p *socksProxy) associate(conn net.Conn) {
+	defer conn.Close()
+	log := slog.With("peer", conn.RemoteAddr().String())
+
+	// open udp socket on the address of the tcp connection
+	laddr := conn.LocalAddr().(*net.TCPAddr)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   laddr.IP,
+		Zone: laddr.Zone,
+	})
+	if err != nil {
+		log.Warn("Could not associate SOCKS5 client", "error", err)
+		p.reply(conn, socksReplyFailure, "0.0.0.0", 0)
+		return
+	}
+	a := socksAssociation{
+		streams:  p.streams,
+		conn:     udpConn,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		targets:  make(map[string]*socksTarget),
+	}
+	defer a.stop()
+	bind := udpConn.LocalAddr().(*net.UDPAddr)
+	if !p.reply(conn, socksReplySuccess, bind.IP.String(),
+		uint16(bind.Port)) {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the association ends when the tcp connection is closed
+	log.Info("Associating SOCKS5 client", "addr", bind.String())
+	go a.run()
+	io.Copy(io.Discard, conn)
+	log.Info("Closing SOCKS5 association of client")
+}
+
+// handleConn handles the socks5 client connection conn
+func (p *socksProxy) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	// read version and authentication methods, only no authentication
+	// is supported
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil ||
+		buf[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		conn.Close()
+		return
+	}
+	if bytes.IndexByte(methods, socksMethodNone) == -1 {
+		network.WriteToConn(conn, []byte{socksVersion,
+			socksMethodNoAcceptable})
+		conn.Close()
+		return
+	}
+	if !network.WriteToConn(conn, []byte{socksVersion, socksMethodNone}) {
+		conn.Close()
+		return
+	}
+
+	// read request with version, command, reserved byte and address
+	if _, err := io.ReadFull(conn, buf); err != nil ||
+		buf[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	host, port, err := readSocksAddr(conn)
+	if err != nil {
+		if err == errSocksAddrType {
+			p.reply(conn, socksReplyAddrUnsupported, "0.0.0.0", 0)
+		}
+		conn.Close()
+		return
+	}
+
+	// handle command
+	switch buf[1] {
+	case socksCmdConnect:
+		p.connect(conn, host, port)
+	case socksCmdUDPAssociate:
+		p.associate(conn)
+	default:
+		p.reply(conn, socksReplyCmdUnsupported, "0.0.0.0", 0)
+		conn.Close()
+	}
+}
+
+// run accepts socks5 client connections until the listener is closed
+func (p *socksProxy) run() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handleConn(conn)
+	}
+}
+
+// stop stops the socks5 proxy
+func (p *socksProxy) stop() {
+	p.listener.Close()
+}
+
+// startSocksProxy starts a socks5 proxy on addr with the streams of the
+// control connection
+func startSocksProxy(addr string, streams *network.Streams) (*socksProxy,
+	error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := socksProxy{
+		streams:  streams,
+		listener: listener,
+	}
+	go p.run()
+	return &p, nil
+}
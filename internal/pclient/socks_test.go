@@ -0,0 +1,242 @@
+package pclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+	"github.com/hwipl/service-proxy/internal/pserver"
+)
+
+func TestSocksAddr(t *testing.T) {
+	for _, test := range []struct {
+		host string
+		want []byte
+	}{
+		{"10.0.0.1", []byte{socksAddrIPv4, 10, 0, 0, 1, 0, 80}},
+		{"::1", []byte{socksAddrIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 1, 0, 80}},
+		{"a.b", []byte{socksAddrDomain, 3, 'a', '.', 'b', 0, 80}},
+	} {
+		got := appendSocksAddr(nil, test.host, 80)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+		host, port, err := readSocksAddr(bytes.NewReader(got))
+		if err != nil || host != test.host || port != 80 {
+			t.Errorf("got %s %d %v, want %s 80 nil",
+				host, port, err, test.host)
+		}
+	}
+
+	// unknown address type
+	_, _, err := readSocksAddr(bytes.NewReader([]byte{2, 0, 0}))
+	if err != errSocksAddrType {
+		t.Errorf("got %v, want %v", err, errSocksAddrType)
+	}
+}
+
+func TestParseSocksDatagram(t *testing.T) {
+	b := appendSocksAddr([]byte{0, 0, 0}, "10.0.0.1", 53)
+	b = append(b, "data"...)
+	host, port, data, err := parseSocksDatagram(b)
+	if err != nil || host != "10.0.0.1" || port != 53 ||
+		string(data) != "data" {
+		t.Errorf("got %s %d %s %v, want 10.0.0.1 53 data nil", host,
+			port, data, err)
+	}
+
+	// fragmented datagram
+	b[2] = 1
+	if _, _, _, err := parseSocksDatagram(b); err != errSocksDatagram {
+		t.Errorf("got %v, want %v", err, errSocksDatagram)
+	}
+}
+
+// testSocksRequest sends a socks5 request with cmd and host and port to the
+// socks5 proxy on conn and returns the reply code and address
+func testSocksRequest(conn net.Conn, cmd byte, host string,
+	port uint16) (byte, string, uint16) {
+	conn.Write([]byte{socksVersion, 1, socksMethodNone})
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		log.Fatal(err)
+	}
+	conn.Write(appendSocksAddr([]byte{socksVersion, cmd, 0}, host, port))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		log.Fatal(err)
+	}
+	host, port, err := readSocksAddr(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return buf[1], host, port
+}
+
+func TestSocksProxy(t *testing.T) {
+	// start tcp and udp echo servers as targets
+	tcpTarget, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tcpTarget.Close()
+	go func() {
+		for {
+			conn, err := tcpTarget.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	tcpPort := uint16(tcpTarget.Addr().(*net.TCPAddr).Port)
+	udpTarget, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer udpTarget.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpTarget.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			udpTarget.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	udpPort := uint16(udpTarget.LocalAddr().(*net.UDPAddr).Port)
+
+	// start control server and client with socks5 proxy
+	addr := net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 52530,
+	}
+	go pserver.RunControlServer(&pserver.Config{
+		Addr:       &addr,
+		AllowedIPs: "127.0.0.1",
+		ForwardIPs: "127.0.0.1",
+		ForwardPorts: fmt.Sprintf("tcp:%d,udp:%d", tcpPort,
+			udpPort),
+	})
+	time.Sleep(1 * time.Second)
+	go RunControlClient(&Config{
+		ServerAddr: addr.String(),
+		Socks:      "127.0.0.1:52531",
+	})
+	time.Sleep(1 * time.Second)
+
+	// test connect to not allowed target
+	conn, err := net.Dial("tcp", "127.0.0.1:52531")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rep, _, _ := testSocksRequest(conn, socksCmdConnect, "127.0.0.1",
+		tcpPort+1); rep != socksReplyRefused {
+		t.Errorf("got %d, want %d", rep, socksReplyRefused)
+	}
+	conn.Close()
+
+	// test connect to allowed target
+	conn, err = net.Dial("tcp", "127.0.0.1:52531")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rep, _, _ := testSocksRequest(conn, socksCmdConnect, "127.0.0.1",
+		tcpPort); rep != socksReplySuccess {
+		t.Errorf("got %d, want %d", rep, socksReplySuccess)
+	}
+	want := []byte("hello world")
+	conn.Write(want)
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("got %s %v, want %s nil", got, err, want)
+	}
+	conn.Close()
+
+	// test udp associate
+	conn, err = net.Dial("tcp", "127.0.0.1:52531")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	rep, host, port := testSocksRequest(conn, socksCmdUDPAssociate,
+		"0.0.0.0", 0)
+	if rep != socksReplySuccess {
+		t.Errorf("got %d, want %d", rep, socksReplySuccess)
+	}
+	udpConn, err := net.Dial("udp", net.JoinHostPort(host,
+		fmt.Sprint(port)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer udpConn.Close()
+	datagram := appendSocksAddr([]byte{0, 0, 0}, "127.0.0.1", udpPort)
+	wantDatagram := append(datagram, want...)
+	udpConn.Write(wantDatagram)
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := udpConn.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], wantDatagram) {
+		t.Errorf("got %v %v, want %v nil", buf[:n], err, wantDatagram)
+	}
+}
+
+func TestSocksAssociationUnresponsiveTarget(t *testing.T) {
+	// create association with streams whose server never answers
+	ctlConn, peerConn := net.Pipe()
+	defer ctlConn.Close()
+	defer peerConn.Close()
+	opens := make(chan *network.Message, socksQueueLen+2)
+	streams := network.NewStreams(ctlConn, false,
+		func(msg *network.Message, _ []byte) bool {
+			if msg.Op == network.MessageConnect {
+				opens <- msg
+			}
+			return true
+		}, nil)
+	defer streams.CloseAll()
+	a := socksAssociation{
+		streams: streams,
+		client:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		targets: make(map[string]*socksTarget),
+	}
+
+	// datagrams for the target are queued without blocking the
+	// association, the stream is only opened once
+	for i := 0; i < socksQueueLen+2; i++ {
+		a.forward("127.0.0.1", 53, []byte{byte(i)})
+	}
+	a.forward("127.0.0.1", 54, []byte{1})
+	if got, want := len(a.targets["127.0.0.1:53"].queue),
+		socksQueueLen; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	ports := make(map[uint16]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-opens:
+			ports[msg.DestPort] = true
+		case <-time.After(time.Second):
+			t.Fatal("stream not opened")
+		}
+	}
+	if !ports[53] || !ports[54] || len(opens) != 0 {
+		t.Errorf("got %v and %d more, want 53 and 54", ports,
+			len(opens))
+	}
+}
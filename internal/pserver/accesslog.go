@@ -0,0 +1,137 @@
+package pserver
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// close reasons of peer connections and udp sessions in the access log
+const (
+	closeReasonPeer        = "peer closed"
+	closeReasonDestination = "destination closed"
+	closeReasonDialFailed  = "dial failed"
+	closeReasonIdle        = "idle timeout"
+	closeReasonLifetime    = "maximum lifetime reached"
+	closeReasonEvicted     = "evicted"
+	closeReasonSendFailed  = "send failed"
+	closeReasonStopped     = "service stopped"
+	closeReasonRemoved     = "destination removed"
+	closeReasonUnhealthy   = "destination unhealthy"
+)
+
+// accessRecord is a record of a peer connection or an udp session of a
+// service in the access log
+type accessRecord struct {
+	Start time.Time `json:"start"`
+	// Duration is the duration of the connection in seconds
+	Duration float64 `json:"duration"`
+	Protocol string  `json:"protocol"`
+	Port     int     `json:"port"`
+	DestPort int     `json:"dest_port"`
+	// Client, Identity and Session describe the client that owns the
+	// service
+	Client        string `json:"client,omitempty"`
+	Identity      string `json:"identity,omitempty"`
+	Session       string `json:"session,omitempty"`
+	Peer          string `json:"peer"`
+	BytesFromPeer int64  `json:"bytes_from_peer"`
+	BytesToPeer   int64  `json:"bytes_to_peer"`
+	Reason        string `json:"reason"`
+
+	// log is the access log the record is written to
+	log *sharedAccessLog
+}
+
+// sharedAccessLog writes access records of the services of a control server
+// as JSON lines to a writer, it is safe for concurrent use
+type sharedAccessLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+	// logger is the logger for errors of the access log
+	logger *sharedLogger
+}
+
+// set sets the writer of the access log, if w is nil, the access log is
+// disabled
+func (a *sharedAccessLog) set(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.w = w
+}
+
+// enabled checks if the access log is enabled, a nil access log is disabled
+func (a *sharedAccessLog) enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.w != nil
+}
+
+// write writes the access record r to the access log
+func (a *sharedAccessLog) write(r *accessRecord) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.w == nil {
+		return
+	}
+	if _, err := a.w.Write(buf); err != nil {
+		a.logger.Warn("Could not write access log", "error", err)
+	}
+}
+
+// newAccessRecord returns a new access record for the connection of peer to
+// the service with protocol and port and the destination of member m in the
+// access log of the owner of m; it returns nil if the access log is disabled
+func (m *poolMember) newAccessRecord(protocol string, port int,
+	peer net.Addr) *accessRecord {
+	var log *sharedAccessLog
+	if m.owner != nil {
+		log = m.owner.accessLog
+	}
+	if !log.enabled() {
+		return nil
+	}
+	r := &accessRecord{
+		Start:    time.Now(),
+		Protocol: protocol,
+		Port:     port,
+		DestPort: m.dstPort,
+		Peer:     peer.String(),
+		log:      log,
+	}
+	if c := m.owner; c != nil {
+		r.Client = c.addr.String()
+		r.Session = c.session
+		if c.identity != nil {
+			r.Identity = c.identity.Name
+		}
+	}
+	return r
+}
+
+// close completes the access record with the bytes forwarded from and to the
+// peer and the close reason and writes it to the access log
+func (r *accessRecord) close(bytes [2]int64, reason string) {
+	if r == nil {
+		return
+	}
+	r.Duration = time.Since(r.Start).Seconds()
+	r.BytesFromPeer = bytes[0]
+	r.BytesToPeer = bytes[1]
+	r.Reason = reason
+	r.log.write(r)
+}
@@ -0,0 +1,70 @@
+package pserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var a sharedAccessLog
+	peer := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 51234}
+	member := &poolMember{
+		owner: &client{
+			addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1),
+				Port: 1234},
+			identity:  &Identity{Name: "test"},
+			session:   "0123abcd",
+			accessLog: &a,
+		},
+		dstPort: 80,
+	}
+
+	// disabled access log does not create records
+	if r := member.newAccessRecord("tcp", 8000, peer); r != nil {
+		t.Errorf("got %v, want nil", r)
+	}
+	(*accessRecord)(nil).close([2]int64{1, 2}, closeReasonPeer)
+
+	// enabled access log writes a JSON line for each closed record
+	var b bytes.Buffer
+	a.set(&b)
+	member.newAccessRecord("tcp", 8000, peer).close([2]int64{518, 7320},
+		closeReasonPeer)
+	member.newAccessRecord("udp", 8000, peer).close([2]int64{},
+		closeReasonIdle)
+
+	lines := bytes.Split(bytes.TrimSuffix(b.Bytes(), []byte("\n")),
+		[]byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	var got accessRecord
+	if err := json.Unmarshal(lines[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	want := accessRecord{
+		Start:         got.Start,
+		Duration:      got.Duration,
+		Protocol:      "tcp",
+		Port:          8000,
+		DestPort:      80,
+		Client:        "127.0.0.1:1234",
+		Identity:      "test",
+		Session:       "0123abcd",
+		Peer:          "10.0.0.5:51234",
+		BytesFromPeer: 518,
+		BytesToPeer:   7320,
+		Reason:        "peer closed",
+	}
+	if got != want || got.Start.IsZero() {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := json.Unmarshal(lines[1], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Protocol != "udp" || got.Reason != "idle timeout" {
+		t.Errorf("got %v, want udp record with idle timeout", got)
+	}
+}
@@ -0,0 +1,129 @@
+package pserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// Identity is the identity of a client
+type Identity struct {
+	// Name is the name of the client, e.g., the common name of its tls
+	// certificate; it is empty if the client is not identified
+	Name string
+	// Addr is the address of the client's control connection
+	Addr net.Addr
+}
+
+// Authenticator authenticates clients
+type Authenticator interface {
+	// Authenticate returns the identity of the client with the control
+	// connection conn and the tls connection state, which is nil if tls
+	// is not used; if it returns an error, the connection is closed
+	Authenticate(conn net.Conn, state *tls.ConnectionState) (*Identity,
+		error)
+}
+
+// Authorizer authorizes service registrations of clients
+type Authorizer interface {
+	// Authorize returns an error if the client with identity id is not
+	// allowed to register a service with protocol ("tcp" or "udp"), port
+	// on the server and destination port destPort
+	Authorize(id *Identity, protocol string, port, destPort uint16) error
+}
+
+// PortAllocator allocates ports for service registrations without port
+type PortAllocator interface {
+	// AllocatePort returns a free port for a service of the client with
+	// identity id with protocol ("tcp" or "udp") on the server IP ip
+	AllocatePort(id *Identity, protocol string, ip net.IP) (uint16, error)
+}
+
+// tlsIdentity returns the identity of the client with the control
+// connection conn and tls connection state, the name is the common name of
+// the client's certificate
+func tlsIdentity(conn net.Conn, state *tls.ConnectionState) *Identity {
+	id := &Identity{Addr: conn.RemoteAddr()}
+	if state != nil && len(state.PeerCertificates) > 0 {
+		id.Name = state.PeerCertificates[0].Subject.CommonName
+	}
+	return id
+}
+
+// Authenticate authenticates the client if the IP address of its control
+// connection is in the list, it identifies clients by the common names of
+// their tls certificates
+func (i *ipNetList) Authenticate(conn net.Conn,
+	state *tls.ConnectionState) (*Identity, error) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !i.containsIP(addr.IP) {
+		return nil, errors.New("IP not allowed")
+	}
+	return tlsIdentity(conn, state), nil
+}
+
+// Authorize authorizes the service registration if protocol and port are in
+// any of the port ranges in the list
+func (p *portRangeList) Authorize(id *Identity, protocol string, port,
+	destPort uint16) error {
+	if !p.containsPort(protocolNumber(protocol), port) {
+		return errors.New("port not allowed")
+	}
+	return nil
+}
+
+// AllocatePort returns the first port in the list that is not in use on ip
+func (p *portRangeList) AllocatePort(id *Identity, protocol string,
+	ip net.IP) (uint16, error) {
+	for _, r := range p.getAll() {
+		if r.protocol != protocolNumber(protocol) {
+			continue
+		}
+		for port := int(r.min); port <= int(r.max); port++ {
+			if port == 0 || (p.inUse != nil &&
+				p.inUse(protocol, port)) {
+				continue
+			}
+			if isFreePort(protocol, ip, port) {
+				return uint16(port), nil
+			}
+		}
+	}
+	return 0, errors.New("no free port")
+}
+
+// isFreePort checks if port is not in use for protocol on ip
+func isFreePort(protocol string, ip net.IP, port int) bool {
+	switch protocol {
+	case "tcp":
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			return false
+		}
+		l.Close()
+		return true
+	case "udp":
+		l, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			return false
+		}
+		l.Close()
+		return true
+	default:
+		return false
+	}
+}
+
+// protocolNumber converts the protocol name to its protocol number
+func protocolNumber(protocol string) uint8 {
+	switch protocol {
+	case "tcp":
+		return network.ProtocolTCP
+	case "udp":
+		return network.ProtocolUDP
+	default:
+		return 0
+	}
+}
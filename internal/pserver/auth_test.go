@@ -0,0 +1,106 @@
+package pserver
+
+import (
+	"log"
+	"net"
+	"testing"
+)
+
+func TestIPNetListAuthenticate(t *testing.T) {
+	ips := testStringsToIPNetList("127.0.0.0/8")
+	for _, test := range []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.IPv4(127, 0, 0, 1), true},
+		{net.IPv4(10, 0, 0, 1), false},
+	} {
+		conn, _ := net.Pipe()
+		pc := &testAddrConn{
+			Conn:   conn,
+			remote: &net.TCPAddr{IP: test.ip},
+		}
+		id, err := ips.Authenticate(pc, nil)
+		if got := err == nil; got != test.want {
+			t.Errorf("got %t, want %t", got, test.want)
+		}
+		if id != nil && id.Addr != pc.remote {
+			t.Errorf("got %v, want %v", id.Addr, pc.remote)
+		}
+		conn.Close()
+	}
+}
+
+func TestPortRangeListAuthorize(t *testing.T) {
+	var ports portRangeList
+	if err := ports.add("tcp:1024-2048"); err != nil {
+		log.Fatal(err)
+	}
+	for _, test := range []struct {
+		protocol string
+		port     uint16
+		want     bool
+	}{
+		{"tcp", 1024, true},
+		{"tcp", 2049, false},
+		{"udp", 1024, false},
+	} {
+		err := ports.Authorize(&Identity{}, test.protocol, test.port,
+			80)
+		if got := err == nil; got != test.want {
+			t.Errorf("got %t, want %t", got, test.want)
+		}
+	}
+}
+
+func TestPortRangeListAllocatePort(t *testing.T) {
+	var ports portRangeList
+	if err := ports.add("tcp:54546-54547"); err != nil {
+		log.Fatal(err)
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+
+	// first port is in use, second port should be allocated
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: 54546})
+	if err != nil {
+		log.Fatal(err)
+	}
+	port, err := ports.AllocatePort(&Identity{}, "tcp", ip)
+	if err != nil || port != 54547 {
+		t.Errorf("got %d, want %d", port, 54547)
+	}
+
+	// all ports are in use
+	l2, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: 54547})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := ports.AllocatePort(&Identity{}, "tcp", ip); err == nil {
+		t.Errorf("got nil, want error")
+	}
+	if _, err := ports.AllocatePort(&Identity{}, "udp", ip); err == nil {
+		t.Errorf("got nil, want error")
+	}
+	l.Close()
+	l2.Close()
+
+	// ports used by services of the control server are skipped
+	ports.inUse = func(protocol string, port int) bool {
+		return port == 54546
+	}
+	port, err = ports.AllocatePort(&Identity{}, "tcp", ip)
+	if err != nil || port != 54547 {
+		t.Errorf("got %d, want %d", port, 54547)
+	}
+}
+
+// testAddrConn is a connection with a custom remote address for tests
+type testAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the remote address of the connection
+func (c *testAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
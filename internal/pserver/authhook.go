@@ -0,0 +1,280 @@
+package pserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authHookTimeout is the maximum time of a request to an
+	// authorization hook
+	authHookTimeout = 5 * time.Second
+	// authHookMaxResponse is the maximum size of a response of an
+	// authorization hook
+	authHookMaxResponse = 64 * 1024
+)
+
+// authHookRequest is the request to an authorization hook. Registrations
+// are not related to connections of peers to the service, so the only
+// address in the request is the one of the client that registers it
+type authHookRequest struct {
+	// Identity is the name of the client's identity
+	Identity string `json:"identity"`
+	// ClientAddr is the remote address of the client's control
+	// connection, it is named client like in events and the access log
+	ClientAddr string `json:"client"`
+	Protocol   string `json:"protocol"`
+	Port       uint16 `json:"port"`
+	DestPort   uint16 `json:"dest_port"`
+}
+
+// authHookResponse is the response of an authorization hook
+type authHookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	// TTL is the number of seconds the decision is cached, it replaces
+	// the default cache time if it is set
+	TTL *int `json:"ttl"`
+}
+
+// authHookKey identifies cached decisions of an authorization hook
+type authHookKey struct {
+	identity string
+	clientIP string
+	protocol string
+	port     uint16
+	destPort uint16
+}
+
+// authHookDecision is a cached decision of an authorization hook
+type authHookDecision struct {
+	err     error
+	expires time.Time
+}
+
+// authHook is an authorizer that sends service registrations to an http
+// endpoint or a command after they are allowed by the next authorizer
+type authHook struct {
+	next     Authorizer
+	url      string
+	command  string
+	cache    time.Duration
+	failOpen bool
+	client   http.Client
+	logger   *sharedLogger
+
+	// mutex protects the cache of decisions
+	mutex     sync.Mutex
+	decisions map[authHookKey]*authHookDecision
+}
+
+// String converts the authorization hook to a string
+func (a *authHook) String() string {
+	hook := a.url
+	if hook == "" {
+		hook = "command \"" + a.command + "\""
+	}
+	fail := "closed"
+	if a.failOpen {
+		fail = "open"
+	}
+	return fmt.Sprintf("%s (cache %s, fail %s)", hook, a.cache, fail)
+}
+
+// getDecision returns the cached decision for key or nil if there is none
+func (a *authHook) getDecision(key authHookKey) *authHookDecision {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	d := a.decisions[key]
+	if d == nil || time.Now().After(d.expires) {
+		return nil
+	}
+	return d
+}
+
+// setDecision caches the decision err for key for the time ttl and removes
+// expired decisions
+func (a *authHook) setDecision(key authHookKey, err error,
+	ttl time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	for k, d := range a.decisions {
+		if now.After(d.expires) {
+			delete(a.decisions, k)
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	a.decisions[key] = &authHookDecision{
+		err:     err,
+		expires: now.Add(ttl),
+	}
+}
+
+// post sends the request in buf to the http endpoint and returns the
+// response body
+func (a *authHook) post(ctx context.Context, buf []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url,
+		bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return readAuthHookResponse(resp.Body)
+}
+
+// readAuthHookResponse reads the response of an authorization hook from r
+func readAuthHookResponse(r io.Reader) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, authHookMaxResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > authHookMaxResponse {
+		return nil, errors.New("response too big")
+	}
+	return out, nil
+}
+
+// run runs the command with the request in buf on stdin and returns its
+// output on stdout
+func (a *authHook) run(ctx context.Context, buf []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", a.command)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return readAuthHookResponse(bytes.NewReader(out))
+}
+
+// request sends the request r to the hook and returns its response
+func (a *authHook) request(r *authHookRequest) (*authHookResponse, error) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		authHookTimeout)
+	defer cancel()
+	var out []byte
+	if a.url != "" {
+		out, err = a.post(ctx, buf)
+	} else {
+		out, err = a.run(ctx, buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp authHookResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &resp, nil
+}
+
+// Authorize authorizes the service registration with the next authorizer
+// and the hook
+func (a *authHook) Authorize(id *Identity, protocol string, port,
+	destPort uint16) error {
+	if err := a.next.Authorize(id, protocol, port,
+		destPort); err != nil {
+		return err
+	}
+
+	// check cached decisions
+	r := &authHookRequest{
+		Identity: id.Name,
+		Protocol: protocol,
+		Port:     port,
+		DestPort: destPort,
+	}
+	key := authHookKey{
+		identity: id.Name,
+		protocol: protocol,
+		port:     port,
+		destPort: destPort,
+	}
+	if id.Addr != nil {
+		r.ClientAddr = id.Addr.String()
+		host, _, err := net.SplitHostPort(r.ClientAddr)
+		if err == nil {
+			key.clientIP = host
+		}
+	}
+	if d := a.getDecision(key); d != nil {
+		return d.err
+	}
+
+	// ask hook
+	resp, err := a.request(r)
+	if err != nil {
+		a.logger.Warn("Authorization hook failed", "client",
+			r.ClientAddr, "identity", id.Name, "protocol",
+			protocol, "port", port, "dest_port", destPort,
+			"error", err)
+		if a.failOpen {
+			return nil
+		}
+		return errors.New("authorization hook failed")
+	}
+	if !resp.Allow {
+		reason := resp.Reason
+		if reason == "" {
+			reason = "no reason"
+		}
+		err = fmt.Errorf("denied by authorization hook: %s", reason)
+	}
+	ttl := a.cache
+	if resp.TTL != nil {
+		ttl = time.Duration(*resp.TTL) * time.Second
+	}
+	a.setDecision(key, err, ttl)
+	return err
+}
+
+// newAuthHook creates a new authorization hook with the url of an http
+// endpoint or a command in hook, the time cache decisions are cached and
+// failOpen that specifies if registrations are allowed if the hook fails.
+// Registrations are first checked by the authorizer next, failures of the
+// hook are logged with logger
+func newAuthHook(hook string, cache time.Duration, failOpen bool,
+	next Authorizer, logger *sharedLogger) *authHook {
+	a := &authHook{
+		next:      next,
+		cache:     cache,
+		failOpen:  failOpen,
+		logger:    logger,
+		decisions: make(map[authHookKey]*authHookDecision),
+	}
+	if strings.HasPrefix(hook, "http://") ||
+		strings.HasPrefix(hook, "https://") {
+		a.url = hook
+	} else {
+		a.command = hook
+	}
+	return a
+}
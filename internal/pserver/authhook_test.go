@@ -0,0 +1,96 @@
+package pserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthHookHTTP(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			var req authHookRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			allow := req.Identity == "alice" &&
+				req.DestPort == 80 &&
+				req.ClientAddr != "127.0.0.2:40000"
+			json.NewEncoder(w).Encode(&authHookResponse{
+				Allow:  allow,
+				Reason: "test",
+			})
+		}))
+	defer srv.Close()
+
+	var ports portRangeList
+	ports.add("tcp:1024-65535")
+	hook := newAuthHook(srv.URL, time.Minute, false, &ports, nil)
+	alice := &Identity{Name: "alice", Addr: &net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 40000,
+	}}
+	alice2 := &Identity{Name: "alice", Addr: &net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 2),
+		Port: 40000,
+	}}
+	bob := &Identity{Name: "bob"}
+	for _, test := range []struct {
+		id       *Identity
+		port     uint16
+		destPort uint16
+		want     bool
+	}{
+		{alice, 8000, 80, true},
+		{alice, 8000, 81, false},
+		{bob, 8000, 80, false},
+		{alice, 80, 80, false},
+		{alice, 8000, 80, true},
+		{alice2, 8000, 80, false},
+	} {
+		err := hook.Authorize(test.id, "tcp", test.port, test.destPort)
+		if got := err == nil; got != test.want {
+			t.Errorf("got %t, want %t", got, test.want)
+		}
+	}
+
+	// the port not allowed by ports and the cached decision should not
+	// result in requests to the hook, decisions are cached per client IP
+	if got := requests.Load(); got != 4 {
+		t.Errorf("got %d, want %d", got, 4)
+	}
+}
+
+func TestAuthHookCommand(t *testing.T) {
+	var ports portRangeList
+	ports.add("tcp:1024-65535")
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	for _, test := range []struct {
+		command  string
+		failOpen bool
+		want     bool
+	}{
+		{"cat > /dev/null; echo '{\"allow\":true}'", false, true},
+		{"cat > /dev/null; echo '{\"allow\":false}'", false, false},
+		{"grep -q '\"identity\":\"alice\"' && " +
+			"echo '{\"allow\":true}'", false, true},
+		{"grep -q '\"client\":\"127.0.0.1:40000\"' && " +
+			"echo '{\"allow\":true}'", false, true},
+		{"exit 1", false, false},
+		{"exit 1", true, true},
+		{"echo invalid", false, false},
+	} {
+		hook := newAuthHook(test.command, 0, test.failOpen, &ports,
+			nil)
+		err := hook.Authorize(&Identity{Name: "alice", Addr: addr},
+			"tcp", 8000, 80)
+		if got := err == nil; got != test.want {
+			t.Errorf("got %t, want %t for %s", got, test.want,
+				test.command)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package pserver
 
 import (
 	"crypto/tls"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hwipl/service-proxy/internal/network"
@@ -15,190 +17,501 @@ type client struct {
 	addr  *net.TCPAddr
 	laddr *net.TCPAddr
 	// serverIP is the IP address the server runs services on
-	serverIP     net.IP
-	tcpPorts     map[int]bool
-	udpPorts     map[int]bool
-	allowedPorts portRangeList
+	serverIP    net.IP
+	tcpPorts    map[int]bool
+	udpPorts    map[int]bool
+	identity    *Identity
+	authorizer  Authorizer
+	allocator   PortAllocator
+	serviceOpts *serviceOptionsList
+	forwards    *forwardPolicy
+	streams     *network.Streams
+	events      *eventBus
+	// logger, accessLog, tcpServices and udpServices are the logger,
+	// the access log and the services of the control server
+	logger      *sharedLogger
+	accessLog   *sharedAccessLog
+	tcpServices *tcpServiceMap
+	udpServices *udpServiceMap
+	// session is the ID of the control connection in log messages
+	session string
+	// clients counts the active clients of the control server
+	clients *atomic.Int64
+	// sendMutex serializes messages to the client, because messages
+	// about standby services are sent by other clients' goroutines
+	sendMutex sync.Mutex
 }
 
-// addTCPService adds a tcp service to the client
-func (c *client) addTCPService(port, destPort int) bool {
-	log.Printf("Adding new service for client %s: forward tcp port %d "+
-		"to port %d\n", c.addr, port, destPort)
+// newPoolMember creates a new pool member for the client and destPort, if
+// stream is true, peer connections are carried in streams to the client
+func (c *client) newPoolMember(destPort int, stream bool) *poolMember {
+	return &poolMember{
+		owner:   c,
+		srcIP:   c.laddr.IP,
+		dstIP:   c.addr.IP,
+		dstPort: destPort,
+		stream:  stream,
+	}
+}
+
+// log returns the logger for log messages of the client, it adds the
+// session ID, the address and, if known, the identity of the client
+func (c *client) log() *slog.Logger {
+	if c == nil {
+		return slog.Default()
+	}
+	l := c.logger.get().With("session", c.session, "client",
+		c.addr.String())
+	if c.identity != nil && c.identity.Name != "" {
+		l = l.With("identity", c.identity.Name)
+	}
+	return l
+}
 
-	// create tcp addresses
+// addTCPService adds a tcp service to the client, if pool is not empty the
+// service joins the pool of services with this name. If stream is true, peer
+// connections are carried in streams over the control connection. It returns
+// the message type of the reply to the client
+func (c *client) addTCPService(port, destPort int, pool string,
+	stream bool) uint8 {
+	log := c.log().With("protocol", "tcp", "port", port, "dest_port",
+		destPort)
+	log.Info("Adding new service for client", "pool", pool, "stream",
+		stream)
+
+	// create tcp address
 	srvAddr := net.TCPAddr{
 		IP:   c.serverIP,
 		Port: port,
 	}
-	srcAddr := net.TCPAddr{
-		IP: c.laddr.IP,
-	}
-	dstAddr := net.TCPAddr{
-		IP:   c.addr.IP,
-		Port: destPort,
+
+	// check if service is allowed
+	if err := c.authorizer.Authorize(c.identity, "tcp", uint16(port),
+		uint16(destPort)); err != nil {
+		log.Warn("Could not create service", "error", err)
+		c.publishDenied("tcp", port, destPort, err.Error())
+		return network.MessageErr
 	}
 
-	// check if port is allowed
-	if !c.allowedPorts.containsPort(network.ProtocolTCP, uint16(port)) {
-		log.Printf("Could not create tcp service %s<->%s: "+
-			"port not allowed\n", &srvAddr, &dstAddr)
-		return false
+	// check if client already has a service on this port
+	if c.tcpPorts[port] {
+		log.Warn("Could not create service", "error",
+			"client already uses port")
+		c.publishDenied("tcp", port, destPort,
+			"client already uses port")
+		return network.MessageErr
 	}
 
 	// start tcp service
-	if runTCPService(&srvAddr, &srcAddr, &dstAddr) == nil {
-		return false
+	opts := c.serviceOpts.get(network.ProtocolTCP, uint16(port))
+	member := c.newPoolMember(destPort, stream)
+	if !stream {
+		member.newHealthCheck(network.ProtocolTCP, port, opts)
+	}
+	srv, standby := runTCPService(c.tcpServices, &srvAddr, pool, member,
+		opts)
+	if srv == nil && !standby {
+		member.stopHealthCheck()
+		c.publishDenied("tcp", port, destPort,
+			"could not start service")
+		return network.MessageErr
+	}
+	if srv != nil {
+		// standby services are checked when they become active
+		member.startHealthCheck()
 	}
 	c.tcpPorts[port] = true
-	return true
+	c.publishService(EventServiceAdded, "tcp", port, destPort, pool,
+		standby)
+	if standby {
+		return network.MessageStandby
+	}
+	return network.MessageOK
 }
 
-// addUDPService adds an udp service to the client
-func (c *client) addUDPService(port, destPort int) bool {
-	log.Printf("Adding new service for client %s: forward udp port %d "+
-		"to port %d\n", c.addr, port, destPort)
+// addUDPService adds an udp service to the client, if pool is not empty the
+// service joins the pool of services with this name. It returns the message
+// type of the reply to the client
+func (c *client) addUDPService(port, destPort int, pool string) uint8 {
+	log := c.log().With("protocol", "udp", "port", port, "dest_port",
+		destPort)
+	log.Info("Adding new service for client", "pool", pool)
 
-	// create udp addresses
+	// create udp address
 	srvAddr := net.UDPAddr{
 		IP:   c.serverIP,
 		Port: port,
 	}
-	srcAddr := net.UDPAddr{
-		IP: c.laddr.IP,
-	}
-	dstAddr := net.UDPAddr{
-		IP:   c.addr.IP,
-		Port: destPort,
+
+	// check if service is allowed
+	if err := c.authorizer.Authorize(c.identity, "udp", uint16(port),
+		uint16(destPort)); err != nil {
+		log.Warn("Could not create service", "error", err)
+		c.publishDenied("udp", port, destPort, err.Error())
+		return network.MessageErr
 	}
 
-	// check if port is allowed
-	if !c.allowedPorts.containsPort(network.ProtocolUDP, uint16(port)) {
-		log.Printf("Could not create udp service %s<->%s: "+
-			"port not allowed\n", &srvAddr, &dstAddr)
-		return false
+	// check if client already has a service on this port
+	if c.udpPorts[port] {
+		log.Warn("Could not create service", "error",
+			"client already uses port")
+		c.publishDenied("udp", port, destPort,
+			"client already uses port")
+		return network.MessageErr
 	}
 
 	// start udp service
-	if runUDPService(&srvAddr, &srcAddr, &dstAddr) == nil {
-		return false
+	opts := c.serviceOpts.get(network.ProtocolUDP, uint16(port))
+	member := c.newPoolMember(destPort, false)
+	srv, standby := runUDPService(c.udpServices, &srvAddr, pool, member,
+		opts)
+	if srv == nil && !standby {
+		c.publishDenied("udp", port, destPort,
+			"could not start service")
+		return network.MessageErr
 	}
 	c.udpPorts[port] = true
-	return true
+	c.publishService(EventServiceAdded, "udp", port, destPort, pool,
+		standby)
+	if standby {
+		return network.MessageStandby
+	}
+	return network.MessageOK
 }
 
-// addService adds a service to the client
-func (c *client) addService(protocol uint8, port, destPort uint16) bool {
+// addService adds a service to the client, if pool is not empty the service
+// joins the pool of services with this name. If stream is true, peer
+// connections are carried in streams over the control connection, this is
+// only supported for tcp. It returns the message type of the reply to the
+// client
+func (c *client) addService(protocol uint8, port, destPort uint16,
+	pool string, stream bool) uint8 {
 	// start service
-	switch protocol {
-	case network.ProtocolTCP:
-		return c.addTCPService(int(port), int(destPort))
-	case network.ProtocolUDP:
-		return c.addUDPService(int(port), int(destPort))
+	switch {
+	case protocol == network.ProtocolTCP:
+		return c.addTCPService(int(port), int(destPort), pool, stream)
+	case protocol == network.ProtocolUDP && !stream:
+		return c.addUDPService(int(port), int(destPort), pool)
 	default:
 		// unknown protocol, stop here
-		return false
+		c.publishDenied(protocolName(protocol), int(port),
+			int(destPort), "protocol not supported")
+		return network.MessageErr
 	}
 }
 
-// handleAddMsg handles the client's add message
-func (c *client) handleAddMsg(msg *network.Message) bool {
-	// try to add service
-	if ok := c.addService(msg.Protocol, msg.Port, msg.DestPort); ok {
-		msg.Op = network.MessageOK
-	} else {
+// handleAddMsg handles the client's add message, pool is the name of the
+// pool in add pool and add stream messages and stream specifies if peer
+// connections are carried in streams over the control connection. If the
+// port in msg is 0, a free port is chosen for services without pool
+func (c *client) handleAddMsg(msg *network.Message, pool string,
+	stream bool) bool {
+	// allocate a free port
+	if msg.Port == 0 && pool == "" {
+		port, err := c.allocator.AllocatePort(c.identity,
+			protocolName(msg.Protocol), c.serverIP)
+		if err != nil {
+			c.log().Warn("Could not create service for client",
+				"protocol", protocolName(msg.Protocol),
+				"dest_port", msg.DestPort, "error", err)
+			c.publishDenied(protocolName(msg.Protocol), 0,
+				int(msg.DestPort), err.Error())
+			msg.Op = network.MessageErr
+			return c.send(msg)
+		}
+		msg.Port = port
+	}
+	if msg.Port == 0 {
+		c.log().Warn("Could not create service for client",
+			"protocol", protocolName(msg.Protocol), "dest_port",
+			msg.DestPort, "error", "no free port")
+		c.publishDenied(protocolName(msg.Protocol), 0,
+			int(msg.DestPort), "no free port")
 		msg.Op = network.MessageErr
+		return c.send(msg)
 	}
 
+	// try to add service
+	msg.Op = c.addService(msg.Protocol, msg.Port, msg.DestPort, pool,
+		stream)
+
 	// send result back to client
-	if !network.WriteToConn(c.conn, msg.Serialize()) {
-		return false
+	return c.send(msg)
+}
+
+// delService removes the service with protocol and port from the client. It
+// returns the message type of the reply to the client
+func (c *client) delService(protocol uint8, port uint16) uint8 {
+	switch protocol {
+	case network.ProtocolTCP:
+		if !c.tcpPorts[int(port)] {
+			return network.MessageErr
+		}
+		delete(c.tcpPorts, int(port))
+		c.stopTCPService(int(port))
+	case network.ProtocolUDP:
+		if !c.udpPorts[int(port)] {
+			return network.MessageErr
+		}
+		delete(c.udpPorts, int(port))
+		c.stopUDPService(int(port))
+	default:
+		// unknown protocol, stop here
+		return network.MessageErr
 	}
-	return true
+	return network.MessageOK
+}
+
+// handleDelMsg handles the client's delete message
+func (c *client) handleDelMsg(msg *network.Message) bool {
+	// try to remove service
+	msg.Op = c.delService(msg.Protocol, msg.Port)
+
+	// send result back to client
+	return c.send(msg)
+}
+
+// send sends msg to the client, it is safe for concurrent use
+func (c *client) send(msg *network.Message) bool {
+	return c.sendWithData(msg, nil)
+}
+
+// sendWithData sends msg and, if messages of its type are followed by data,
+// data to the client, it is safe for concurrent use
+func (c *client) sendWithData(msg *network.Message, data []byte) bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	return network.WriteToConn(c.conn, msg.SerializeWithData(data))
 }
 
 // handleClient handles the client and its control connection
 func (c *client) handleClient() {
 	defer c.conn.Close()
 	defer c.stopClient()
+	c.publish(&Event{Type: EventClientConnected})
 	for {
 		// read a message from the connection and parse it; if there is
 		// no message within 30s, assume client is dead and stop
-		var msg network.Message
 		c.conn.SetDeadline(time.Now().Add(30 * time.Second))
-		buf := network.ReadFromConn(c.conn)
-		if buf == nil {
-			log.Println("Closing connection to client", c.addr)
+		msg, data := network.ReadMessageFromConn(c.conn)
+		if msg == nil {
+			c.log().Info("Closing connection to client")
 			return
 		}
-		msg.Parse(buf)
+
+		// handle stream messages
+		if network.IsStreamMessage(msg.Op) {
+			if !c.streams.Handle(msg, data) {
+				c.log().Warn("Closing connection to client",
+					"error", "invalid stream message")
+				return
+			}
+			continue
+		}
 
 		// handle message types
 		switch msg.Op {
 		case network.MessageAdd:
-			if !c.handleAddMsg(&msg) {
+			if !c.handleAddMsg(msg, "", false) {
+				return
+			}
+		case network.MessageAddPool:
+			if len(data) == 0 {
+				c.log().Warn("Closing connection to client",
+					"error", "invalid pool")
+				return
+			}
+			if !c.handleAddMsg(msg, string(data), false) {
+				return
+			}
+		case network.MessageAddStream:
+			if !c.handleAddMsg(msg, string(data), true) {
+				return
+			}
+		case network.MessageAddForward:
+			if len(data) == 0 {
+				c.log().Warn("Closing connection to client",
+					"error", "invalid forward")
+				return
+			}
+			if !c.handleAddForwardMsg(msg, string(data)) {
 				return
 			}
 		case network.MessageDel:
-			// not implemented
+			if !c.handleDelMsg(msg) {
+				return
+			}
 		case network.MessageNop:
 			// just ignore NOP
 		default:
 			// unknown message, stop here
-			log.Println("Unknown message from client", c.addr)
-			log.Println("Closing connection to client", c.addr)
+			c.log().Warn("Closing connection to client", "error",
+				"unknown message")
 			return
 		}
 	}
 }
 
-// stopClient stops active client services
+// stopTCPService removes the client from the tcp service on port
+func (c *client) stopTCPService(port int) {
+	s, m, next := c.tcpServices.leave(port, c)
+	if m == nil {
+		// service has already been removed
+		return
+	}
+	m.stopHealthCheck()
+	pool := ""
+	if s != nil {
+		pool = s.pool.name
+	}
+	c.publishService(EventServiceRemoved, "tcp", port, m.dstPort, pool,
+		s == nil)
+	log := c.log().With("protocol", "tcp", "port", port, "dest_port",
+		m.dstPort)
+	if s == nil {
+		log.Info("Removing a standby service for client")
+		return
+	}
+	log.Info("Removing a service for client", "pool", pool)
+	if remaining := s.pool.count(); remaining > 0 {
+		log.Info("Keeping service with remaining pool members",
+			"members", remaining)
+		s.closeMember(m, closeReasonRemoved)
+		return
+	}
+	s.stopService()
+	startStandbyTCPService(next)
+}
+
+// stopUDPService removes the client from the udp service on port
+func (c *client) stopUDPService(port int) {
+	s, m, next := c.udpServices.leave(port, c)
+	if m == nil {
+		// service has already been removed
+		return
+	}
+	m.stopHealthCheck()
+	pool := ""
+	if s != nil {
+		pool = s.pool.name
+	}
+	c.publishService(EventServiceRemoved, "udp", port, m.dstPort, pool,
+		s == nil)
+	log := c.log().With("protocol", "udp", "port", port, "dest_port",
+		m.dstPort)
+	if s == nil {
+		log.Info("Removing a standby service for client")
+		return
+	}
+	log.Info("Removing a service for client", "pool", pool,
+		"sessions", s.sessionCount(), "drops", s.dropCount())
+	if remaining := s.pool.count(); remaining > 0 {
+		log.Info("Keeping service with remaining pool members",
+			"members", remaining)
+		s.closeMember(m, closeReasonRemoved)
+		return
+	}
+	s.stopService()
+	startStandbyUDPService(next)
+}
+
+// closeMember closes the peer connections and udp sessions of the service on
+// protocol and port with the destination of member because of reason
+func (c *client) closeMember(protocol uint8, port int, member *poolMember,
+	reason string) {
+	switch protocol {
+	case network.ProtocolTCP:
+		if s := c.tcpServices.get(port); s != nil {
+			s.closeMember(member, reason)
+		}
+	case network.ProtocolUDP:
+		if s := c.udpServices.get(port); s != nil {
+			s.closeMember(member, reason)
+		}
+	}
+}
+
+// stopClient stops active client services and streams
 func (c *client) stopClient() {
+	c.clients.Add(-1)
+	c.streams.CloseAll()
 	for port := range c.tcpPorts {
-		s := tcpServices.get(port)
-		log.Printf("Removing a service for client %s: forward tcp "+
-			"port %d to port %d\n", c.addr, s.srvAddr.Port,
-			s.dstAddr.Port)
-		s.stopService()
-		tcpServices.del(port)
+		c.stopTCPService(port)
 	}
 	for port := range c.udpPorts {
-		s := udpServices.get(port)
-		log.Printf("Removing a service for client %s: forward udp "+
-			"port %d to port %d\n", c.addr, s.srvAddr.Port,
-			s.dstAddr.Port)
-		s.stopService()
-		udpServices.del(port)
+		c.stopUDPService(port)
 	}
+	c.publish(&Event{Type: EventClientDisconnected})
 }
 
-// handleClient handles the client with its control connection conn
-func handleClient(conn net.Conn, tlsConfig *tls.Config, serverIP net.IP,
-	allowedPorts portRangeList) {
+// newClient creates a new client with its control connection conn on the
+// control server srv; it returns nil if the tls handshake or the
+// authentication fails
+func newClient(conn net.Conn, srv *controlServer) *client {
 	c := client{
-		conn:         conn,
-		addr:         conn.RemoteAddr().(*net.TCPAddr),
-		laddr:        conn.LocalAddr().(*net.TCPAddr),
-		serverIP:     serverIP,
-		tcpPorts:     make(map[int]bool),
-		udpPorts:     make(map[int]bool),
-		allowedPorts: allowedPorts,
-	}
-	tlsInfo := ""
-	if tlsConfig != nil {
-		tlsConn := tls.Server(conn, tlsConfig)
+		conn:        conn,
+		addr:        conn.RemoteAddr().(*net.TCPAddr),
+		laddr:       conn.LocalAddr().(*net.TCPAddr),
+		serverIP:    srv.addr.IP,
+		tcpPorts:    make(map[int]bool),
+		udpPorts:    make(map[int]bool),
+		authorizer:  srv.authorizer,
+		allocator:   srv.allocator,
+		serviceOpts: &srv.serviceOpts,
+		forwards:    &srv.forwards,
+		clients:     &srv.clients,
+		events:      &srv.events,
+		logger:      &srv.logger,
+		accessLog:   &srv.accessLog,
+		tcpServices: &srv.tcpServices,
+		udpServices: &srv.udpServices,
+		session:     network.NewSessionID(),
+	}
+	var state *tls.ConnectionState
+	if srv.tlsConfig != nil {
+		tlsConn := tls.Server(conn, srv.tlsConfig)
 		tlsConn.SetDeadline(time.Now().Add(15 * time.Second))
 		if err := tlsConn.Handshake(); err != nil {
-			log.Println("TLS handshake with client", c.addr,
-				"failed:", err)
+			c.log().Warn("TLS handshake with client failed",
+				"error", err)
 			tlsConn.Close()
-			return
+			return nil
 		}
-		clientCert := tlsConn.ConnectionState().PeerCertificates[0]
-		commonName := clientCert.Subject.CommonName
-		tlsInfo = " (CN=" + commonName + ")"
+		cs := tlsConn.ConnectionState()
+		state = &cs
 		c.conn = tlsConn
 	}
-	log.Printf("New connection from client %s%s\n", c.addr, tlsInfo)
-	go c.handleClient()
+
+	// authenticate client and get its forward policy
+	id, err := srv.authenticate(c.conn, state)
+	if err != nil {
+		c.log().Warn("Dropping new connection", "error", err)
+		c.conn.Close()
+		return nil
+	}
+	c.identity = id
+	if policy := srv.policies.get(id.Name); policy != nil {
+		c.forwards = policy
+	}
+	c.streams = network.NewStreams(c.conn, true, c.sendWithData,
+		c.acceptStream)
+	c.log().Info("New connection from client", "tls", state != nil)
+	c.clients.Add(1)
+	return &c
+}
+
+// handleClient handles the client with its control connection conn on the
+// control server srv; if the server is shut down, conn is closed
+func handleClient(conn net.Conn, srv *controlServer) {
+	if !srv.addConn(conn) {
+		conn.Close()
+		return
+	}
+	go func() {
+		defer srv.delConn(conn)
+		if c := newClient(conn, srv); c != nil {
+			c.handleClient()
+		}
+	}()
 }
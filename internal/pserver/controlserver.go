@@ -1,95 +1,597 @@
 package pserver
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
 )
 
+// Config stores the configuration of the control server
+type Config struct {
+	// Addr is the address the control server listens on
+	Addr *net.TCPAddr
+	// WebSocketAddr is the address of the http listener the control
+	// server accepts websocket control connections on, if it is nil,
+	// websockets are not used
+	WebSocketAddr *net.TCPAddr
+	// Stdio specifies if the control server handles a single control
+	// connection over stdin and stdout instead of listening on Addr
+	Stdio bool
+	// TLSConfig is the tls configuration of the control server, if it
+	// is nil, tls is not used
+	TLSConfig *tls.Config
+	// AllowedIPs is a comma-separated list of IPs the control server
+	// accepts connections from
+	AllowedIPs string
+	// AllowedPorts is a comma-separated list of protocol and port (range)
+	// pairs that are allowed in service registrations
+	AllowedPorts string
+	// ServiceOptions is a comma-separated list of service options, e.g.,
+	// timeouts, for protocols and port ranges
+	ServiceOptions string
+	// ForwardIPs is a comma-separated list of IPs that clients can reach
+	// with local forwards through the server
+	ForwardIPs string
+	// ForwardPorts is a comma-separated list of protocol and port (range)
+	// pairs that clients can reach with local forwards through the server
+	ForwardPorts string
+	// ForwardPolicies is a comma-separated list of forward policies of
+	// clients, identified by the common names of their certificates, that
+	// replace ForwardIPs and ForwardPorts for these clients
+	ForwardPolicies string
+	// Authenticator authenticates clients, if it is nil, clients are
+	// authenticated by AllowedIPs and identified by the common names of
+	// their tls certificates
+	Authenticator Authenticator
+	// Authorizer authorizes service registrations, if it is nil, the
+	// ports in AllowedPorts are allowed
+	Authorizer Authorizer
+	// AuthHook is the url of an http endpoint or a command that
+	// authorizes service registrations after Authorizer, if it is empty,
+	// no hook is used
+	AuthHook string
+	// AuthHookCache is the time decisions of AuthHook are cached, unless
+	// the hook sets another time in its response; if it is 0, decisions
+	// are not cached
+	AuthHookCache time.Duration
+	// AuthHookFailOpen specifies if registrations are allowed if AuthHook
+	// fails, by default they are denied
+	AuthHookFailOpen bool
+	// EventWebhooks is a comma-separated list of urls events of clients
+	// and services are sent to as http POST requests
+	EventWebhooks string
+	// EventWebhookSecret is the secret events sent to EventWebhooks are
+	// signed with, if it is empty, events are not signed
+	EventWebhookSecret string
+	// EventsAddr is the address of the http listener that serves the
+	// event stream, if it is nil, no event stream is served
+	EventsAddr *net.TCPAddr
+	// EventCommand is a command that is run for each event of clients
+	// and services with the event on stdin, if it is empty, no command
+	// is run
+	EventCommand string
+	// PortAllocator allocates ports for service registrations without
+	// port, if it is nil, the first free port in AllowedPorts is used
+	PortAllocator PortAllocator
+	// Logger is the logger for log messages of the control server, if it
+	// is nil, the default slog logger is used
+	Logger Logger
+	// LogHandler is the handler for structured log messages, it replaces
+	// Logger if it is not nil
+	LogHandler slog.Handler
+	// AccessLog is the writer for the access log with a JSON record for
+	// each peer connection and udp session of services, if it is nil, no
+	// access log is written
+	AccessLog io.Writer
+}
+
 // controlServer stores controlServer server information
 type controlServer struct {
 	addr         *net.TCPAddr
+	wsAddr       *net.TCPAddr
+	stdio        bool
 	tlsConfig    *tls.Config
 	listener     *net.TCPListener
+	wsListener   *net.TCPListener
+	clients      atomic.Int64
 	allowedIPs   ipNetList
 	allowedPorts portRangeList
+	serviceOpts  serviceOptionsList
+	forwards     forwardPolicy
+	policies     forwardPolicyList
+	wsServer     *http.Server
+	auth         Authenticator
+	authorizer   Authorizer
+	hook         *authHook
+	allocator    PortAllocator
+	events       eventBus
+	webhooks     eventWebhookList
+	secret       string
+	eventCommand string
+	// eventsAddr, eventsListener and eventsServer serve the event stream
+	eventsAddr     *net.TCPAddr
+	eventsListener *net.TCPListener
+	eventsServer   *http.Server
+	// logger and accessLog are the logger and access log of the control
+	// server and its services
+	logger    sharedLogger
+	accessLog sharedAccessLog
+	// tcpServices and udpServices are the services of the clients
+	tcpServices tcpServiceMap
+	udpServices udpServiceMap
+
+	// mutex protects the following fields
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	// done is closed when the server is shut down
+	done chan struct{}
+	// connsDone waits for the goroutines of the control connections
+	connsDone sync.WaitGroup
 }
 
-// runServer runs the control server
-func (c *controlServer) runServer() {
-	// start control socket
-	listener, err := net.ListenTCP("tcp", c.addr)
-	if err != nil {
-		log.Fatal(err)
+// addConn adds the control connection conn to the control server, it
+// returns false if the server is shut down
+func (c *controlServer) addConn(conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return false
+	}
+	if c.conns == nil {
+		c.conns = make(map[net.Conn]bool)
 	}
+	c.conns[conn] = true
+	c.connsDone.Add(1)
+	return true
+}
+
+// delConn removes the control connection conn from the control server
+func (c *controlServer) delConn(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.conns, conn)
+	c.connsDone.Done()
+}
+
+// isClosed checks if the control server is shut down
+func (c *controlServer) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closed
+}
+
+// runServer runs the control server until its listener is closed, it
+// returns an error if the listener fails before the server is shut down
+func (c *controlServer) runServer() error {
+	listener := c.listener
 	defer listener.Close()
-	c.listener = listener
 	for {
 		// get new control connection
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if c.isClosed() {
+				return nil
+			}
+			return err
 		}
 
-		// if connection is not from an allowed ip, drop it
-		ip := conn.RemoteAddr().(*net.TCPAddr).IP
-		if !c.allowedIPs.containsIP(ip) {
-			log.Printf("Dropping new connection from %s: "+
-				"IP not allowed\n", conn.RemoteAddr())
-			conn.Close()
-			continue
+		// handle client connection
+		handleClient(conn, c)
+	}
+}
+
+// listen creates the listeners of the control server, if they have not been
+// passed by systemd socket activation
+func (c *controlServer) listen() error {
+	if c.listener == nil {
+		listener, err := net.ListenTCP("tcp", c.addr)
+		if err != nil {
+			return err
+		}
+		c.listener = listener
+	}
+	if c.wsAddr != nil && c.wsListener == nil {
+		listener, err := net.ListenTCP("tcp", c.wsAddr)
+		if err != nil {
+			c.listener.Close()
+			return err
 		}
+		c.wsListener = listener
+	}
+	if c.wsListener != nil {
+		c.wsServer = &http.Server{
+			Handler:           http.HandlerFunc(c.handleWebSocket),
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+	}
+	if c.eventsAddr != nil {
+		listener, err := net.ListenTCP("tcp", c.eventsAddr)
+		if err != nil {
+			c.listener.Close()
+			if c.wsListener != nil {
+				c.wsListener.Close()
+			}
+			return err
+		}
+		c.eventsListener = listener
+		c.eventsServer = &http.Server{
+			Handler:           http.HandlerFunc(c.handleEvents),
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+	}
+	return nil
+}
 
-		// handle client connection
-		handleClient(conn, c.tlsConfig, c.addr.IP, c.allowedPorts)
+// handleWebSocket handles the http request r of a websocket control
+// connection
+func (c *controlServer) handleWebSocket(w http.ResponseWriter,
+	r *http.Request) {
+	// upgrade request to websocket and handle client connection
+	conn, err := network.AcceptWebSocket(w, r)
+	if err != nil {
+		c.logger.Warn("Dropping new websocket connection", "client",
+			r.RemoteAddr, "error", err)
+		return
 	}
+	handleClient(conn, c)
 }
 
-// RunControlServer runs the control server on addr
-func RunControlServer(addr *net.TCPAddr, tlsConfig *tls.Config,
-	allowedIPs, allowedPorts string) {
-	// create control server
-	c := controlServer{
-		addr:      addr,
-		tlsConfig: tlsConfig,
+// runWebSocketServer runs the http server for websocket control connections
+func (c *controlServer) runWebSocketServer() {
+	err := c.wsServer.Serve(c.wsListener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		c.logger.Error("Stopping websocket control connections",
+			"error", err)
 	}
+}
 
-	// parse allowed IP addresses
-	if allowedIPs != "" {
-		aIP := strings.Split(allowedIPs, ",")
-		for _, a := range aIP {
-			c.allowedIPs.add(a)
-		}
+// serve runs the control server on its listeners until it is shut down, it
+// returns an error if the listener fails before the server is shut down
+func (c *controlServer) serve() error {
+	if c.wsServer != nil {
+		go c.runWebSocketServer()
+	}
+	if c.eventsServer != nil {
+		go c.runEventsServer()
+	}
+	return c.runServer()
+}
+
+// shutdown shuts down the control server. It closes the listeners and all
+// control connections, which stops the services of the clients, and waits
+// until the clients are stopped or ctx is done
+func (c *controlServer) shutdown(ctx context.Context) error {
+	c.mutex.Lock()
+	if !c.closed {
+		close(c.done)
+	}
+	c.closed = true
+	conns := make([]net.Conn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.mutex.Unlock()
+
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.wsServer != nil {
+		c.wsServer.Close()
+	}
+	if c.eventsServer != nil {
+		c.eventsServer.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.connsDone.Wait()
+		close(done)
+	}()
+	defer c.events.close()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startEventHooks starts sending the events of the control server to its
+// webhooks and event command
+func (c *controlServer) startEventHooks() {
+	// peer events are only sent to event streams
+	noPeers := func(e *Event) bool { return !e.isPeerEvent() }
+	for _, u := range c.webhooks.getAll() {
+		go runEventWebhook(c.events.subscribe(noPeers), u, c.secret,
+			c.logger.get())
+	}
+	if c.eventCommand != "" {
+		go runEventCommand(c.events.subscribe(noPeers),
+			c.eventCommand, c.logger.get())
+	}
+}
+
+// authenticate authenticates the client with the control connection conn and
+// tls connection state and returns its identity. Without authenticator, all
+// clients are allowed and identified by their tls certificates
+func (c *controlServer) authenticate(conn net.Conn,
+	state *tls.ConnectionState) (*Identity, error) {
+	if c.auth == nil {
+		return tlsIdentity(conn, state), nil
+	}
+	id, err := c.auth.Authenticate(conn, state)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		id = &Identity{Addr: conn.RemoteAddr()}
+	}
+	return id, nil
+}
+
+// stdioAddrs returns the local and remote address of a control connection
+// over stdin and stdout. In an ssh session, these are the addresses in the
+// SSH_CONNECTION environment variable, otherwise the client is on localhost
+func stdioAddrs() (*net.TCPAddr, *net.TCPAddr) {
+	local := &net.TCPAddr{}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	fields := strings.Fields(os.Getenv("SSH_CONNECTION"))
+	if len(fields) != 4 {
+		return local, remote
+	}
+	if ip := net.ParseIP(fields[0]); ip != nil {
+		port, _ := strconv.Atoi(fields[1])
+		remote = &net.TCPAddr{IP: ip, Port: port}
+	}
+	if ip := net.ParseIP(fields[2]); ip != nil {
+		port, _ := strconv.Atoi(fields[3])
+		local = &net.TCPAddr{IP: ip, Port: port}
+	}
+	return local, remote
+}
+
+// runStdio runs the control server with a single control connection over
+// stdin and stdout until the connection is closed
+func (c *controlServer) runStdio() {
+	local, remote := stdioAddrs()
+	conn := network.NewPipeConn(os.Stdin, os.Stdout, func() error {
+		os.Stdin.Close()
+		return os.Stdout.Close()
+	}, local, remote)
+	if client := newClient(conn, c); client != nil {
+		client.handleClient()
 	}
+}
 
-	// parse allowed ports
-	if allowedPorts != "" {
-		aPorts := strings.Split(allowedPorts, ",")
-		for _, a := range aPorts {
-			c.allowedPorts.add(a)
+// parseList splits the comma-separated list into its entries and adds them
+// with add
+func parseList(list string, add func(string) error) error {
+	if list == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		if err := add(entry); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// output info and run control server
-	ip := ""
-	if addr.IP != nil {
-		ip = fmt.Sprintf("%s", addr.IP)
+// newControlServer creates a new control server with configuration config
+func newControlServer(config *Config) (*controlServer, error) {
+	c := controlServer{
+		addr:      config.Addr,
+		wsAddr:    config.WebSocketAddr,
+		stdio:     config.Stdio,
+		tlsConfig: config.TLSConfig,
+		done:      make(chan struct{}),
+	}
+	if c.addr == nil {
+		c.addr = &net.TCPAddr{}
+	}
+	c.logger.set(config.LogHandler, config.Logger)
+	c.accessLog.set(config.AccessLog)
+	c.accessLog.logger = &c.logger
+	c.events.logger = &c.logger
+	c.tcpServices.logger = &c.logger
+	c.udpServices.logger = &c.logger
+	c.allowedPorts.inUse = c.portInUse
+
+	// set authenticator, authorizer and port allocator, the default
+	// authenticator is not used in stdio mode
+	c.auth = config.Authenticator
+	if c.auth == nil && !c.stdio {
+		c.auth = &c.allowedIPs
+	}
+	c.authorizer = config.Authorizer
+	if c.authorizer == nil {
+		c.authorizer = &c.allowedPorts
+	}
+	if config.AuthHook != "" {
+		c.hook = newAuthHook(config.AuthHook, config.AuthHookCache,
+			config.AuthHookFailOpen, c.authorizer, &c.logger)
+		c.authorizer = c.hook
+	}
+	c.allocator = config.PortAllocator
+	if c.allocator == nil {
+		c.allocator = &c.allowedPorts
+	}
+
+	// parse allowed IP addresses and ports
+	if err := parseList(config.AllowedIPs, c.allowedIPs.add); err != nil {
+		return nil, fmt.Errorf("invalid allowed IP: %w", err)
+	}
+	if err := parseList(config.AllowedPorts,
+		c.allowedPorts.add); err != nil {
+		return nil, fmt.Errorf("invalid allowed port: %w", err)
+	}
+
+	// parse service options
+	if err := parseList(config.ServiceOptions,
+		c.serviceOpts.add); err != nil {
+		return nil, fmt.Errorf("invalid service options: %w", err)
+	}
+
+	// parse allowed targets of local forwards
+	if err := parseList(config.ForwardIPs, c.forwards.ips.add); err != nil {
+		return nil, fmt.Errorf("invalid forward IP: %w", err)
+	}
+	if err := parseList(config.ForwardPorts,
+		c.forwards.ports.add); err != nil {
+		return nil, fmt.Errorf("invalid forward port: %w", err)
+	}
+	if err := parseList(config.ForwardPolicies,
+		c.policies.add); err != nil {
+		return nil, fmt.Errorf("invalid forward policy: %w", err)
+	}
+
+	// parse event hooks
+	if err := parseList(config.EventWebhooks,
+		c.webhooks.add); err != nil {
+		return nil, fmt.Errorf("invalid event webhook: %w", err)
+	}
+	c.secret = config.EventWebhookSecret
+	c.eventsAddr = config.EventsAddr
+	c.eventCommand = config.EventCommand
+	return &c, nil
+}
+
+// portInUse checks if a service of the control server uses port with
+// protocol
+func (c *controlServer) portInUse(protocol string, port int) bool {
+	switch protocol {
+	case "tcp":
+		return c.tcpServices.get(port) != nil
+	case "udp":
+		return c.udpServices.get(port) != nil
+	default:
+		return false
 	}
-	tlsInfo := ""
-	if tlsConfig != nil {
-		tlsInfo = "in mTLS mode "
+}
+
+// logConfig outputs the configuration of the control server
+func (c *controlServer) logConfig() {
+	tls := c.tlsConfig != nil
+	if c.stdio {
+		c.logger.Info("Starting server in stdio mode", "tls", tls)
+	} else if c.listener != nil {
+		c.logger.Info("Starting server on systemd socket", "tls", tls,
+			"addr", c.listener.Addr().String())
+	} else {
+		c.logger.Info("Starting server", "tls", tls, "addr",
+			c.addr.String())
+	}
+	if !c.stdio {
+		if c.wsListener != nil {
+			c.logger.Info("Accepting websocket control "+
+				"connections on systemd socket", "addr",
+				c.wsListener.Addr().String())
+		} else if c.wsAddr != nil {
+			c.logger.Info("Accepting websocket control connections",
+				"addr", c.wsAddr.String())
+		}
+		if c.auth != Authenticator(&c.allowedIPs) {
+			c.logger.Info("Using custom authenticator for " +
+				"control connections")
+		}
+		for _, ipNet := range c.allowedIPs.getAll() {
+			c.logger.Info("Allowing control connections", "ips",
+				ipNet.String())
+		}
+	}
+	authorizer := c.authorizer
+	if c.hook != nil {
+		authorizer = c.hook.next
+	}
+	if authorizer != Authorizer(&c.allowedPorts) {
+		c.logger.Info("Using custom authorizer for service " +
+			"registrations")
 	}
-	log.Printf("Starting server %sand listening on %s:%d\n", tlsInfo, ip,
-		addr.Port)
-	for _, ipNet := range c.allowedIPs.getAll() {
-		log.Printf("Allowing control connections from %s\n", ipNet)
+	if c.hook != nil {
+		c.logger.Info("Using authorization hook for service "+
+			"registrations", "hook", c.hook.String())
 	}
 	for _, portRange := range c.allowedPorts.getAll() {
-		log.Printf("Allowing port range %s in service registrations\n",
-			portRange)
+		c.logger.Info("Allowing port range in service registrations",
+			"ports", portRange.String())
 	}
+	for _, ipNet := range c.forwards.ips.getAll() {
+		c.logger.Info("Allowing local forwards", "ips", ipNet.String())
+	}
+	for _, portRange := range c.forwards.ports.getAll() {
+		c.logger.Info("Allowing port range in local forwards", "ports",
+			portRange.String())
+	}
+	for _, e := range c.policies.getAll() {
+		c.logger.Info("Using forward policy for client", "identity",
+			e.identity, "policy", e.policy.String())
+	}
+	for _, opts := range c.serviceOpts.getAll() {
+		c.logger.Info("Using service options", "options", opts.String())
+	}
+	if c.eventsAddr != nil && !c.stdio {
+		c.logger.Info("Serving event stream", "url",
+			"http://"+c.eventsAddr.String()+"/events")
+	}
+	for _, u := range c.webhooks.getAll() {
+		c.logger.Info("Sending events to webhook", "url", u)
+	}
+	if c.eventCommand != "" {
+		c.logger.Info("Sending events to command", "command",
+			c.eventCommand)
+	}
+}
 
-	c.runServer()
+// RunControlServer runs the control server with configuration config
+func RunControlServer(config *Config) {
+	// create control server
+	c, err := newControlServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// get listeners from systemd socket activation
+	if !c.stdio {
+		listener, wsListener, err := systemdListeners(c.logger.get())
+		if err != nil {
+			log.Fatal("cannot use systemd sockets: ", err)
+		}
+		c.listener, c.wsListener = listener, wsListener
+	}
+
+	// output info and run control server
+	c.logConfig()
+	c.startEventHooks()
+	if c.stdio {
+		c.runStdio()
+		return
+	}
+	if err := c.listen(); err != nil {
+		log.Fatal(err)
+	}
+	go c.runNotify(c.done)
+	if err := c.serve(); err != nil {
+		log.Fatal(err)
+	}
 }
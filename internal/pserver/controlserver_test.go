@@ -13,30 +13,54 @@ func TestRunControlServer(t *testing.T) {
 		IP:   net.IPv4(127, 0, 0, 1),
 		Port: 53535,
 	}
-	allowedIPs := "127.0.0.1"
-	allowedPorts := "tcp:53535-54545"
-	go RunControlServer(&addr, nil, allowedIPs, allowedPorts)
+	config := Config{
+		Addr:         &addr,
+		AllowedIPs:   "127.0.0.1",
+		AllowedPorts: "tcp:53535-54545",
+	}
+	go RunControlServer(&config)
 	time.Sleep(1 * time.Second)
 
 	// test client with not registered but already used port
-	go pclient.RunControlClient(&addr, nil, "tcp:53535:53535")
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:53535:53535",
+	})
 	time.Sleep(1 * time.Second)
 
 	// test client with not allowed port
-	go pclient.RunControlClient(&addr, nil, "tcp:50000:50000")
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:50000:50000",
+	})
 	time.Sleep(1 * time.Second)
 
 	// test client with allowed port
-	go pclient.RunControlClient(&addr, nil, "tcp:53536:53536")
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:53536:53536",
+	})
 	time.Sleep(1 * time.Second)
 
 	// test client with already registered port
-	go pclient.RunControlClient(&addr, nil, "tcp:53536:53536")
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:53536:53536",
+	})
 	time.Sleep(1 * time.Second)
 
 	// test parallel clients
-	go pclient.RunControlClient(&addr, nil, "tcp:53537:53537")
-	go pclient.RunControlClient(&addr, nil, "tcp:53538:53538")
-	go pclient.RunControlClient(&addr, nil, "tcp:53539:53539")
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:53537:53537",
+	})
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:53538:53538",
+	})
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:53539:53539",
+	})
 	time.Sleep(1 * time.Second)
 }
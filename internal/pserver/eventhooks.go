@@ -0,0 +1,142 @@
+package pserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	// eventHookTimeout is the maximum time of a webhook request or an
+	// event command
+	eventHookTimeout = 10 * time.Second
+	// eventWebhookAttempts is the number of attempts to send an event to
+	// a webhook
+	eventWebhookAttempts = 4
+)
+
+var (
+	// eventWebhookRetryDelay is the delay before the first retry of a
+	// webhook request, it is doubled for each further retry
+	eventWebhookRetryDelay = time.Second
+)
+
+// eventWebhookList is a list of webhook urls for events
+type eventWebhookList struct {
+	l []string
+}
+
+// add checks the webhook url in entry and adds it to the list
+func (e *eventWebhookList) add(entry string) error {
+	u, err := url.Parse(entry)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url: %s", entry)
+	}
+	e.l = append(e.l, entry)
+	return nil
+}
+
+// getAll returns all webhook urls in the list
+func (e *eventWebhookList) getAll() []string {
+	return e.l
+}
+
+// signEvent returns the hex encoded HMAC-SHA256 of the event in buf with
+// secret
+func signEvent(secret string, buf []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(buf)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postEvent sends the event in buf of type t to the webhook url, the event
+// is signed with secret if it is not empty
+func postEvent(url, secret, t string, buf []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		eventHookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Proxy-Event", t)
+	if secret != "" {
+		req.Header.Set("X-Service-Proxy-Signature",
+			"sha256="+signEvent(secret, buf))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// runEventWebhook sends the events in events to the webhook url until events
+// is closed. Failed requests are retried with increasing delays, the events
+// are signed with secret if it is not empty. Failures are logged with log
+func runEventWebhook(events chan *Event, url, secret string,
+	log *slog.Logger) {
+	for e := range events {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		delay := eventWebhookRetryDelay
+		for i := 1; ; i++ {
+			err = postEvent(url, secret, e.Type, buf)
+			if err == nil || i == eventWebhookAttempts {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil {
+			log.Warn("Could not send event to webhook",
+				"event", e.Type, "url", url, "error", err)
+		}
+	}
+}
+
+// runEventCommand runs command in a shell for each event in events until
+// events is closed, the event is passed as JSON on stdin. Failures are logged
+// with log
+func runEventCommand(events chan *Event, command string, log *slog.Logger) {
+	for e := range events {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			eventHookTimeout)
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(buf)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Warn("Could not run event command", "event",
+				e.Type, "error", err)
+		}
+		cancel()
+	}
+}
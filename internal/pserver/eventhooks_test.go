@@ -0,0 +1,98 @@
+package pserver
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventWebhookListAdd(t *testing.T) {
+	var l eventWebhookList
+	for _, u := range []string{"http://example.com/hook",
+		"https://example.com"} {
+		if err := l.add(u); err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	}
+	for _, u := range []string{"ftp://example.com", "http://",
+		"example.com"} {
+		if err := l.add(u); err == nil {
+			t.Errorf("got nil, want error for %s", u)
+		}
+	}
+}
+
+func TestRunEventWebhook(t *testing.T) {
+	eventWebhookRetryDelay = 10 * time.Millisecond
+	defer func() { eventWebhookRetryDelay = time.Second }()
+
+	// webhook fails the first request and passes events to received
+	received := make(chan *Event, 1)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			buf, _ := io.ReadAll(r.Body)
+			want := "sha256=" + signEvent("secret", buf)
+			got := r.Header.Get("X-Service-Proxy-Signature")
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+			var e Event
+			json.Unmarshal(buf, &e)
+			received <- &e
+		}))
+	defer srv.Close()
+
+	events := make(chan *Event, 1)
+	events <- &Event{Type: EventClientConnected}
+	close(events)
+	runEventWebhook(events, srv.URL, "secret", slog.Default())
+	select {
+	case e := <-received:
+		if e.Type != EventClientConnected {
+			t.Errorf("got %s, want %s", e.Type,
+				EventClientConnected)
+		}
+	default:
+		t.Errorf("got no event, want %s", EventClientConnected)
+	}
+}
+
+func TestRunEventCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "events")
+	events := make(chan *Event, 2)
+	events <- &Event{Type: EventClientConnected}
+	events <- &Event{Type: EventClientDisconnected}
+	close(events)
+	runEventCommand(events, "cat >> "+file+"; echo >> "+file,
+		slog.Default())
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	for _, want := range []string{EventClientConnected,
+		EventClientDisconnected} {
+		var e Event
+		if err := d.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != want {
+			t.Errorf("got %s, want %s", e.Type, want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package pserver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// eventQueueLen is the number of events queued for each subscriber
+	// of the event bus
+	eventQueueLen = 256
+)
+
+// event types
+const (
+	// EventClientConnected is sent when a client connects
+	EventClientConnected = "client.connected"
+	// EventClientDisconnected is sent when a client disconnects
+	EventClientDisconnected = "client.disconnected"
+	// EventServiceAdded is sent when a client registers a service
+	EventServiceAdded = "service.added"
+	// EventServiceActive is sent when a standby service becomes active
+	EventServiceActive = "service.active"
+	// EventServiceRemoved is sent when a service of a client is removed
+	EventServiceRemoved = "service.removed"
+	// EventRegistrationDenied is sent when a service registration of a
+	// client is denied
+	EventRegistrationDenied = "registration.denied"
+	// EventPeerConnected is sent when a peer connects to a service
+	EventPeerConnected = "peer.connected"
+	// EventPeerDisconnected is sent when the connection of a peer to a
+	// service is closed
+	EventPeerDisconnected = "peer.disconnected"
+)
+
+// Event is a lifecycle event of a client or a service
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Client is the address of the client's control connection
+	Client string `json:"client"`
+	// Identity is the name of the client's identity
+	Identity string `json:"identity,omitempty"`
+	// Protocol, Port, DestPort, Pool and Standby describe the service of
+	// service events
+	Protocol string `json:"protocol,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	DestPort int    `json:"dest_port,omitempty"`
+	Pool     string `json:"pool,omitempty"`
+	Standby  bool   `json:"standby,omitempty"`
+	// Reason is the reason of denied registrations
+	Reason string `json:"reason,omitempty"`
+	// Peer is the address of the peer of peer events, BytesFromPeer and
+	// BytesToPeer are the bytes forwarded from and to the peer
+	Peer          string `json:"peer,omitempty"`
+	BytesFromPeer int64  `json:"bytes_from_peer,omitempty"`
+	BytesToPeer   int64  `json:"bytes_to_peer,omitempty"`
+}
+
+// isPeerEvent checks if e is an event of a peer connection
+func (e *Event) isPeerEvent() bool {
+	return e.Type == EventPeerConnected || e.Type == EventPeerDisconnected
+}
+
+// eventBus passes events to its subscribers, it is safe for concurrent use
+type eventBus struct {
+	mutex sync.Mutex
+	// subs maps the channels of the subscribers to their filters
+	subs   map[chan *Event]func(e *Event) bool
+	closed bool
+	// logger is the logger for dropped events
+	logger *sharedLogger
+}
+
+// subscribe returns a new channel that receives the events on the bus that
+// pass filter or all events if filter is nil, it is closed when the bus is
+// closed
+func (b *eventBus) subscribe(filter func(e *Event) bool) chan *Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := make(chan *Event, eventQueueLen)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	if b.subs == nil {
+		b.subs = make(map[chan *Event]func(e *Event) bool)
+	}
+	b.subs[ch] = filter
+	return ch
+}
+
+// unsubscribe removes the subscription with channel ch and closes ch
+func (b *eventBus) unsubscribe(ch chan *Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish passes event e to all subscribers, if the queue of a subscriber
+// is full, e is dropped for it
+func (b *eventBus) publish(e *Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch, filter := range b.subs {
+		if filter != nil && !filter(e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			b.logger.Warn("Dropping event, queue full", "event",
+				e.Type, "client", e.Client)
+		}
+	}
+}
+
+// close closes the bus and the channels of all subscribers
+func (b *eventBus) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
+
+// publish publishes event e of the client
+func (c *client) publish(e *Event) {
+	if c == nil || c.events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Client = c.addr.String()
+	if c.identity != nil {
+		e.Identity = c.identity.Name
+	}
+	c.events.publish(e)
+}
+
+// publishService publishes an event of type t about the client's service
+// with protocol, port, destination port destPort and pool
+func (c *client) publishService(t, protocol string, port, destPort int,
+	pool string, standby bool) {
+	c.publish(&Event{
+		Type:     t,
+		Protocol: protocol,
+		Port:     port,
+		DestPort: destPort,
+		Pool:     pool,
+		Standby:  standby,
+	})
+}
+
+// publishDenied publishes a denied registration of a service with protocol,
+// port and destination port destPort of the client because of reason
+func (c *client) publishDenied(protocol string, port, destPort int,
+	reason string) {
+	c.publish(&Event{
+		Type:     EventRegistrationDenied,
+		Protocol: protocol,
+		Port:     port,
+		DestPort: destPort,
+		Reason:   reason,
+	})
+}
+
+// publishPeer publishes an event of type t about the connection of peer to
+// the client's service with protocol and port and the destination port
+// destPort; bytes are the bytes forwarded from and to the peer
+func (c *client) publishPeer(t, protocol string, port, destPort int,
+	peer net.Addr, bytes [2]int64) {
+	c.publish(&Event{
+		Type:          t,
+		Protocol:      protocol,
+		Port:          port,
+		DestPort:      destPort,
+		Peer:          peer.String(),
+		BytesFromPeer: bytes[0],
+		BytesToPeer:   bytes[1],
+	})
+}
@@ -0,0 +1,48 @@
+package pserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	var b eventBus
+	ch1 := b.subscribe(nil)
+	ch2 := b.subscribe(nil)
+
+	// publish event to all subscribers
+	c := &client{
+		addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		identity: &Identity{Name: "test"},
+		events:   &b,
+	}
+	c.publishService(EventServiceAdded, "tcp", 8000, 80, "", false)
+	for _, ch := range []chan *Event{ch1, ch2} {
+		e := <-ch
+		if e.Type != EventServiceAdded ||
+			e.Client != "127.0.0.1:1234" ||
+			e.Identity != "test" || e.Port != 8000 {
+			t.Errorf("got %+v, want service event", e)
+		}
+	}
+
+	// unsubscribe, full queues drop events
+	b.unsubscribe(ch2)
+	if _, ok := <-ch2; ok {
+		t.Errorf("got %t, want false", ok)
+	}
+	for i := 0; i < eventQueueLen+1; i++ {
+		c.publish(&Event{Type: EventClientConnected})
+	}
+	if len(ch1) != eventQueueLen {
+		t.Errorf("got %d, want %d", len(ch1), eventQueueLen)
+	}
+
+	// close bus
+	b.close()
+	for range ch1 {
+	}
+	if _, ok := <-b.subscribe(nil); ok {
+		t.Errorf("got %t, want false", ok)
+	}
+}
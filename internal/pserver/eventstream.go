@@ -0,0 +1,175 @@
+package pserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// eventStreamKeepAlive is the interval of keep-alive comments in
+	// server-sent event streams
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// eventFilter filters the events of an event stream, empty lists match all
+// events
+type eventFilter struct {
+	// types are event types or their prefixes, e.g., "service"
+	types []string
+	// identities are the names of client identities
+	identities []string
+	// services are services with protocol and port, e.g., "tcp:8000"
+	services []string
+}
+
+// matchAny checks if value is in list or list is empty, if prefix is true,
+// entries in the list also match values they are a prefix of followed by a
+// dot
+func matchAny(list []string, value string, prefix bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, l := range list {
+		if l == value || (prefix && strings.HasPrefix(value, l+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// match checks if the event e passes the filter
+func (f *eventFilter) match(e *Event) bool {
+	service := ""
+	if e.Protocol != "" {
+		service = fmt.Sprintf("%s:%d", e.Protocol, e.Port)
+	}
+	return matchAny(f.types, e.Type, true) &&
+		matchAny(f.identities, e.Identity, false) &&
+		matchAny(f.services, service, false)
+}
+
+// splitValues returns the comma-separated values of the query parameter key
+// in query
+func splitValues(query url.Values, key string) []string {
+	var values []string
+	for _, v := range query[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// parseEventFilter parses the event filter in the parameters type, identity
+// and service of query
+func parseEventFilter(query url.Values) (*eventFilter, error) {
+	f := &eventFilter{
+		types:      splitValues(query, "type"),
+		identities: splitValues(query, "identity"),
+		services:   splitValues(query, "service"),
+	}
+	for _, s := range f.services {
+		protocol, port, ok := strings.Cut(s, ":")
+		if !ok || (protocol != "tcp" && protocol != "udp") {
+			return nil, fmt.Errorf("invalid service: %s", s)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid service: %s", s)
+		}
+	}
+	return f, nil
+}
+
+// writeEvent writes the event e to w as server-sent event if sse is true or
+// as a line of JSON otherwise
+func writeEvent(w http.ResponseWriter, e *Event, sse bool) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if sse {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, buf)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", buf)
+	return err
+}
+
+// handleEvents handles the http request r for the event stream. The events
+// are sent as server-sent events if the client accepts them and as
+// newline-delimited JSON otherwise
+func (c *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/events" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe to events and start stream
+	events := c.events.subscribe(filter.match)
+	defer c.events.unsubscribe(events)
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// send events until the client or the server closes the stream
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, e, sse)
+		case <-keepAlive.C:
+			if !sse {
+				continue
+			}
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// runEventsServer runs the http server for event streams
+func (c *controlServer) runEventsServer() {
+	err := c.eventsServer.Serve(c.eventsListener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		c.logger.Error("Stopping event streams", "error", err)
+	}
+}
@@ -0,0 +1,115 @@
+package pserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEventFilter(t *testing.T) {
+	f, err := parseEventFilter(url.Values{
+		"type":     {"peer,service.added"},
+		"identity": {"alice"},
+		"service":  {"tcp:8000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		e    Event
+		want bool
+	}{
+		{Event{Type: EventPeerConnected, Identity: "alice",
+			Protocol: "tcp", Port: 8000}, true},
+		{Event{Type: EventServiceAdded, Identity: "alice",
+			Protocol: "tcp", Port: 8000}, true},
+		{Event{Type: EventServiceRemoved, Identity: "alice",
+			Protocol: "tcp", Port: 8000}, false},
+		{Event{Type: EventPeerConnected, Identity: "bob",
+			Protocol: "tcp", Port: 8000}, false},
+		{Event{Type: EventPeerConnected, Identity: "alice",
+			Protocol: "udp", Port: 8000}, false},
+		{Event{Type: "peers", Identity: "alice",
+			Protocol: "tcp", Port: 8000}, false},
+	} {
+		if got := f.match(&test.e); got != test.want {
+			t.Errorf("got %t, want %t for %+v", got, test.want,
+				test.e)
+		}
+	}
+
+	// empty filter matches all events, invalid services are errors
+	f, err = parseEventFilter(url.Values{})
+	if err != nil || !f.match(&Event{Type: EventClientConnected}) {
+		t.Errorf("got %v, want match", err)
+	}
+	for _, s := range []string{"tcp", "sctp:80", "tcp:port"} {
+		if _, err := parseEventFilter(url.Values{
+			"service": {s},
+		}); err == nil {
+			t.Errorf("got nil, want error for %s", s)
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	c := &controlServer{}
+	srv := httptest.NewServer(http.HandlerFunc(c.handleEvents))
+	defer srv.Close()
+
+	// invalid requests
+	for _, u := range []string{"/", "/events?service=invalid"} {
+		resp, err := http.Get(srv.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("got %d, want error for %s", resp.StatusCode,
+				u)
+		}
+	}
+
+	// test server-sent events and JSON lines
+	for _, accept := range []string{"text/event-stream", ""} {
+		req, err := http.NewRequest(http.MethodGet,
+			srv.URL+"/events?type=client", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.events.publish(&Event{Type: EventServiceAdded})
+		c.events.publish(&Event{Type: EventClientConnected})
+
+		r := bufio.NewReader(resp.Body)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			want := "event: " + EventClientConnected + "\n"
+			if line != want {
+				t.Errorf("got %q, want %q", line, want)
+			}
+			line, _ = r.ReadString('\n')
+			line = strings.TrimPrefix(line, "data: ")
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Error(err)
+		}
+		if e.Type != EventClientConnected {
+			t.Errorf("got %s, want %s", e.Type,
+				EventClientConnected)
+		}
+		resp.Body.Close()
+	}
+}
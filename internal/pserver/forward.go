@@ -0,0 +1,229 @@
+package pserver
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+const (
+	// forwardDialTimeout is the timeout for connecting to targets of
+	// local forwards
+	forwardDialTimeout = 10 * time.Second
+)
+
+// forwardPolicy stores the targets that clients can reach with local
+// forwards through the server
+type forwardPolicy struct {
+	ips   ipNetList
+	ports portRangeList
+}
+
+// target resolves host and returns the IP address of the target with
+// protocol, host and port, if the target is allowed
+func (f *forwardPolicy) target(protocol uint8, host string,
+	port uint16) (net.IP, error) {
+	if !f.ports.containsPort(protocol, port) {
+		return nil, errors.New("port not allowed")
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		if f.ips.containsIP(ip) {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("IP not allowed")
+}
+
+// add converts the string target to a port range, if it starts with a
+// protocol, or to an IP network and adds it to the policy
+func (f *forwardPolicy) add(target string) error {
+	if strings.HasPrefix(target, "tcp:") ||
+		strings.HasPrefix(target, "udp:") {
+		return f.ports.add(target)
+	}
+	return f.ips.add(target)
+}
+
+// String converts the forward policy to a string
+func (f *forwardPolicy) String() string {
+	var targets []string
+	for _, ipNet := range f.ips.getAll() {
+		targets = append(targets, ipNet.String())
+	}
+	for _, portRange := range f.ports.getAll() {
+		targets = append(targets, portRange.String())
+	}
+	return strings.Join(targets, ";")
+}
+
+// forwardPolicyEntry stores the forward policy of a client identity
+type forwardPolicyEntry struct {
+	identity string
+	policy   forwardPolicy
+}
+
+// forwardPolicyList is a list of forward policies of client identities,
+// i.e., the common names of client certificates
+type forwardPolicyList struct {
+	l []*forwardPolicyEntry
+}
+
+// add converts the string in entry to a forward policy and adds it to the
+// list. The format of entry is "<identity>=<target>[;<target>...]" with IPs
+// and port ranges as targets; entries of the same identity are merged
+func (f *forwardPolicyList) add(entry string) error {
+	identity, targets, ok := strings.Cut(entry, "=")
+	if !ok || identity == "" || targets == "" {
+		return fmt.Errorf("cannot parse forward policy: %s", entry)
+	}
+	policy := f.get(identity)
+	if policy == nil {
+		e := forwardPolicyEntry{identity: identity}
+		f.l = append(f.l, &e)
+		policy = &e.policy
+	}
+	for _, t := range strings.Split(targets, ";") {
+		if err := policy.add(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get returns the forward policy of identity or nil if there is none
+func (f *forwardPolicyList) get(identity string) *forwardPolicy {
+	for _, e := range f.l {
+		if e.identity == identity {
+			return &e.policy
+		}
+	}
+	return nil
+}
+
+// getAll returns a list of all forward policy entries
+func (f *forwardPolicyList) getAll() []*forwardPolicyEntry {
+	return f.l
+}
+
+// protocolName returns the name of protocol for log messages
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case network.ProtocolTCP:
+		return "tcp"
+	case network.ProtocolUDP:
+		return "udp"
+	default:
+		return "unknown"
+	}
+}
+
+// handleAddForwardMsg handles the client's add forward message with the
+// target host
+func (c *client) handleAddForwardMsg(msg *network.Message, host string) bool {
+	target := net.JoinHostPort(host, strconv.Itoa(int(msg.DestPort)))
+	log := c.log().With("protocol", protocolName(msg.Protocol), "port",
+		msg.Port, "target", target)
+	log.Info("Adding new local forward for client")
+
+	// check if target is allowed
+	msg.Op = network.MessageOK
+	if msg.Protocol != network.ProtocolTCP {
+		log.Warn("Could not add local forward", "error",
+			"protocol not supported")
+		msg.Op = network.MessageErr
+	} else if _, err := c.forwards.target(msg.Protocol, host,
+		msg.DestPort); err != nil {
+		log.Warn("Could not add local forward", "error", err)
+		msg.Op = network.MessageErr
+	}
+
+	// send result back to client
+	return c.send(msg)
+}
+
+// acceptStream handles the stream s opened by the client and connects it
+// to its target
+func (c *client) acceptStream(s *network.Stream) {
+	protocol := protocolName(s.Protocol())
+	target := net.JoinHostPort(s.Host, strconv.Itoa(int(s.Port)))
+	log := c.log().With("protocol", protocol, "stream",
+		s.RemoteAddr().String(), "target", target)
+
+	// check target and connect to it
+	ip, err := c.forwards.target(s.Protocol(), s.Host, s.Port)
+	if err != nil {
+		log.Warn("Refusing stream", "error", err)
+		s.Close()
+		return
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(s.Port)))
+	dstConn, err := net.DialTimeout(protocol, addr, forwardDialTimeout)
+	if err != nil {
+		log.Warn("Could not connect stream", "error", err)
+		s.Close()
+		return
+	}
+	if !s.Accept() {
+		dstConn.Close()
+		s.Close()
+		return
+	}
+
+	// start forwarding traffic between stream and target
+	log.Info("New stream from client", "addr",
+		dstConn.RemoteAddr().String())
+	if s.Protocol() == network.ProtocolUDP {
+		runUDPStream(s, dstConn, log)
+		return
+	}
+	runTCPForwarder(s, dstConn, nil, log, nil)
+}
+
+// runUDPStream forwards datagrams between the udp stream s and the
+// connected udp socket dstConn until the stream is closed, it logs with log
+func runUDPStream(s *network.Stream, dstConn net.Conn, log *slog.Logger) {
+	go func() {
+		buf := make([]byte, network.StreamDataLen)
+		for {
+			n, err := dstConn.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// icmp port unreachable from target, ignore
+				continue
+			}
+			if err != nil {
+				s.Close()
+				return
+			}
+			if _, err := s.Write(buf[:n]); err != nil {
+				dstConn.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, network.StreamDataLen)
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			break
+		}
+		dstConn.Write(buf[:n])
+	}
+	dstConn.Close()
+	s.Close()
+	log.Info("Closing udp stream")
+}
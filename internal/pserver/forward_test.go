@@ -0,0 +1,127 @@
+package pserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+	"github.com/hwipl/service-proxy/internal/pclient"
+)
+
+func TestForwardPolicyTarget(t *testing.T) {
+	var f forwardPolicy
+	f.ips.add("127.0.0.1")
+	f.ports.add("tcp:1024-2048")
+
+	for _, test := range []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"127.0.0.1", 1024, "127.0.0.1"},
+		{"localhost", 2048, "127.0.0.1"},
+		{"127.0.0.1", 80, "port not allowed"},
+		{"127.0.0.2", 1024, "IP not allowed"},
+	} {
+		got := ""
+		ip, err := f.target(network.ProtocolTCP, test.host, test.port)
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = ip.String()
+		}
+		if got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
+
+func TestLocalForward(t *testing.T) {
+	// start echo server as target of the local forward
+	target, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	// start control server and client with local forward
+	addr := net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 55555,
+	}
+	go RunControlServer(&Config{
+		Addr:         &addr,
+		AllowedIPs:   "127.0.0.1",
+		ForwardIPs:   "127.0.0.1",
+		ForwardPorts: fmt.Sprintf("tcp:%d", targetPort),
+	})
+	time.Sleep(1 * time.Second)
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Forwards:   fmt.Sprintf("tcp:55556:127.0.0.1:%d", targetPort),
+	})
+	time.Sleep(1 * time.Second)
+
+	// send data through local forward and read it back
+	conn, err := net.Dial("tcp", "127.0.0.1:55556")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	want := []byte("hello world")
+	if _, err := conn.Write(want); err != nil {
+		log.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestForwardPolicyList(t *testing.T) {
+	var f forwardPolicyList
+	f.add("alice=10.0.0.0/8;tcp:1-1024")
+	f.add("bob=10.0.0.1;udp:53")
+	f.add("alice=tcp:8080")
+
+	for _, test := range []struct {
+		identity string
+		want     string
+	}{
+		{"alice", "10.0.0.0/8;tcp:1-1024;tcp:8080-8080"},
+		{"bob", "10.0.0.1/32;udp:53-53"},
+	} {
+		got := f.get(test.identity).String()
+		if got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+	if got := f.get("eve"); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
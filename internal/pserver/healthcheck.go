@@ -0,0 +1,230 @@
+package pserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+const (
+	// types of health checks of destinations
+	healthCheckOff = iota
+	healthCheckTCP
+	healthCheckHTTP
+
+	// default settings of health checks
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthPath     = "/"
+	defaultHealthFails    = 3
+)
+
+// parseHealthCheck converts the string s to a health check type
+func parseHealthCheck(s string) (int, error) {
+	switch s {
+	case "off":
+		return healthCheckOff, nil
+	case "tcp":
+		return healthCheckTCP, nil
+	case "http":
+		return healthCheckHTTP, nil
+	default:
+		return 0, fmt.Errorf("unknown health check %s", s)
+	}
+}
+
+// healthCheck periodically checks the destination of a pool member and
+// reports health transitions to the owner of the member
+type healthCheck struct {
+	member    *poolMember
+	protocol  uint8
+	port      int
+	opts      *serviceOptions
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+// addr returns the address of the health check
+func (h *healthCheck) addr() string {
+	port := h.member.dstPort
+	if h.opts.healthPort != 0 {
+		port = h.opts.healthPort
+	}
+	return net.JoinHostPort(h.member.dstIP.String(), strconv.Itoa(port))
+}
+
+// check runs a single health check and returns an error if it failed
+func (h *healthCheck) check() error {
+	timeout := h.opts.healthTimeout
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: h.member.srcIP},
+		Timeout:   timeout,
+	}
+
+	// tcp health check
+	if h.opts.healthCheck == healthCheckTCP {
+		conn, err := dialer.Dial("tcp", h.addr())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// http health check, redirects are not followed and count as healthy
+	path := h.opts.healthPath
+	if path == "" {
+		path = defaultHealthPath
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: timeout,
+	}
+	resp, err := client.Get("http://" + h.addr() + path)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	return nil
+}
+
+// setHealthy sets the health of the member and reports transitions to the
+// owner of the member; err is the error of the failed health check
+func (h *healthCheck) setHealthy(healthy bool, err error) {
+	if h.member.unhealthy.Load() != healthy {
+		// no transition
+		return
+	}
+	h.member.unhealthy.Store(!healthy)
+
+	op := uint8(network.MessageHealthy)
+	log := h.member.owner.log().With("protocol",
+		protocolName(h.protocol), "port", h.port, "dest_port",
+		h.member.dstPort, "addr", h.addr())
+	if healthy {
+		log.Info("Health check of service is healthy")
+	} else {
+		log.Warn("Health check of service is unhealthy", "error", err)
+		op = network.MessageUnhealthy
+	}
+	if h.member.owner == nil {
+		return
+	}
+	if !healthy {
+		// move peers of the member to the remaining members
+		h.member.owner.closeMember(h.protocol, h.port, h.member,
+			closeReasonUnhealthy)
+	}
+	h.member.owner.send(&network.Message{
+		Op:       op,
+		Protocol: h.protocol,
+		Port:     uint16(h.port),
+		DestPort: uint16(h.member.dstPort),
+	})
+}
+
+// run runs the health checks until the health check is stopped. The member
+// becomes unhealthy after the configured number of failed checks in a row
+// and healthy again after the first successful check
+func (h *healthCheck) run() {
+	interval := h.opts.healthInterval
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	maxFails := h.opts.healthFails
+	if maxFails == 0 {
+		maxFails = defaultHealthFails
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fails := 0
+	for {
+		select {
+		case <-h.done:
+			// stopped, possibly before it was started
+			return
+		default:
+		}
+		if err := h.check(); err != nil {
+			fails++
+			if fails >= maxFails {
+				h.setHealthy(false, err)
+			}
+		} else {
+			fails = 0
+			h.setHealthy(true, nil)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// start starts the health check
+func (h *healthCheck) start() {
+	h.startOnce.Do(func() {
+		go h.run()
+	})
+}
+
+// stop stops the health check
+func (h *healthCheck) stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// newHealthCheck creates the health check of the member of the service on
+// protocol and port, if health checks are enabled in opts. The health check
+// is started with startHealthCheck when the service of the member is active,
+// so members of standby services are not checked
+func (p *poolMember) newHealthCheck(protocol uint8, port int,
+	opts *serviceOptions) {
+	if opts.healthCheck == healthCheckOff {
+		return
+	}
+	p.health = &healthCheck{
+		member:   p,
+		protocol: protocol,
+		port:     port,
+		opts:     opts,
+		done:     make(chan struct{}),
+	}
+}
+
+// startHealthCheck starts the health check of the member, if it has one
+func (p *poolMember) startHealthCheck() {
+	if p.health != nil {
+		p.health.start()
+	}
+}
+
+// stopHealthCheck stops the health checks of the member
+func (p *poolMember) stopHealthCheck() {
+	if p.health != nil {
+		p.health.stop()
+	}
+}
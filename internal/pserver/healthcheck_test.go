@@ -0,0 +1,183 @@
+package pserver
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// testHealthCheck creates a health check of the destination addr with the
+// service options opts
+func testHealthCheck(addr *net.TCPAddr, opts *serviceOptions) *healthCheck {
+	return &healthCheck{
+		member: &poolMember{
+			srcIP:   net.IPv4(127, 0, 0, 1),
+			dstIP:   addr.IP,
+			dstPort: addr.Port,
+		},
+		opts: opts,
+		done: make(chan struct{}),
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	h := testHealthCheck(addr, &serviceOptions{healthCheck: healthCheckTCP})
+
+	// destination is listening
+	if err := h.check(); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+
+	// destination is not listening
+	listener.Close()
+	if err := h.check(); err == nil {
+		t.Errorf("got nil, want error")
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(status)
+		}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	h := testHealthCheck(addr, &serviceOptions{
+		healthCheck: healthCheckHTTP,
+		healthPath:  "/healthz",
+	})
+
+	for _, test := range []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusFound, true},
+		{http.StatusInternalServerError, false},
+	} {
+		status = test.status
+		err := h.check()
+		if (err == nil) != test.ok {
+			t.Errorf("got %v for status %d", err, test.status)
+		}
+	}
+}
+
+func TestHealthCheckRun(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	// start health checks of the closed destination
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	owner := &client{conn: serverConn, tcpServices: &tcpServiceMap{}}
+	member := &poolMember{
+		owner:   owner,
+		srcIP:   addr.IP,
+		dstIP:   addr.IP,
+		dstPort: addr.Port,
+	}
+	member.newHealthCheck(network.ProtocolTCP, 8000, &serviceOptions{
+		healthCheck:    healthCheckTCP,
+		healthInterval: 10 * time.Millisecond,
+		healthFails:    2,
+	})
+	member.startHealthCheck()
+	defer member.stopHealthCheck()
+
+	// destination becomes unhealthy
+	var msg network.Message
+	msg.Parse(network.ReadFromConn(clientConn))
+	want := network.Message{
+		Op:       network.MessageUnhealthy,
+		Protocol: network.ProtocolTCP,
+		Port:     8000,
+		DestPort: uint16(addr.Port),
+	}
+	if msg != want {
+		t.Errorf("got %v, want %v", msg, want)
+	}
+	if !member.unhealthy.Load() {
+		t.Errorf("got healthy member, want unhealthy")
+	}
+
+	// destination becomes healthy again
+	listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+	msg.Parse(network.ReadFromConn(clientConn))
+	want.Op = network.MessageHealthy
+	if msg != want {
+		t.Errorf("got %v, want %v", msg, want)
+	}
+}
+
+func TestHealthCheckStandby(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	// create health check of the closed destination, but do not start
+	// it like for members of standby services
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	owner := &client{conn: serverConn, tcpServices: &tcpServiceMap{}}
+	member := &poolMember{
+		owner:   owner,
+		srcIP:   addr.IP,
+		dstIP:   addr.IP,
+		dstPort: addr.Port,
+	}
+	member.newHealthCheck(network.ProtocolTCP, 8000, &serviceOptions{
+		healthCheck:    healthCheckTCP,
+		healthInterval: 10 * time.Millisecond,
+		healthFails:    1,
+	})
+	defer member.stopHealthCheck()
+
+	// owner is not notified before the health check is started
+	clientConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 64)
+	if n, err := clientConn.Read(buf); err == nil {
+		t.Errorf("got message %v, want none", buf[:n])
+	}
+
+	// owner is notified after the health check is started
+	clientConn.SetReadDeadline(time.Time{})
+	member.startHealthCheck()
+	var msg network.Message
+	msg.Parse(network.ReadFromConn(clientConn))
+	if msg.Op != network.MessageUnhealthy {
+		t.Errorf("got %d, want %d", msg.Op, network.MessageUnhealthy)
+	}
+}
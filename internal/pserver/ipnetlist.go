@@ -1,7 +1,7 @@
 package pserver
 
 import (
-	"log"
+	"fmt"
 	"net"
 )
 
@@ -61,14 +61,14 @@ func (i *ipNetList) getAll() []*net.IPNet {
 }
 
 // add converts the string addr to an ip network and adds it to the list
-func (i *ipNetList) add(addr string) {
+func (i *ipNetList) add(addr string) error {
 	// check if it is a cidr address
 	ip, ipNet, err := net.ParseCIDR(addr)
 	if err != nil {
 		// not cidr, check if we can parse it as regular ip
 		ip = net.ParseIP(addr)
 		if ip == nil {
-			log.Fatal("cannot parse allowed IP: ", addr)
+			return fmt.Errorf("cannot parse IP: %s", addr)
 		}
 		// create ip net
 		netmask := net.CIDRMask(32, 32)
@@ -81,4 +81,5 @@ func (i *ipNetList) add(addr string) {
 		}
 	}
 	i.addIPNet(ipNet)
+	return nil
 }
@@ -0,0 +1,87 @@
+package pserver
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Logger is a logger for log messages, e.g., a *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+	Println(v ...any)
+}
+
+// printfWriter writes log records of a text handler to a Logger
+type printfWriter struct {
+	l Logger
+}
+
+// Write writes the log record in p to the logger
+func (p *printfWriter) Write(b []byte) (int, error) {
+	p.l.Printf("%s", b)
+	return len(b), nil
+}
+
+// newPrintfHandler returns a handler that writes log records as text
+// without time to the Logger l, which adds its own time
+func newPrintfHandler(l Logger) slog.Handler {
+	return slog.NewTextHandler(&printfWriter{l}, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+// sharedLogger forwards log messages of a control server, its clients and
+// their services to the current logger, it is safe for concurrent use
+type sharedLogger struct {
+	l atomic.Pointer[slog.Logger]
+}
+
+// get returns the current logger or the default logger if there is none or
+// s is nil
+func (s *sharedLogger) get() *slog.Logger {
+	if s == nil {
+		return slog.Default()
+	}
+	if l := s.l.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// set sets the current logger to a logger with handler h or, if h is nil,
+// a logger that writes to l; if both are nil, the default logger is used
+func (s *sharedLogger) set(h slog.Handler, l Logger) {
+	switch {
+	case h != nil:
+		s.l.Store(slog.New(h))
+	case l != nil:
+		s.l.Store(slog.New(newPrintfHandler(l)))
+	default:
+		s.l.Store(nil)
+	}
+}
+
+// Debug logs a debug message msg with key-value pairs args
+func (s *sharedLogger) Debug(msg string, args ...any) {
+	s.get().Debug(msg, args...)
+}
+
+// Info logs an informational message msg with key-value pairs args
+func (s *sharedLogger) Info(msg string, args ...any) {
+	s.get().Info(msg, args...)
+}
+
+// Warn logs a warning msg with key-value pairs args
+func (s *sharedLogger) Warn(msg string, args ...any) {
+	s.get().Warn(msg, args...)
+}
+
+// Error logs an error message msg with key-value pairs args
+func (s *sharedLogger) Error(msg string, args ...any) {
+	s.get().Error(msg, args...)
+}
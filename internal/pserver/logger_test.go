@@ -0,0 +1,62 @@
+package pserver
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testPrintfLogger is a Logger that stores log messages for tests
+type testPrintfLogger struct {
+	b bytes.Buffer
+}
+
+// Printf stores a log message
+func (l *testPrintfLogger) Printf(format string, v ...any) {
+	fmt.Fprintf(&l.b, format, v...)
+}
+
+// Println stores a log message
+func (l *testPrintfLogger) Println(v ...any) {
+	fmt.Fprintln(&l.b, v...)
+}
+
+func TestSharedLogger(t *testing.T) {
+	var logger sharedLogger
+	c := &client{
+		addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		identity: &Identity{Name: "test"},
+		session:  "0123abcd",
+		logger:   &logger,
+	}
+
+	// printf logger without time and with client attributes
+	var l testPrintfLogger
+	logger.set(nil, &l)
+	c.log().Info("test", "port", 8000)
+	want := "level=INFO msg=test session=0123abcd client=127.0.0.1:1234 " +
+		"identity=test port=8000\n"
+	if got := l.b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// handler replaces printf logger, debug messages are filtered
+	var b bytes.Buffer
+	logger.set(slog.NewJSONHandler(&b, nil), &l)
+	logger.Debug("test")
+	c.log().Warn("test")
+	want = `"level":"WARN","msg":"test","session":"0123abcd",` +
+		`"client":"127.0.0.1:1234","identity":"test"}`
+	if got := b.String(); !strings.Contains(got, want) ||
+		strings.Count(got, "\n") != 1 {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// nil client uses default logger
+	if (*client)(nil).log() != slog.Default() {
+		t.Errorf("got other logger, want default logger")
+	}
+}
@@ -2,7 +2,6 @@ package pserver
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 
@@ -62,6 +61,9 @@ func (p *portRange) String() string {
 // portRangeList is a list of portRanges
 type portRangeList struct {
 	l []*portRange
+	// inUse checks if a service uses port with protocol when ports are
+	// allocated, if it is set
+	inUse func(protocol string, port int) bool
 }
 
 // addRange adds protocol and ports min and max to the list
@@ -118,12 +120,12 @@ func (p *portRangeList) getAll() []*portRange {
 	return p.l
 }
 
-// add converts the string in port to a port range and adds it to the list
-func (p *portRangeList) add(port string) {
+// parsePortRange converts the string in port to a port range
+func parsePortRange(port string) (*portRange, error) {
 	// get protocol and port range
 	protPorts := strings.Split(port, ":")
 	if len(protPorts) != 2 {
-		log.Fatal("cannot parse allowed port: ", port)
+		return nil, fmt.Errorf("cannot parse port: %s", port)
 	}
 
 	// parse protocol
@@ -134,17 +136,17 @@ func (p *portRangeList) add(port string) {
 	case "udp":
 		protocol = network.ProtocolUDP
 	default:
-		log.Fatal("unknown protocol in allowed port: ", port)
+		return nil, fmt.Errorf("unknown protocol in port: %s", port)
 	}
 
 	// get min and max port from port range
 	minmax := strings.Split(protPorts[1], "-")
 	if len(minmax) < 1 || len(minmax) > 2 {
-		log.Fatal("cannot parse allowed port: ", port)
+		return nil, fmt.Errorf("cannot parse port: %s", port)
 	}
 	min, err := strconv.ParseUint(minmax[0], 10, 16)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cannot parse port %s: %w", port, err)
 	}
 	getMax := func() string {
 		if len(minmax) == 2 {
@@ -154,12 +156,26 @@ func (p *portRangeList) add(port string) {
 	}
 	max, err := strconv.ParseUint(getMax(), 10, 16)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cannot parse port %s: %w", port, err)
 	}
 	if min > max {
 		min, max = max, min
 	}
 
+	return &portRange{
+		protocol: protocol,
+		min:      uint16(min),
+		max:      uint16(max),
+	}, nil
+}
+
+// add converts the string in port to a port range and adds it to the list
+func (p *portRangeList) add(port string) error {
 	// add port range to allowed port ranges
-	p.addRange(protocol, uint16(min), uint16(max))
+	r, err := parsePortRange(port)
+	if err != nil {
+		return err
+	}
+	p.addRange(r.protocol, r.min, r.max)
+	return nil
 }
@@ -0,0 +1,132 @@
+package pserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrServerStarted is returned if a server is started more than once
+	ErrServerStarted = errors.New("server already started")
+	// ErrServerClosed is returned if a server is started after it has
+	// been shut down
+	ErrServerClosed = errors.New("server closed")
+)
+
+// UDPServiceStats are the runtime statistics of an udp service
+type UDPServiceStats struct {
+	// Port is the port of the service
+	Port int
+	// Sessions is the number of active sessions of peers
+	Sessions int
+	// Drops is the number of packets dropped by the service, e.g.,
+	// because a queue was full or no session could be created
+	Drops uint64
+}
+
+// Server is a control server that runs in the background, e.g., as part of
+// another program
+type Server struct {
+	c *controlServer
+
+	// mutex protects started and closed
+	mutex   sync.Mutex
+	started bool
+	closed  bool
+}
+
+// Start creates the listeners of the server and runs it in the background
+// until it is shut down or ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.started {
+		return ErrServerStarted
+	}
+	s.c.logConfig()
+	if err := s.c.listen(); err != nil {
+		return err
+	}
+	s.started = true
+	s.c.startEventHooks()
+	go func() {
+		if err := s.c.serve(); err != nil {
+			s.c.logger.Error("Stopping server", "error", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		s.Shutdown(context.Background())
+	})
+	return nil
+}
+
+// Shutdown shuts down the server and stops the services of its clients. It
+// waits until all clients are stopped or ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	return s.c.shutdown(ctx)
+}
+
+// Addr returns the address of the server's listener for control connections
+// or nil if the server is not started
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.started {
+		return nil
+	}
+	return s.c.listener.Addr()
+}
+
+// WebSocketAddr returns the address of the server's listener for websocket
+// control connections or nil if there is none
+func (s *Server) WebSocketAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.started || s.c.wsListener == nil {
+		return nil
+	}
+	return s.c.wsListener.Addr()
+}
+
+// EventsAddr returns the address of the server's listener for event streams
+// or nil if there is none
+func (s *Server) EventsAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.started || s.c.eventsListener == nil {
+		return nil
+	}
+	return s.c.eventsListener.Addr()
+}
+
+// UDPServices returns the statistics of the active udp services of the
+// server ordered by port
+func (s *Server) UDPServices() []UDPServiceStats {
+	return s.c.udpServices.stats()
+}
+
+// NewServer creates a new server with configuration config; stdio mode is
+// not supported
+func NewServer(config *Config) (*Server, error) {
+	if config.Stdio {
+		return nil, errors.New("stdio mode is not supported")
+	}
+	c, err := newControlServer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{c: c}, nil
+}
@@ -0,0 +1,265 @@
+package pserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// serviceOptions stores the options of a service
+type serviceOptions struct {
+	// idleTimeout is the time without traffic after which a connection
+	// is closed; 0 disables the idle timeout
+	idleTimeout time.Duration
+	// maxLifetime is the maximum time a connection is kept open; 0
+	// disables the maximum lifetime
+	maxLifetime time.Duration
+	// keepAlive is the tcp keep-alive configuration of connections, it
+	// is only applied if keepAliveSet is true
+	keepAlive    net.KeepAliveConfig
+	keepAliveSet bool
+	// maxSessions is the maximum number of udp sessions of a service; 0
+	// means unlimited
+	maxSessions int
+	// queueLen is the length of the packet queue of udp sessions; 0
+	// means default length
+	queueLen int
+	// dropOldest specifies if the oldest packet in a full queue is
+	// dropped instead of the newest
+	dropOldest bool
+	// udpNAT specifies if udp sessions use the nat mode instead of the
+	// socket mode
+	udpNAT bool
+	// natSockets is the maximum number of outbound sockets per
+	// destination of udp services in nat mode; 0 means default
+	natSockets int
+	// poolStrategy is the strategy for distributing connections and
+	// sessions in service pools
+	poolStrategy int
+	// healthCheck is the type of health checks of destinations
+	healthCheck int
+	// healthInterval is the time between health checks and healthTimeout
+	// is the timeout of a health check; 0 means default
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	// healthPath is the path of http health checks
+	healthPath string
+	// healthPort is the port of health checks; 0 means destination port
+	healthPort int
+	// healthFails is the number of failed health checks after which a
+	// destination is unhealthy; 0 means default
+	healthFails int
+}
+
+// set sets the service option key to value
+func (s *serviceOptions) set(key, value string) error {
+	parseDuration := func() (time.Duration, error) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("negative duration %s", value)
+		}
+		return d, nil
+	}
+
+	var err error
+	switch key {
+	case "idle":
+		s.idleTimeout, err = parseDuration()
+	case "lifetime":
+		s.maxLifetime, err = parseDuration()
+	case "keepalive":
+		switch value {
+		case "on":
+			s.keepAlive.Enable = true
+		case "off":
+			s.keepAlive.Enable = false
+		default:
+			err = fmt.Errorf("invalid value %s", value)
+		}
+		s.keepAliveSet = true
+	case "keepalive-idle":
+		s.keepAlive.Idle, err = parseDuration()
+		s.keepAlive.Enable = true
+		s.keepAliveSet = true
+	case "keepalive-interval":
+		s.keepAlive.Interval, err = parseDuration()
+		s.keepAlive.Enable = true
+		s.keepAliveSet = true
+	case "keepalive-count":
+		s.keepAlive.Count, err = strconv.Atoi(value)
+		s.keepAlive.Enable = true
+		s.keepAliveSet = true
+	case "max-sessions":
+		s.maxSessions, err = strconv.Atoi(value)
+		if err == nil && s.maxSessions < 0 {
+			err = fmt.Errorf("negative number %s", value)
+		}
+	case "queue":
+		s.queueLen, err = strconv.Atoi(value)
+		if err == nil && s.queueLen < 1 {
+			err = fmt.Errorf("invalid queue length %s", value)
+		}
+	case "drop":
+		switch value {
+		case "oldest":
+			s.dropOldest = true
+		case "newest":
+			s.dropOldest = false
+		default:
+			err = fmt.Errorf("invalid value %s", value)
+		}
+	case "mode":
+		switch value {
+		case "socket":
+			s.udpNAT = false
+		case "nat":
+			s.udpNAT = true
+		default:
+			err = fmt.Errorf("invalid value %s", value)
+		}
+	case "nat-sockets":
+		s.natSockets, err = strconv.Atoi(value)
+		if err == nil && s.natSockets < 1 {
+			err = fmt.Errorf("invalid number of sockets %s", value)
+		}
+	case "strategy":
+		s.poolStrategy, err = parsePoolStrategy(value)
+	case "health":
+		s.healthCheck, err = parseHealthCheck(value)
+	case "health-interval":
+		s.healthInterval, err = parseDuration()
+	case "health-timeout":
+		s.healthTimeout, err = parseDuration()
+	case "health-path":
+		if !strings.HasPrefix(value, "/") {
+			err = fmt.Errorf("invalid path %s", value)
+		}
+		s.healthPath = value
+	case "health-port":
+		s.healthPort, err = strconv.Atoi(value)
+		if err == nil && (s.healthPort < 1 || s.healthPort > 65535) {
+			err = fmt.Errorf("invalid port %s", value)
+		}
+	case "health-fails":
+		s.healthFails, err = strconv.Atoi(value)
+		if err == nil && s.healthFails < 1 {
+			err = fmt.Errorf("invalid number %s", value)
+		}
+	default:
+		return fmt.Errorf("unknown service option %s", key)
+	}
+	return err
+}
+
+// applyKeepAlive applies the keep-alive configuration to conn, errors are
+// logged with log
+func (s *serviceOptions) applyKeepAlive(conn *net.TCPConn,
+	log *slog.Logger) {
+	if !s.keepAliveSet {
+		return
+	}
+	if err := conn.SetKeepAliveConfig(s.keepAlive); err != nil {
+		log.Warn("Could not set keep-alive on connection",
+			"addr", conn.LocalAddr().String(), "peer",
+			conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// serviceOptionsEntry stores service options for a port range
+type serviceOptionsEntry struct {
+	ports   *portRange
+	options [][2]string
+}
+
+// serviceOptionsList is a list of service options for port ranges
+type serviceOptionsList struct {
+	l []*serviceOptionsEntry
+}
+
+// add converts the string in entry to service options and adds them to the
+// list. The format of entry is
+// "<protocol>[:<ports>]:<key>=<value>[:<key>=<value>...]", entries without
+// ports apply to all ports of the protocol
+func (s *serviceOptionsList) add(entry string) error {
+	parts := strings.Split(entry, ":")
+	if len(parts) < 2 {
+		return fmt.Errorf("cannot parse service options: %s", entry)
+	}
+
+	// get port range, if there is none use all ports of the protocol
+	ports := parts[0] + ":0-65535"
+	options := parts[1:]
+	if !strings.Contains(parts[1], "=") {
+		ports = parts[0] + ":" + parts[1]
+		options = parts[2:]
+	}
+	r, err := parsePortRange(ports)
+	if err != nil {
+		return err
+	}
+	e := serviceOptionsEntry{
+		ports: r,
+	}
+
+	// parse options and check them
+	var check serviceOptions
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("cannot parse service option: %s", o)
+		}
+		if err := check.set(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("cannot parse service option %s: %w",
+				o, err)
+		}
+		if r.protocol == network.ProtocolUDP &&
+			strings.HasPrefix(kv[0], "health") {
+			// a tcp or http check says nothing about an udp
+			// destination
+			return fmt.Errorf("cannot use service option %s: "+
+				"no health checks for udp services", o)
+		}
+		e.options = append(e.options, [2]string{kv[0], kv[1]})
+	}
+	s.l = append(s.l, &e)
+	return nil
+}
+
+// get returns the service options for protocol and port. Options of all
+// matching entries are applied in the order they were added to the list
+func (s *serviceOptionsList) get(protocol uint8, port uint16) *serviceOptions {
+	var opts serviceOptions
+	for _, e := range s.l {
+		if !e.ports.containsPort(protocol, port) {
+			continue
+		}
+		for _, kv := range e.options {
+			// options have been checked when they were added
+			opts.set(kv[0], kv[1])
+		}
+	}
+	return &opts
+}
+
+// String converts the service options entry to a string
+func (e *serviceOptionsEntry) String() string {
+	var b strings.Builder
+	b.WriteString(e.ports.String())
+	for _, kv := range e.options {
+		b.WriteString(":" + kv[0] + "=" + kv[1])
+	}
+	return b.String()
+}
+
+// getAll returns a list of all service options entries
+func (s *serviceOptionsList) getAll() []*serviceOptionsEntry {
+	return s.l
+}
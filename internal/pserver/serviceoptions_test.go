@@ -0,0 +1,145 @@
+package pserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+func TestServiceOptionsSet(t *testing.T) {
+	var opts serviceOptions
+
+	// test valid options
+	for _, kv := range [][2]string{
+		{"idle", "30s"},
+		{"lifetime", "1h"},
+		{"keepalive-idle", "15s"},
+		{"keepalive-interval", "5s"},
+		{"keepalive-count", "3"},
+		{"nat-sockets", "16"},
+		{"strategy", "least-conn"},
+		{"health", "http"},
+		{"health-interval", "5s"},
+		{"health-timeout", "1s"},
+		{"health-path", "/healthz"},
+		{"health-port", "8081"},
+		{"health-fails", "2"},
+	} {
+		if err := opts.set(kv[0], kv[1]); err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	}
+	want := serviceOptions{
+		idleTimeout: 30 * time.Second,
+		maxLifetime: time.Hour,
+		keepAlive: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     15 * time.Second,
+			Interval: 5 * time.Second,
+			Count:    3,
+		},
+		keepAliveSet:   true,
+		natSockets:     16,
+		poolStrategy:   poolLeastConn,
+		healthCheck:    healthCheckHTTP,
+		healthInterval: 5 * time.Second,
+		healthTimeout:  time.Second,
+		healthPath:     "/healthz",
+		healthPort:     8081,
+		healthFails:    2,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+
+	// test invalid options
+	for _, kv := range [][2]string{
+		{"idle", "-1s"},
+		{"lifetime", "forever"},
+		{"keepalive", "maybe"},
+		{"nat-sockets", "0"},
+		{"strategy", "random"},
+		{"health", "icmp"},
+		{"health-path", "healthz"},
+		{"health-port", "65536"},
+		{"health-fails", "0"},
+		{"unknown", "1"},
+	} {
+		if err := opts.set(kv[0], kv[1]); err == nil {
+			t.Errorf("got nil, want error for %s=%s", kv[0], kv[1])
+		}
+	}
+}
+
+func TestServiceOptionsListAdd(t *testing.T) {
+	// health checks are only supported for tcp services
+	var list serviceOptionsList
+	for _, test := range []struct {
+		entry string
+		ok    bool
+	}{
+		{"tcp:health=tcp", true},
+		{"udp:8000:health-port=8000", false},
+		{"udp:idle=5m:health=http", false},
+	} {
+		err := list.add(test.entry)
+		if (err == nil) != test.ok {
+			t.Errorf("got %v for %s", err, test.entry)
+		}
+	}
+}
+
+func TestServiceOptionsListGet(t *testing.T) {
+	var list serviceOptionsList
+	list.add("tcp:idle=5m:lifetime=1h")
+	list.add("tcp:8000-8080:idle=30s:keepalive=off")
+
+	// test global options
+	want := &serviceOptions{
+		idleTimeout: 5 * time.Minute,
+		maxLifetime: time.Hour,
+	}
+	got := list.get(network.ProtocolTCP, 9000)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// test service options overriding global options
+	want = &serviceOptions{
+		idleTimeout:  30 * time.Second,
+		maxLifetime:  time.Hour,
+		keepAliveSet: true,
+	}
+	got = list.get(network.ProtocolTCP, 8080)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// test other protocol
+	want = &serviceOptions{}
+	got = list.get(network.ProtocolUDP, 8080)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestServiceOptionsListGetAll(t *testing.T) {
+	var list serviceOptionsList
+	list.add("tcp:idle=5m")
+	list.add("tcp:8000:lifetime=1h:keepalive=on")
+
+	want := []string{
+		"tcp:0-65535:idle=5m",
+		"tcp:8000-8000:lifetime=1h:keepalive=on",
+	}
+	got := []string{}
+	for _, e := range list.getAll() {
+		got = append(got, e.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
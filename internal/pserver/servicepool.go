@@ -0,0 +1,243 @@
+package pserver
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+const (
+	// pool strategies for distributing connections and sessions
+	poolRoundRobin = iota
+	poolLeastConn
+	poolSourceHash
+)
+
+// parsePoolStrategy converts the string s to a pool strategy
+func parsePoolStrategy(s string) (int, error) {
+	switch s {
+	case "round-robin":
+		return poolRoundRobin, nil
+	case "least-conn":
+		return poolLeastConn, nil
+	case "source-hash":
+		return poolSourceHash, nil
+	default:
+		return 0, fmt.Errorf("unknown pool strategy %s", s)
+	}
+}
+
+// poolMember is a destination of a service that belongs to a client
+type poolMember struct {
+	owner   *client
+	srcIP   net.IP
+	dstIP   net.IP
+	dstPort int
+	// stream specifies if peer connections are carried in streams over
+	// the control connection of the owner
+	stream bool
+	// conns is the number of active connections or sessions
+	conns atomic.Int64
+	// unhealthy is set if health checks of the destination fail
+	unhealthy atomic.Bool
+	health    *healthCheck
+}
+
+// tcpAddrs returns the tcp source and destination address of the member
+func (p *poolMember) tcpAddrs() (*net.TCPAddr, *net.TCPAddr) {
+	return &net.TCPAddr{IP: p.srcIP},
+		&net.TCPAddr{IP: p.dstIP, Port: p.dstPort}
+}
+
+// dialTCP opens a connection from peer to the destination of the member
+// until ctx is done; for members with streams, it opens a stream over the
+// control connection of the owner with the address of peer as host and
+// dstPort as port
+func (p *poolMember) dialTCP(ctx context.Context, peer net.Addr) (net.Conn,
+	error) {
+	if p.stream {
+		s, err := p.owner.streams.OpenContext(ctx, network.ProtocolTCP,
+			peer.String(), uint16(p.dstPort))
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	srcAddr, dstAddr := p.tcpAddrs()
+	dialer := net.Dialer{LocalAddr: srcAddr}
+	return dialer.DialContext(ctx, "tcp", dstAddr.String())
+}
+
+// udpAddrs returns the udp source and destination address of the member
+func (p *poolMember) udpAddrs() (*net.UDPAddr, *net.UDPAddr) {
+	return &net.UDPAddr{IP: p.srcIP},
+		&net.UDPAddr{IP: p.dstIP, Port: p.dstPort}
+}
+
+// servicePool is a pool of destinations of a service. Services that are not
+// in a named pool use a pool with an empty name and a single member
+type servicePool struct {
+	mutex    sync.Mutex
+	name     string
+	strategy int
+	members  []*poolMember
+	next     int
+}
+
+// add adds member to the pool
+func (s *servicePool) add(member *poolMember) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.members = append(s.members, member)
+}
+
+// remove removes the member of owner from the pool and returns the removed
+// member and the number of remaining members
+func (s *servicePool) remove(owner *client) (*poolMember, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed *poolMember
+	k := 0
+	for _, m := range s.members {
+		if m.owner == owner {
+			removed = m
+			continue
+		}
+		s.members[k] = m
+		k++
+	}
+	s.members = s.members[:k]
+	return removed, k
+}
+
+// count returns the number of members in the pool
+func (s *servicePool) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.members)
+}
+
+// notify sends a message with op for the service on protocol and port to the
+// owners of all members in the pool
+func (s *servicePool) notify(op, protocol uint8, port int) {
+	s.mutex.Lock()
+	members := append([]*poolMember(nil), s.members...)
+	s.mutex.Unlock()
+
+	for _, m := range members {
+		if m.owner == nil {
+			continue
+		}
+		m.owner.send(&network.Message{
+			Op:       op,
+			Protocol: protocol,
+			Port:     uint16(port),
+			DestPort: uint16(m.dstPort),
+		})
+		switch op {
+		case network.MessageActive:
+			m.owner.publishService(EventServiceActive,
+				protocolName(protocol), port, m.dstPort, s.name,
+				false)
+		case network.MessageDel:
+			m.owner.publishService(EventServiceRemoved,
+				protocolName(protocol), port, m.dstPort, s.name,
+				false)
+		}
+	}
+}
+
+// startHealthChecks starts the health checks of all members in the pool
+func (s *servicePool) startHealthChecks() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, m := range s.members {
+		m.startHealthCheck()
+	}
+}
+
+// stopHealthChecks stops the health checks of all members in the pool
+func (s *servicePool) stopHealthChecks() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, m := range s.members {
+		m.stopHealthCheck()
+	}
+}
+
+// healthyMembers returns the healthy members of the pool, the caller must
+// hold the mutex
+func (s *servicePool) healthyMembers() []*poolMember {
+	for i, m := range s.members {
+		if !m.unhealthy.Load() {
+			continue
+		}
+
+		// there are unhealthy members, copy the healthy ones
+		members := append([]*poolMember(nil), s.members[:i]...)
+		for _, m := range s.members[i+1:] {
+			if !m.unhealthy.Load() {
+				members = append(members, m)
+			}
+		}
+		return members
+	}
+	return s.members
+}
+
+// pick selects a healthy member of the pool for a new connection or session
+// from peer using the pool strategy; it returns nil if there is no healthy
+// member
+func (s *servicePool) pick(peer net.IP) *poolMember {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	members := s.healthyMembers()
+	if len(members) == 0 {
+		return nil
+	}
+
+	switch s.strategy {
+	case poolLeastConn:
+		// start searching at the next member, so members with the
+		// same number of connections are used in turn
+		var least *poolMember
+		for i := range members {
+			m := members[(s.next+i)%len(members)]
+			if least == nil || m.conns.Load() < least.conns.Load() {
+				least = m
+			}
+		}
+		s.next++
+		return least
+	case poolSourceHash:
+		h := fnv.New32a()
+		h.Write(peer.To16())
+		return members[h.Sum32()%uint32(len(members))]
+	default:
+		m := members[s.next%len(members)]
+		s.next++
+		return m
+	}
+}
+
+// newServicePool creates a new service pool with name, the pool strategy in
+// opts and the first member
+func newServicePool(name string, opts *serviceOptions,
+	member *poolMember) *servicePool {
+	return &servicePool{
+		name:     name,
+		strategy: opts.poolStrategy,
+		members:  []*poolMember{member},
+	}
+}
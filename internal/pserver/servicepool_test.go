@@ -0,0 +1,144 @@
+package pserver
+
+import (
+	"net"
+	"testing"
+)
+
+// testPoolMember creates a pool member with the source IP srcIP and the
+// destination address dstAddr
+func testPoolMember(srcIP net.IP, dstAddr *net.UDPAddr) *poolMember {
+	return &poolMember{
+		srcIP:   srcIP,
+		dstIP:   dstAddr.IP,
+		dstPort: dstAddr.Port,
+	}
+}
+
+// testServicePool creates a service pool with the service options opts and a
+// single member with the source IP srcIP and the destination address dstAddr
+func testServicePool(srcIP net.IP, dstAddr *net.UDPAddr,
+	opts *serviceOptions) *servicePool {
+	return newServicePool("", opts, testPoolMember(srcIP, dstAddr))
+}
+
+// testPoolMembers creates a service pool with the pool strategy and n members
+// that belong to different clients
+func testPoolMembers(strategy, n int) (*servicePool, []*poolMember) {
+	var members []*poolMember
+	for i := 0; i < n; i++ {
+		members = append(members, &poolMember{
+			owner:   &client{},
+			dstPort: 8000 + i,
+		})
+	}
+	pool := newServicePool("test", &serviceOptions{poolStrategy: strategy},
+		members[0])
+	for _, m := range members[1:] {
+		pool.add(m)
+	}
+	return pool, members
+}
+
+func TestServicePoolPickRoundRobin(t *testing.T) {
+	pool, members := testPoolMembers(poolRoundRobin, 3)
+	for i := 0; i < 6; i++ {
+		want := members[i%3]
+		got := pool.pick(net.IPv4(192, 0, 2, 1))
+		if got != want {
+			t.Errorf("got %d, want %d", got.dstPort, want.dstPort)
+		}
+	}
+}
+
+func TestServicePoolPickLeastConn(t *testing.T) {
+	pool, members := testPoolMembers(poolLeastConn, 3)
+	members[0].conns.Store(2)
+	members[1].conns.Store(1)
+	members[2].conns.Store(3)
+
+	// member with least connections
+	want := members[1]
+	got := pool.pick(net.IPv4(192, 0, 2, 1))
+	if got != want {
+		t.Errorf("got %d, want %d", got.dstPort, want.dstPort)
+	}
+
+	// members with the same number of connections are used in turn
+	members[0].conns.Store(1)
+	seen := make(map[*poolMember]bool)
+	for i := 0; i < 4; i++ {
+		seen[pool.pick(net.IPv4(192, 0, 2, 1))] = true
+	}
+	if len(seen) != 2 || seen[members[2]] {
+		t.Errorf("got %d members, want 2", len(seen))
+	}
+}
+
+func TestServicePoolPickSourceHash(t *testing.T) {
+	pool, _ := testPoolMembers(poolSourceHash, 3)
+
+	// same peer IP, same member
+	want := pool.pick(net.IPv4(192, 0, 2, 1))
+	for i := 0; i < 5; i++ {
+		got := pool.pick(net.IPv4(192, 0, 2, 1))
+		if got != want {
+			t.Errorf("got %d, want %d", got.dstPort, want.dstPort)
+		}
+	}
+
+	// different peer IPs, different members
+	seen := make(map[*poolMember]bool)
+	for i := 0; i < 64; i++ {
+		seen[pool.pick(net.IPv4(192, 0, 2, byte(i)))] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("got %d members, want 3", len(seen))
+	}
+}
+
+func TestServicePoolPickHealthy(t *testing.T) {
+	pool, members := testPoolMembers(poolRoundRobin, 3)
+	members[1].unhealthy.Store(true)
+
+	// unhealthy members are skipped
+	for i := 0; i < 4; i++ {
+		if m := pool.pick(nil); m == members[1] {
+			t.Errorf("got unhealthy member %d", m.dstPort)
+		}
+	}
+
+	// no healthy members
+	members[0].unhealthy.Store(true)
+	members[2].unhealthy.Store(true)
+	if m := pool.pick(nil); m != nil {
+		t.Errorf("got %v, want nil", m)
+	}
+}
+
+func TestServicePoolRemove(t *testing.T) {
+	pool, members := testPoolMembers(poolRoundRobin, 3)
+
+	// remove member in the middle
+	removed, remaining := pool.remove(members[1].owner)
+	if removed != members[1] {
+		t.Errorf("got %v, want %v", removed, members[1])
+	}
+	if remaining != 2 {
+		t.Errorf("got %d, want %d", remaining, 2)
+	}
+	for i := 0; i < 4; i++ {
+		if m := pool.pick(nil); m == members[1] {
+			t.Errorf("got removed member %d", m.dstPort)
+		}
+	}
+
+	// remove remaining members
+	pool.remove(members[0].owner)
+	if _, remaining := pool.remove(members[2].owner); remaining != 0 {
+		t.Errorf("got %d, want %d", remaining, 0)
+	}
+	if m := pool.pick(nil); m != nil {
+		t.Errorf("got %v, want nil", m)
+	}
+}
@@ -0,0 +1,75 @@
+package pserver
+
+// standbyService is a service registration that waits until the active
+// service on its port stops
+type standbyService struct {
+	pool   string
+	member *poolMember
+	opts   *serviceOptions
+}
+
+// standbyQueue stores the standby services of ports in registration order
+type standbyQueue map[int][]*standbyService
+
+// push appends the standby service s to the queue of port and returns its
+// position in the queue
+func (q standbyQueue) push(port int, s *standbyService) int {
+	q[port] = append(q[port], s)
+	return len(q[port])
+}
+
+// remove removes the standby service of owner from the queue of port and
+// returns it; it returns nil if owner has no standby service on port
+func (q standbyQueue) remove(port int, owner *client) *standbyService {
+	for i, s := range q[port] {
+		if s.member.owner != owner {
+			continue
+		}
+		q[port] = append(q[port][:i], q[port][i+1:]...)
+		if len(q[port]) == 0 {
+			delete(q, port)
+		}
+		return s
+	}
+	return nil
+}
+
+// pop removes the next standby service from the queue of port and returns
+// it together with all other standby services in the same pool; it returns
+// nil if the queue is empty
+func (q standbyQueue) pop(port int) []*standbyService {
+	if len(q[port]) == 0 {
+		return nil
+	}
+	next := []*standbyService{q[port][0]}
+	var rest []*standbyService
+	for _, s := range q[port][1:] {
+		if next[0].pool != "" && s.pool == next[0].pool {
+			next = append(next, s)
+			continue
+		}
+		rest = append(rest, s)
+	}
+	if len(rest) == 0 {
+		delete(q, port)
+	} else {
+		q[port] = rest
+	}
+	return next
+}
+
+// count returns the number of standby services of port
+func (q standbyQueue) count(port int) int {
+	return len(q[port])
+}
+
+// newStandbyPool creates a service pool for the standby services that
+// become active
+func newStandbyPool(standby []*standbyService) *servicePool {
+	pool := newServicePool(standby[0].pool, standby[0].opts,
+		standby[0].member)
+	for _, s := range standby[1:] {
+		pool.add(s.member)
+	}
+	return pool
+}
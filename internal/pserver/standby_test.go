@@ -0,0 +1,132 @@
+package pserver
+
+import (
+	"log"
+	"net"
+	"testing"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// testStandbyService creates a standby service in pool for a new client
+func testStandbyService(pool string, dstPort int) *standbyService {
+	return &standbyService{
+		pool: pool,
+		member: &poolMember{
+			owner:   &client{},
+			dstPort: dstPort,
+		},
+		opts: &serviceOptions{},
+	}
+}
+
+func TestStandbyQueuePop(t *testing.T) {
+	q := make(standbyQueue)
+	s1 := testStandbyService("", 1)
+	s2 := testStandbyService("web", 2)
+	s3 := testStandbyService("other", 3)
+	s4 := testStandbyService("web", 4)
+	for i, s := range []*standbyService{s1, s2, s3, s4} {
+		if got := q.push(8000, s); got != i+1 {
+			t.Errorf("got %d, want %d", got, i+1)
+		}
+	}
+
+	// standby services are popped in order, services in the same pool
+	// are popped together
+	for _, want := range [][]*standbyService{
+		{s1},
+		{s2, s4},
+		{s3},
+		nil,
+	} {
+		got := q.pop(8000)
+		if len(got) != len(want) {
+			t.Errorf("got %d, want %d", len(got), len(want))
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("got %d, want %d",
+					got[i].member.dstPort,
+					want[i].member.dstPort)
+			}
+		}
+	}
+	if q.count(8000) != 0 {
+		t.Errorf("got %d, want 0", q.count(8000))
+	}
+}
+
+func TestStandbyQueueRemove(t *testing.T) {
+	q := make(standbyQueue)
+	s1 := testStandbyService("", 1)
+	s2 := testStandbyService("", 2)
+	q.push(8000, s1)
+	q.push(8000, s2)
+
+	if got := q.remove(8000, s1.member.owner); got != s1 {
+		t.Errorf("got %v, want %v", got, s1)
+	}
+	if got := q.remove(8000, s1.member.owner); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+	if got := q.pop(8000); len(got) != 1 || got[0] != s2 {
+		t.Errorf("got %v, want %v", got, s2)
+	}
+}
+
+func TestTCPServiceStandby(t *testing.T) {
+	// get a free port for the service
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	srvAddr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	port := srvAddr.Port
+
+	// create active service and standby service
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	var services tcpServiceMap
+	active := &client{tcpServices: &services}
+	standby := &client{conn: serverConn, tcpServices: &services}
+	opts := &serviceOptions{}
+	srv, queued := runTCPService(&services, srvAddr, "",
+		&poolMember{owner: active, dstPort: 1}, opts)
+	if srv == nil || queued {
+		log.Fatal("could not create tcp service")
+	}
+	srv, queued = runTCPService(&services, srvAddr, "",
+		&poolMember{owner: standby, dstPort: 2}, opts)
+	if srv != nil || !queued {
+		t.Errorf("got %v, want standby", srv)
+	}
+
+	// stop active service and check that standby service is active
+	go active.stopTCPService(port)
+	var msg network.Message
+	msg.Parse(network.ReadFromConn(clientConn))
+	want := network.Message{
+		Op:       network.MessageActive,
+		Protocol: network.ProtocolTCP,
+		Port:     uint16(port),
+		DestPort: 2,
+	}
+	if msg != want {
+		t.Errorf("got %v, want %v", msg, want)
+	}
+	srv = services.get(port)
+	if srv == nil || srv.pool.pick(nil).owner != standby {
+		t.Errorf("got %v, want promoted standby service", srv)
+	}
+
+	// stop promoted service
+	standby.stopTCPService(port)
+	if srv = services.get(port); srv != nil {
+		t.Errorf("got %v, want nil", srv)
+	}
+}
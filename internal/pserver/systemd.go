@@ -0,0 +1,174 @@
+package pserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd
+	// socket activation
+	listenFDsStart = 3
+	// webSocketFDName is the name of the socket for websocket control
+	// connections in socket activation, other sockets are used for
+	// regular control connections
+	webSocketFDName = "websocket"
+	// notifyStatusInterval is the interval of status notifications if
+	// the watchdog is disabled
+	notifyStatusInterval = 10 * time.Second
+)
+
+// systemdFiles returns the files and names of the sockets passed by systemd
+// socket activation in the LISTEN_* environment variables
+func systemdFiles() ([]*os.File, []string) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		if i >= len(names) {
+			names = append(names, "")
+		}
+		fd := uintptr(listenFDsStart + i)
+		files = append(files, os.NewFile(fd, names[i]))
+	}
+	return files, names[:n]
+}
+
+// systemdListeners returns the tcp listeners for control connections and
+// websocket control connections passed by systemd socket activation; they
+// are nil if there are no such sockets. Ignored sockets are logged with log
+func systemdListeners(log *slog.Logger) (*net.TCPListener, *net.TCPListener,
+	error) {
+	var control, ws *net.TCPListener
+	files, names := systemdFiles()
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		listener, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, nil, fmt.Errorf("socket %d is not a tcp "+
+				"socket", listenFDsStart+i)
+		}
+		switch {
+		case names[i] == webSocketFDName && ws == nil:
+			ws = listener
+		case names[i] != webSocketFDName && control == nil:
+			control = listener
+		default:
+			log.Warn("Ignoring extra socket from systemd",
+				"addr", listener.Addr().String())
+			listener.Close()
+		}
+	}
+	return control, ws, nil
+}
+
+// sdNotify sends state to the service manager via the datagram socket in
+// the NOTIFY_SOCKET environment variable, if it is set
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract socket address
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: socket,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval of watchdog notifications, i.e.,
+// half of the watchdog timeout in WATCHDOG_USEC, or 0 if the watchdog is
+// disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// status returns the status of the control server for notifications
+func (c *controlServer) status() string {
+	sessions, drops := c.udpServices.sessionStats()
+	return fmt.Sprintf("STATUS=Serving %d clients with %d tcp and %d "+
+		"udp services, %d udp sessions and %d dropped udp packets",
+		c.clients.Load(), c.tcpServices.count(),
+		c.udpServices.count(), sessions, drops)
+}
+
+// runNotify notifies the service manager that the control server is ready
+// and periodically sends its status and watchdog keep-alives until done is
+// closed, then it notifies the service manager that the server is stopping
+func (c *controlServer) runNotify(done <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	if err := sdNotify("READY=1\n" + c.status()); err != nil {
+		c.logger.Warn("Could not notify service manager", "error",
+			err)
+		return
+	}
+
+	interval := watchdogInterval()
+	watchdog := interval > 0
+	if !watchdog {
+		interval = notifyStatusInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			if err := sdNotify("STOPPING=1"); err != nil {
+				c.logger.Warn("Could not notify service "+
+					"manager", "error", err)
+			}
+			return
+		}
+		state := c.status()
+		if watchdog {
+			state += "\nWATCHDOG=1"
+		}
+		if err := sdNotify(state); err != nil {
+			c.logger.Warn("Could not notify service manager",
+				"error", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pserver
+
+import (
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNotifySocket creates a fake notify socket and sets NOTIFY_SOCKET
+func testNotifySocket(t *testing.T) *net.UnixConn {
+	addr := &net.UnixAddr{
+		Name: filepath.Join(t.TempDir(), "notify"),
+		Net:  "unixgram",
+	}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Setenv("NOTIFY_SOCKET", addr.Name)
+	return conn
+}
+
+// testReadNotify reads a notification from the fake notify socket conn
+func testReadNotify(conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSDNotify(t *testing.T) {
+	conn := testNotifySocket(t)
+	defer conn.Close()
+
+	want := "READY=1"
+	if err := sdNotify(want); err != nil {
+		t.Fatal(err)
+	}
+	if got := testReadNotify(conn); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRunNotify(t *testing.T) {
+	conn := testNotifySocket(t)
+	defer conn.Close()
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	var c controlServer
+	c.clients.Add(2)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.runNotify(done)
+		close(stopped)
+	}()
+
+	// check readiness, status and watchdog notifications
+	want := "READY=1\nSTATUS=Serving 2 clients with "
+	if got := testReadNotify(conn); !strings.HasPrefix(got, want) {
+		t.Errorf("got %s, want prefix %s", got, want)
+	}
+	want = "\nWATCHDOG=1"
+	if got := testReadNotify(conn); !strings.HasSuffix(got, want) {
+		t.Errorf("got %s, want suffix %s", got, want)
+	}
+
+	// stop notifications, the last one reports stopping
+	close(done)
+	<-stopped
+	for got := ""; got != "STOPPING=1"; {
+		got = testReadNotify(conn)
+		if !strings.HasSuffix(got, want) && got != "STOPPING=1" {
+			t.Errorf("got %s, want STOPPING=1", got)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("got %s, want 0", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	if got := watchdogInterval(); got != 15*time.Second {
+		t.Errorf("got %s, want %s", got, 15*time.Second)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("got %s, want 0", got)
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	// sockets of other processes are ignored and the environment
+	// variables are removed
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	control, ws, err := systemdListeners(slog.Default())
+	if control != nil || ws != nil || err != nil {
+		t.Errorf("got %v %v %v, want nil nil nil", control, ws, err)
+	}
+	if got := os.Getenv("LISTEN_FDS"); got != "" {
+		t.Errorf("got %s, want empty", got)
+	}
+}
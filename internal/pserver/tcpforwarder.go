@@ -1,9 +1,33 @@
 package pserver
 
 import (
+	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpBufferLen is the length of buffers for copying tcp data if the
+	// data cannot be spliced between connections
+	tcpBufferLen = 32 * 1024
+
+	// directions of traffic in a tcp forwarder
+	tcpPeerToDst = 0
+	tcpDstToPeer = 1
+)
 
-	"github.com/hwipl/service-proxy/internal/network"
+var (
+	// tcpBuffers is a pool of buffers for copying tcp data
+	tcpBuffers = sync.Pool{
+		New: func() any {
+			b := make([]byte, tcpBufferLen)
+			return &b
+		},
+	}
 )
 
 // tcpForwarder forwards network traffic between a tcp service proxy and
@@ -11,81 +35,199 @@ import (
 type tcpForwarder struct {
 	srvConn net.Conn
 	dstConn net.Conn
-	srvData chan []byte
-	dstData chan []byte
+	opts    *serviceOptions
+	log     *slog.Logger
+	// onClose is called with the forwarded bytes in each direction and
+	// the close reason when the forwarder is closed
+	onClose func(bytes [2]int64, reason string)
+	// bytes counts the forwarded bytes in each direction, each counter
+	// is only updated by the goroutine of its direction
+	bytes [2]int64
+
+	// mutex protects the following fields
+	mutex       sync.Mutex
+	closeReason string
+	// idleSince is the time since when each direction has been idle and
+	// idleUntil is the time until when each direction has been idle;
+	// closed directions are idle indefinitely
+	idleSince [2]time.Time
+	idleUntil [2]time.Time
+	closed    [2]bool
 }
 
-// runForwarder runs the tcp forwarder
-func (t *tcpForwarder) runForwarder() {
-	// read data from connections to channels
-	go tcpReadToChannel(t.srvConn, t.srvData)
-	go tcpReadToChannel(t.dstConn, t.dstData)
+// closeWithReason closes both connections of the forwarder because of reason
+func (t *tcpForwarder) closeWithReason(reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-	// start forwarding traffic
-	for {
-		select {
-		case data, more := <-t.srvData:
-			if !more {
-				// no more data from service connection,
-				// disable channel, close reading side of
-				// service connection and close writing side of
-				// destination connection
-				t.srvData = nil
-				t.srvConn.(*net.TCPConn).CloseRead()
-				t.dstConn.(*net.TCPConn).CloseWrite()
-				break
-			}
-			// copy data from service peer to destination
-			network.WriteToConn(t.dstConn, data)
-		case data, more := <-t.dstData:
-			if !more {
-				// no more data from destination connection,
-				// disable channel, close reading side of
-				// destination connection and close writing
-				// side of service connection
-				t.dstData = nil
-				t.dstConn.(*net.TCPConn).CloseRead()
-				t.srvConn.(*net.TCPConn).CloseWrite()
-				break
-			}
-			// copy data from destination to service peer
-			network.WriteToConn(t.srvConn, data)
-		}
+	if t.closeReason != "" {
+		return
+	}
+	t.closeReason = reason
+	t.srvConn.Close()
+	t.dstConn.Close()
+}
 
-		// if both channels are closed, stop
-		if t.srvData == nil && t.dstData == nil {
-			break
-		}
+// getCloseReason returns the reason for closing the forwarder with
+// closeWithReason or defaultReason if the connections were closed otherwise
+func (t *tcpForwarder) getCloseReason(defaultReason string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closeReason == "" {
+		return defaultReason
+	}
+	return t.closeReason
+}
+
+// checkIdle updates the idle state of direction dir after a period without
+// (active is false) or with (active is true) traffic and returns whether the
+// forwarder has been idle in both directions for the idle timeout
+func (t *tcpForwarder) checkIdle(dir int, active bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if active {
+		t.idleSince[dir] = now
 	}
+	t.idleUntil[dir] = now
 
+	// both directions have been idle between the later idleSince and the
+	// earlier idleUntil
+	since := t.idleSince[tcpPeerToDst]
+	if t.idleSince[tcpDstToPeer].After(since) {
+		since = t.idleSince[tcpDstToPeer]
+	}
+	until := now
+	for d := range t.idleUntil {
+		if !t.closed[d] && t.idleUntil[d].Before(until) {
+			until = t.idleUntil[d]
+		}
+	}
+	return until.Sub(since) >= t.opts.idleTimeout
 }
 
-// tcpReadToChannel reads data from conn and writes it to channel
-func tcpReadToChannel(conn net.Conn, channel chan<- []byte) {
-	buf := make([]byte, 2048)
+// setClosed marks direction dir as closed
+func (t *tcpForwarder) setClosed(dir int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed[dir] = true
+}
 
+// forward copies traffic in direction dir from src to dst until src is closed
+// or the forwarder is idle and closes the connections afterwards
+func (t *tcpForwarder) forward(dir int, dst, src net.Conn) {
+	// with an idle timeout, copy the data in intervals of a quarter of
+	// the timeout and check if the forwarder is idle after each interval
+	interval := t.opts.idleTimeout / 4
 	for {
-		n, err := conn.Read(buf)
-		if n > 0 {
-			data := make([]byte, n)
-			copy(data, buf[:n])
-			channel <- data
+		if interval > 0 {
+			src.SetReadDeadline(time.Now().Add(interval))
 		}
-		if err != nil {
-			close(channel)
+		n, err := tcpCopy(dst, src)
+		t.bytes[dir] += n
+		if interval == 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
 			break
 		}
+		if t.checkIdle(dir, n > 0) {
+			t.closeWithReason(closeReasonIdle)
+			break
+		}
+	}
+
+	// no more data from src, close reading side of src and writing side
+	// of dst
+	t.setClosed(dir)
+	if c, ok := src.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	}
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// runForwarder runs the tcp forwarder
+func (t *tcpForwarder) runForwarder() {
+	defer t.srvConn.Close()
+	defer t.dstConn.Close()
+
+	if t.opts == nil {
+		t.opts = &serviceOptions{}
+	}
+	if t.log == nil {
+		t.log = slog.Default()
 	}
+
+	// start timer for maximum lifetime, it closes the connections and,
+	// thus, stops the forwarder
+	if t.opts.maxLifetime > 0 {
+		lifetime := time.AfterFunc(t.opts.maxLifetime, func() {
+			t.closeWithReason(closeReasonLifetime)
+		})
+		defer lifetime.Stop()
+	}
+
+	// start forwarding traffic in both directions
+	now := time.Now()
+	t.idleSince = [2]time.Time{now, now}
+	t.idleUntil = [2]time.Time{now, now}
+	reasons := make(chan string, 2)
+	go func() {
+		t.forward(tcpPeerToDst, t.dstConn, t.srvConn)
+		reasons <- closeReasonPeer
+	}()
+	go func() {
+		t.forward(tcpDstToPeer, t.srvConn, t.dstConn)
+		reasons <- closeReasonDestination
+	}()
+
+	// wait for both directions, the first one closed is the reason
+	reason := <-reasons
+	<-reasons
+
+	reason = t.getCloseReason(reason)
+	t.log.Info("Closing tcp connection", "reason", reason,
+		"bytes_from_peer", t.bytes[tcpPeerToDst], "bytes_to_peer",
+		t.bytes[tcpDstToPeer])
+	if t.onClose != nil {
+		t.onClose(t.bytes, reason)
+	}
+}
+
+// tcpCopy copies data from src to dst until src is closed or an error
+// occurs. Data between tcp connections is copied with ReadFrom, that uses
+// splice on linux, other data is copied with a buffer from the buffer pool.
+// Splice keeps the data out of user space, but it is not faster than the
+// buffer for small writes over loopback, see BenchmarkTCPForwarder
+func tcpCopy(dst, src net.Conn) (int64, error) {
+	if d, ok := dst.(*net.TCPConn); ok {
+		if _, ok := src.(*net.TCPConn); ok {
+			return d.ReadFrom(src)
+		}
+	}
+
+	// hide ReadFrom and WriteTo of the connections, so the buffer is used
+	buf := tcpBuffers.Get().(*[]byte)
+	defer tcpBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src},
+		*buf)
 }
 
 // runTCPForwarder starts forwarding traffic between a connection to the
-// service proxy and a connection to the destination
-func runTCPForwarder(srvConn, dstConn net.Conn) {
+// service proxy and a connection to the destination using the service
+// options opts and the logger log, which defaults to the default logger;
+// onClose is called with the forwarded bytes from and to the peer and the
+// close reason when the forwarder is closed if it is not nil
+func runTCPForwarder(srvConn, dstConn net.Conn, opts *serviceOptions,
+	log *slog.Logger, onClose func(bytes [2]int64, reason string)) {
 	fwd := tcpForwarder{
 		srvConn: srvConn,
 		dstConn: dstConn,
-		srvData: make(chan []byte),
-		dstData: make(chan []byte),
+		opts:    opts,
+		log:     log,
+		onClose: onClose,
 	}
 	go fwd.runForwarder()
 }
@@ -2,9 +2,13 @@ package pserver
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/hwipl/service-proxy/internal/network"
 )
@@ -53,8 +57,6 @@ func TestTCPForwarder(t *testing.T) {
 	forwarder := tcpForwarder{
 		srvConn: srvClient,
 		dstConn: dstConn,
-		srvData: make(chan []byte),
-		dstData: make(chan []byte),
 	}
 	go forwarder.runForwarder()
 
@@ -77,3 +79,237 @@ func TestTCPForwarder(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestTCPForwarderIdleTimeout(t *testing.T) {
+	// create connection pairs
+	srvConn, srvClient := testTCPConnPair()
+	defer srvConn.Close()
+	dstConn, dstClient := testTCPConnPair()
+	defer dstClient.Close()
+
+	// create forwarder between connections with short idle timeout
+	forwarder := tcpForwarder{
+		srvConn: srvClient,
+		dstConn: dstConn,
+		opts:    &serviceOptions{idleTimeout: 100 * time.Millisecond},
+	}
+	done := make(chan struct{})
+	go func() {
+		forwarder.runForwarder()
+		close(done)
+	}()
+
+	// wait for idle timeout
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarder not closed after idle timeout")
+	}
+	want := "idle timeout"
+	got := forwarder.getCloseReason("")
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestTCPForwarderHalfClose(t *testing.T) {
+	// create connection pairs and forwarder between them
+	srvConn, srvClient := testTCPConnPair()
+	defer srvConn.Close()
+	dstConn, dstClient := testTCPConnPair()
+	defer dstClient.Close()
+	runTCPForwarder(srvClient, dstConn, &serviceOptions{}, nil, nil)
+
+	// write request and close writing side of service connection
+	want := []byte{1, 2, 3, 4, 5, 6}
+	network.WriteToConn(srvConn, want)
+	srvConn.CloseWrite()
+
+	// read request until closed at destination
+	got, err := io.ReadAll(dstClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// destination can still send reply after half-close
+	want = []byte{6, 5, 4, 3, 2, 1}
+	network.WriteToConn(dstClient, want)
+	dstClient.CloseWrite()
+	got, err = io.ReadAll(srvConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTCPForwarderMaxLifetime(t *testing.T) {
+	// create connection pairs
+	srvConn, srvClient := testTCPConnPair()
+	defer srvConn.Close()
+	dstConn, dstClient := testTCPConnPair()
+	defer dstClient.Close()
+
+	// create forwarder between connections with short lifetime
+	forwarder := tcpForwarder{
+		srvConn: srvClient,
+		dstConn: dstConn,
+		opts:    &serviceOptions{maxLifetime: 100 * time.Millisecond},
+	}
+	done := make(chan struct{})
+	go func() {
+		forwarder.runForwarder()
+		close(done)
+	}()
+
+	// wait for maximum lifetime
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarder not closed after maximum lifetime")
+	}
+	want := "maximum lifetime reached"
+	got := forwarder.getCloseReason("")
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// testTCPConnPair creates a pair of connected tcp connections
+func testTCPConnPair() (*net.TCPConn, *net.TCPConn) {
+	tcpAddr := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, err := net.ListenTCP("tcp", &tcpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.DialTCP("tcp", &tcpAddr,
+		listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, err := listener.AcceptTCP()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client, server
+}
+
+// testTCPCopyChannel copies data from src to dst like the previous tcp
+// forwarder, that read chunks of at most 2048 bytes into new slices and passed
+// them over a channel, for comparison in benchmarks
+func testTCPCopyChannel(dst, src *net.TCPConn) {
+	data := make(chan []byte)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				d := make([]byte, n)
+				copy(d, buf[:n])
+				data <- d
+			}
+			if err != nil {
+				close(data)
+				return
+			}
+		}
+	}()
+	for d := range data {
+		network.WriteToConn(dst, d)
+	}
+	dst.CloseWrite()
+}
+
+// testTCPCopy copies data from src to dst with io.Copy without splice for
+// comparison in benchmarks
+func testTCPCopy(dst, src *net.TCPConn) {
+	io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+	dst.CloseWrite()
+}
+
+// benchmarkTCPForwarder benchmarks forwarding data in chunks of size bytes
+// from a peer to a destination with forward, that starts forwarding from the
+// service connection srvConn to the destination connection dstConn
+func benchmarkTCPForwarder(b *testing.B, size int,
+	forward func(srvConn, dstConn *net.TCPConn)) {
+	// create connection pairs and forwarder between them
+	srvConn, srvClient := testTCPConnPair()
+	defer srvConn.Close()
+	dstConn, dstClient := testTCPConnPair()
+	defer dstClient.Close()
+	forward(srvClient, dstConn)
+
+	// write data to service connection and read it from destination
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		data := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			if !network.WriteToConn(srvConn, data) {
+				return
+			}
+		}
+		srvConn.CloseWrite()
+	}()
+	n, err := io.Copy(io.Discard, dstClient)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if n != int64(b.N*size) {
+		b.Fatalf("got %d bytes, want %d", n, b.N*size)
+	}
+}
+
+// testTCPConn wraps a tcp connection, so the tcp forwarder copies data with a
+// buffer instead of splice; CloseRead and CloseWrite are still available
+type testTCPConn struct {
+	*net.TCPConn
+}
+
+// BenchmarkTCPForwarder benchmarks the tcp forwarder with splice, with a
+// buffer and with an idle timeout and, for comparison, the previous channel
+// based forwarder and io.Copy without splice
+func BenchmarkTCPForwarder(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	forwarders := []struct {
+		name    string
+		forward func(srvConn, dstConn *net.TCPConn)
+	}{
+		{"forwarder", func(srvConn, dstConn *net.TCPConn) {
+			runTCPForwarder(srvConn, dstConn, &serviceOptions{},
+				logger, nil)
+		}},
+		{"buffered", func(srvConn, dstConn *net.TCPConn) {
+			runTCPForwarder(testTCPConn{srvConn},
+				testTCPConn{dstConn}, &serviceOptions{},
+				logger, nil)
+		}},
+		{"idle", func(srvConn, dstConn *net.TCPConn) {
+			// read deadlines expire every 10ms
+			opts := &serviceOptions{
+				idleTimeout: 40 * time.Millisecond,
+			}
+			runTCPForwarder(srvConn, dstConn, opts, logger, nil)
+		}},
+		{"channel", func(srvConn, dstConn *net.TCPConn) {
+			go testTCPCopyChannel(dstConn, srvConn)
+		}},
+		{"copy", func(srvConn, dstConn *net.TCPConn) {
+			go testTCPCopy(dstConn, srvConn)
+		}},
+	}
+	for _, f := range forwarders {
+		for _, size := range []int{1024, 65536} {
+			name := fmt.Sprintf("%s/%d", f.name, size)
+			b.Run(name, func(b *testing.B) {
+				benchmarkTCPForwarder(b, size, f.forward)
+			})
+		}
+	}
+}
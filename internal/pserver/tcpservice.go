@@ -1,20 +1,33 @@
 package pserver
 
 import (
-	"log"
+	"context"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
 )
 
-var (
-	// tcpServices stores all active tcp services identified by port
-	tcpServices tcpServiceMap
+const (
+	// tcpAcceptRetryDelay is the delay before accepting new connections
+	// of a tcp service again after an error
+	tcpAcceptRetryDelay = 100 * time.Millisecond
+
+	// tcpDialTimeout is the timeout for connecting a peer to the proxy
+	// destination
+	tcpDialTimeout = 10 * time.Second
 )
 
-// tcpServiceMap stores active tcp services identified by port
+// tcpServiceMap stores the active tcp services of a control server
+// identified by port
 type tcpServiceMap struct {
 	m sync.Mutex
 	s map[int]*tcpService
+	// standby stores the standby services of ports
+	standby standbyQueue
+	// logger is the logger for log messages of the services
+	logger *sharedLogger
 }
 
 // add adds the service entry identified by port to the tcpServiceMap and
@@ -33,6 +46,14 @@ func (t *tcpServiceMap) add(port int, service *tcpService) bool {
 	return false
 }
 
+// count returns the number of active services in the tcpServiceMap
+func (t *tcpServiceMap) count() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return len(t.s)
+}
+
 // del removes the service identified by port from the tcpServiceMap
 func (t *tcpServiceMap) del(port int) {
 	t.m.Lock()
@@ -41,6 +62,91 @@ func (t *tcpServiceMap) del(port int) {
 	delete(t.s, port)
 }
 
+// joinOrQueue adds member to the pool of the service identified by port, if
+// the service exists and its pool has the name pool, and returns the service.
+// If the service exists with another pool, member is queued as standby with
+// the service options opts and its position in the standby queue is returned.
+// If the service does not exist, it returns nil and 0
+func (t *tcpServiceMap) joinOrQueue(port int, pool string, member *poolMember,
+	opts *serviceOptions) (*tcpService, int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	s := t.s[port]
+	if s == nil {
+		return nil, 0
+	}
+	if pool != "" && s.pool.name == pool {
+		s.pool.add(member)
+		return s, 0
+	}
+	if t.standby == nil {
+		t.standby = make(standbyQueue)
+	}
+	return nil, t.standby.push(port, &standbyService{
+		pool:   pool,
+		member: member,
+		opts:   opts,
+	})
+}
+
+// leave removes the pool member or the standby service of owner from the
+// service identified by port. It returns the service and the removed member
+// or, if owner has a standby service, nil and the removed member. If the
+// service has no remaining members, it is replaced by the next standby
+// service, if there is one, that is returned as next and must be started
+func (t *tcpServiceMap) leave(port int, owner *client) (s *tcpService,
+	m *poolMember, next *tcpService) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if standby := t.standby.remove(port, owner); standby != nil {
+		return nil, standby.member, nil
+	}
+	s = t.s[port]
+	if s == nil {
+		return nil, nil, nil
+	}
+	m, remaining := s.pool.remove(owner)
+	if m == nil || remaining > 0 {
+		return s, m, nil
+	}
+	return s, m, t.promote(s)
+}
+
+// fail removes the service s that could not be started and returns the next
+// standby service, if there is one, that replaces it and must be started
+func (t *tcpServiceMap) fail(s *tcpService) *tcpService {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.promote(s)
+}
+
+// promote replaces the service s with the next standby service and returns
+// it; if there is no standby service, s is removed and nil is returned. The
+// caller must hold the mutex
+func (t *tcpServiceMap) promote(s *tcpService) *tcpService {
+	port := s.srvAddr.Port
+	standby := t.standby.pop(port)
+	if standby == nil {
+		delete(t.s, port)
+		return nil
+	}
+	next := newTCPService(t, s.srvAddr, newStandbyPool(standby),
+		standby[0].opts)
+	t.s[port] = next
+	return next
+}
+
+// standbyCount returns the number of standby services on port
+func (t *tcpServiceMap) standbyCount(port int) int {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.standby.count(port)
+}
+
 // get gets the service identified by port from the tcpServiceMap
 func (t *tcpServiceMap) get(port int) *tcpService {
 	t.m.Lock()
@@ -51,12 +157,15 @@ func (t *tcpServiceMap) get(port int) *tcpService {
 
 // tcpService stores tcp service proxy information
 type tcpService struct {
+	services *tcpServiceMap
 	srvAddr  *net.TCPAddr
 	listener *net.TCPListener
-	srcAddr  *net.TCPAddr
-	dstAddr  *net.TCPAddr
+	pool     *servicePool
+	opts     *serviceOptions
 	mutex    *sync.Mutex
 	done     bool
+	// fwds stores the active forwarders of the service and their members
+	fwds map[*tcpForwarder]*poolMember
 }
 
 // runService runs the tcp service proxy
@@ -64,33 +173,128 @@ func (t *tcpService) runService() {
 	defer t.listener.Close()
 	for {
 		// get new service connection
-		srvConn, err := t.listener.Accept()
+		srvConn, err := t.listener.AcceptTCP()
 		if err != nil {
 			if t.getDone() {
 				// service is shutting down, ignore errors
 				return
 			}
-			log.Fatal(err)
+			t.services.logger.Error("Could not accept tcp "+
+				"connection",
+				"addr", t.srvAddr.String(), "error", err)
+			time.Sleep(tcpAcceptRetryDelay)
+			continue
 		}
 
-		// open connection to proxy destination
-		dstConn, err := net.DialTCP("tcp", t.srcAddr, t.dstAddr)
-		if err != nil {
+		// select proxy destination for the peer from the pool, if
+		// there is no healthy destination, refuse the connection with
+		// a reset
+		member := t.pool.pick(srvConn.RemoteAddr().(*net.TCPAddr).IP)
+		if member == nil {
+			t.services.logger.Warn("Refusing tcp connection",
+				"protocol",
+				"tcp", "port", t.srvAddr.Port, "peer",
+				srvConn.RemoteAddr().String(), "error",
+				"no healthy destination")
+			srvConn.SetLinger(0)
 			srvConn.Close()
 			continue
 		}
 
-		// start forwarding traffic between connections
-		runTCPForwarder(srvConn, dstConn)
+		// connect peer to proxy destination in the background, so a
+		// slow destination does not block other peers
+		go t.handleConn(srvConn, member)
 	}
 }
 
-// setDone marks the service as done
-func (t *tcpService) setDone() {
+// handleConn connects the peer connection srvConn to the destination of
+// member and forwards traffic between them
+func (t *tcpService) handleConn(srvConn *net.TCPConn, member *poolMember) {
+	// open connection to proxy destination, count it as active while
+	// connecting, so other peers are distributed accordingly
+	peer, port := srvConn.RemoteAddr(), t.srvAddr.Port
+	log := member.owner.log().With("protocol", "tcp", "port", port,
+		"dest_port", member.dstPort, "peer", peer.String())
+	access := member.newAccessRecord("tcp", port, peer)
+	member.conns.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), tcpDialTimeout)
+	dstConn, err := member.dialTCP(ctx, peer)
+	cancel()
+	if err != nil {
+		log.Warn("Could not connect peer to destination",
+			"stream", member.stream, "error", err)
+		member.conns.Add(-1)
+		access.close([2]int64{}, closeReasonDialFailed)
+		srvConn.SetLinger(0)
+		srvConn.Close()
+		return
+	}
+
+	// start forwarding traffic between connections
+	t.opts.applyKeepAlive(srvConn, log)
+	if tcpConn, ok := dstConn.(*net.TCPConn); ok {
+		t.opts.applyKeepAlive(tcpConn, log)
+	}
+	log.Info("New tcp connection")
+	member.owner.publishPeer(EventPeerConnected, "tcp", port,
+		member.dstPort, peer, [2]int64{})
+	onClose := func(b [2]int64, reason string) {
+		member.conns.Add(-1)
+		member.owner.publishPeer(EventPeerDisconnected, "tcp", port,
+			member.dstPort, peer, b)
+		access.close(b, reason)
+	}
+	// run forwarder as active forwarder of the service, so it is closed
+	// when the service stops
+	fwd := &tcpForwarder{
+		srvConn: srvConn,
+		dstConn: dstConn,
+		opts:    t.opts,
+		log:     log,
+		onClose: onClose,
+	}
+	if !t.addForwarder(fwd, member) {
+		// service stopped while connecting
+		fwd.closeWithReason(closeReasonStopped)
+	}
+	fwd.runForwarder()
+	t.delForwarder(fwd)
+}
+
+// addForwarder adds the active forwarder fwd of member to the service and
+// returns true if successful; it fails if the service is done
+func (t *tcpService) addForwarder(fwd *tcpForwarder, member *poolMember) bool {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	t.done = true
+	if t.done {
+		return false
+	}
+	if t.fwds == nil {
+		t.fwds = make(map[*tcpForwarder]*poolMember)
+	}
+	t.fwds[fwd] = member
+	return true
+}
+
+// delForwarder removes the forwarder fwd from the service
+func (t *tcpService) delForwarder(fwd *tcpForwarder) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.fwds, fwd)
+}
+
+// closeMember closes the active forwarders of member because of reason
+func (t *tcpService) closeMember(member *poolMember, reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for fwd, m := range t.fwds {
+		if m == member {
+			fwd.closeWithReason(reason)
+		}
+	}
 }
 
 // getDone checks if the service is done
@@ -101,43 +305,116 @@ func (t *tcpService) getDone() bool {
 	return t.done
 }
 
-// stopService stops the tcp service proxy
+// stopService stops the tcp service proxy and closes its active forwarders
 func (t *tcpService) stopService() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
 	// set service to done and close its listener
-	t.setDone()
+	t.done = true
 	t.listener.Close()
-	// this is pretty gracefully. active forwarder connections will remain
-	// open until they are done. also close active forwarders?
+	for fwd := range t.fwds {
+		fwd.closeWithReason(closeReasonStopped)
+	}
 }
 
-// runTCPService runs a tcp service proxy that listens on srvAddr and forwards
-// incoming connections to dstAddr from srcAddr
-func runTCPService(srvAddr, srcAddr, dstAddr *net.TCPAddr) *tcpService {
-	// create service
-	srv := tcpService{
-		srvAddr: srvAddr,
-		srcAddr: srcAddr,
-		dstAddr: dstAddr,
-		mutex:   &sync.Mutex{},
+// startService creates the listener of the tcp service proxy and runs it
+func (t *tcpService) startService() error {
+	listener, err := net.ListenTCP("tcp", t.srvAddr)
+	if err != nil {
+		return err
 	}
+	t.listener = listener
+	go t.runService()
+	return nil
+}
 
-	if tcpServices.add(srvAddr.Port, &srv) {
-		// create tcp listener
-		listener, err := net.ListenTCP("tcp", srvAddr)
-		if err != nil {
-			log.Printf("Could not create tcp service %s<->%s: %s\n",
-				srvAddr, dstAddr, err)
-			tcpServices.del(srvAddr.Port)
-			return nil
+// startStandbyTCPService starts the tcp service srv that replaced a stopped
+// service and tells the owners of its members that they are active. If the
+// service cannot be started, its owners are told that their services are
+// removed and the next standby service is started
+func startStandbyTCPService(srv *tcpService) {
+	for srv != nil {
+		port := srv.srvAddr.Port
+		log := srv.services.logger.get().With("protocol", "tcp",
+			"port", port)
+		log.Info("Promoting standby service", "members",
+			srv.pool.count(), "standby",
+			srv.services.standbyCount(port))
+		if err := srv.startService(); err != nil {
+			log.Warn("Could not start standby service", "error",
+				err)
+			srv.pool.notify(network.MessageDel, network.ProtocolTCP,
+				port)
+			srv.pool.stopHealthChecks()
+			srv = srv.services.fail(srv)
+			continue
 		}
-		srv.listener = listener
+		log.Info("Standby service is active")
+		srv.pool.notify(network.MessageActive, network.ProtocolTCP,
+			port)
+		srv.pool.startHealthChecks()
+		return
+	}
+}
 
-		// run service
-		go srv.runService()
-		return &srv
+// newTCPService creates a new tcp service proxy in services on srvAddr with
+// the destinations in pool and the service options opts
+func newTCPService(services *tcpServiceMap, srvAddr *net.TCPAddr,
+	pool *servicePool, opts *serviceOptions) *tcpService {
+	return &tcpService{
+		services: services,
+		srvAddr:  srvAddr,
+		pool:     pool,
+		opts:     opts,
+		mutex:    &sync.Mutex{},
 	}
+}
 
-	log.Printf("Could not create tcp service %s<->%s: service already "+
-		"active\n", srvAddr, dstAddr)
-	return nil
+// runTCPService runs a tcp service proxy in services that listens on srvAddr
+// and forwards incoming connections to the destination of member using the
+// service options opts. If pool is not empty and the service is already
+// running with the same pool name, member joins the pool of the running
+// service. If the service is already running with another pool, member is
+// queued as standby and standby is true
+func runTCPService(services *tcpServiceMap, srvAddr *net.TCPAddr,
+	pool string, member *poolMember, opts *serviceOptions) (
+	srv *tcpService, standby bool) {
+	srv = newTCPService(services, srvAddr, newServicePool(pool, opts,
+		member), opts)
+	log := member.owner.log().With("protocol", "tcp", "port",
+		srvAddr.Port, "dest_port", member.dstPort)
+
+	for {
+		if services.add(srvAddr.Port, srv) {
+			// create tcp listener and run service
+			if err := srv.startService(); err != nil {
+				log.Warn("Could not create service", "error",
+					err)
+				srv.pool.remove(member.owner)
+				srv.pool.notify(network.MessageDel,
+					network.ProtocolTCP, srvAddr.Port)
+				srv.pool.stopHealthChecks()
+				startStandbyTCPService(services.fail(srv))
+				return nil, false
+			}
+			return srv, false
+		}
+
+		// service already active, try joining its pool or queue as
+		// standby
+		s, n := services.joinOrQueue(srvAddr.Port, pool, member,
+			opts)
+		if s != nil {
+			log.Info("Joined pool of service", "pool", pool,
+				"members", s.pool.count())
+			return s, false
+		}
+		if n > 0 {
+			log.Info("Queued service as standby", "standby", n)
+			return nil, true
+		}
+
+		// service stopped in the meantime, try again
+	}
 }
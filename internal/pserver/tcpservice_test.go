@@ -0,0 +1,206 @@
+package pserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/network"
+)
+
+// testTCPEchoServer creates a tcp server that echoes all data, the caller
+// must close the listener
+func testTCPEchoServer() *net.TCPListener {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTCPServiceSlowDestination(t *testing.T) {
+	// create destination that echoes data
+	echo := testTCPEchoServer()
+	defer echo.Close()
+
+	// create stream member whose client never answers stream requests
+	ctlConn, peerConn := net.Pipe()
+	defer ctlConn.Close()
+	defer peerConn.Close()
+	slow := &poolMember{
+		owner: &client{
+			streams: network.NewStreams(ctlConn, true,
+				func(*network.Message, []byte) bool {
+					return true
+				}, nil),
+		},
+		dstPort: 1,
+		stream:  true,
+	}
+	defer slow.owner.streams.CloseAll()
+
+	// create service with the slow member and the echo destination
+	srvAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	srv := newTCPService(&tcpServiceMap{}, srvAddr, newServicePool("",
+		&serviceOptions{}, slow), &serviceOptions{})
+	srv.pool.add(testPoolMember(nil, &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: echo.Addr().(*net.TCPAddr).Port,
+	}))
+	if err := srv.startService(); err != nil {
+		log.Fatal(err)
+	}
+	defer srv.stopService()
+
+	// first peer waits for the slow member
+	addr := srv.listener.Addr().String()
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer first.Close()
+
+	// second peer is connected to the echo destination in the meantime
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(time.Second))
+	want := []byte("hello")
+	if _, err := second.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(second, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTCPServiceStopClosesForwarders(t *testing.T) {
+	// write access log to a pipe
+	var a sharedAccessLog
+	r, w := io.Pipe()
+	a.set(w)
+	defer a.set(nil)
+	defer r.Close()
+
+	// create service with echo destination
+	echo := testTCPEchoServer()
+	defer echo.Close()
+	pool := testServicePool(nil, &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: echo.Addr().(*net.TCPAddr).Port,
+	}, &serviceOptions{})
+	pool.members[0].owner = &client{accessLog: &a}
+	srv := newTCPService(&tcpServiceMap{},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, pool,
+		&serviceOptions{})
+	if err := srv.startService(); err != nil {
+		log.Fatal(err)
+	}
+
+	// connect peer and wait until its traffic is forwarded
+	peer, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(time.Second))
+	buf := []byte("hello")
+	if _, err := peer.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// stop service, the connection of the peer should be closed
+	srv.stopService()
+	var record accessRecord
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := record.Reason, closeReasonStopped; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := peer.Read(buf); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestTCPServiceCloseMember(t *testing.T) {
+	// create service with two members and echo destinations
+	echo := testTCPEchoServer()
+	defer echo.Close()
+	dstAddr := &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: echo.Addr().(*net.TCPAddr).Port,
+	}
+	first := testPoolMember(nil, dstAddr)
+	second := testPoolMember(nil, dstAddr)
+	pool := newServicePool("", &serviceOptions{}, first)
+	pool.add(second)
+	srv := newTCPService(&tcpServiceMap{},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, pool,
+		&serviceOptions{})
+	if err := srv.startService(); err != nil {
+		log.Fatal(err)
+	}
+	defer srv.stopService()
+
+	// connect peer to the first member
+	peer, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(time.Second))
+	buf := []byte("hello")
+	if _, err := peer.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing connections of the second member keeps the peer connected
+	srv.closeMember(second, closeReasonRemoved)
+	if _, err := peer.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing connections of the first member disconnects the peer
+	srv.closeMember(first, closeReasonUnhealthy)
+	if _, err := peer.Read(buf); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
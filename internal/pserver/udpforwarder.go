@@ -1,57 +1,199 @@
 package pserver
 
 import (
-	"log"
+	"container/list"
+	"log/slog"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// defaultUDPIdleTimeout is the default time without traffic after
+	// which an udp forwarder is removed
+	defaultUDPIdleTimeout = time.Minute
+
+	// defaultUDPQueueLen is the default length of the packet queue of an
+	// udp forwarder
+	defaultUDPQueueLen = 64
+)
+
 // udpForwarderMap maps peer addresses to forwarders
 type udpForwarderMap struct {
 	mutex   sync.Mutex
 	srvConn *net.UDPConn
-	srcAddr *net.UDPAddr
-	dstAddr *net.UDPAddr
-	fwds    map[string]*udpForwarder
+	pool    *servicePool
+	opts    *serviceOptions
+	fwds    map[netip.AddrPort]*udpForwarder
+	// lru orders the forwarders by their last activity, the most
+	// recently used forwarder is at the front
+	lru *list.List
+	// drops counts the packets dropped by all forwarders and packets
+	// dropped because no forwarder could be created
+	drops atomic.Uint64
 }
 
 // get returns an udpForwarder for peer
-func (u *udpForwarderMap) get(peer *net.UDPAddr) *udpForwarder {
+func (u *udpForwarderMap) get(peer netip.AddrPort) *udpForwarder {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
-	fwd := u.fwds[peer.String()]
+	fwd := u.fwds[peer]
 	if fwd == nil {
+		// if the maximum number of forwarders is reached, remove the
+		// least recently used forwarder
+		if u.opts.maxSessions > 0 && len(u.fwds) >= u.opts.maxSessions {
+			old := u.lru.Back().Value.(*udpForwarder)
+			old.log.Info("Evicting udp session, maximum sessions " +
+				"reached")
+			u.closeWithReason(old, closeReasonEvicted)
+		}
+
+		// select destination for this peer from the pool
+		member := u.pool.pick(peer.Addr().AsSlice())
+		if member == nil {
+			return nil
+		}
+
 		// create a new forwarder for this peer
-		dstConn, err := net.DialUDP("udp", u.srcAddr, u.dstAddr)
+		srcAddr, dstAddr := member.udpAddrs()
+		dstConn, err := net.DialUDP("udp", srcAddr, dstAddr)
 		if err != nil {
-			log.Println("error creating socket for peer", peer)
+			member.owner.log().Warn("Could not create udp session",
+				"peer", peer.String(), "error", err)
 			return nil
 		}
+		idleTimeout := u.opts.idleTimeout
+		if idleTimeout == 0 {
+			idleTimeout = defaultUDPIdleTimeout
+		}
+		queueLen := u.opts.queueLen
+		if queueLen == 0 {
+			queueLen = defaultUDPQueueLen
+		}
 		newFwd := udpForwarder{
-			fwdMap:  u,
-			srvConn: u.srvConn,
-			dstConn: dstConn,
-			peer:    peer,
-			srvData: make(chan []byte),
-			dstData: make(chan []byte),
+			fwdMap:      u,
+			member:      member,
+			srvConn:     u.srvConn,
+			dstConn:     dstConn,
+			peer:        peer,
+			idleTimeout: idleTimeout,
+			srvData:     make(chan *udpPacket, queueLen),
+			dstData:     make(chan *udpPacket),
+			done:        make(chan struct{}),
 		}
-		u.fwds[peer.String()] = &newFwd
+		newFwd.log = member.owner.log().With("protocol", "udp", "port",
+			newFwd.port(), "dest_port", member.dstPort, "peer",
+			peer.String())
+		newFwd.access = member.newAccessRecord("udp", newFwd.port(),
+			net.UDPAddrFromAddrPort(peer))
+		member.conns.Add(1)
+		newFwd.elem = u.lru.PushFront(&newFwd)
+		u.fwds[peer] = &newFwd
+		newFwd.log.Debug("New udp session", "sessions", len(u.fwds))
+		member.owner.publishPeer(EventPeerConnected, "udp",
+			newFwd.port(), member.dstPort,
+			net.UDPAddrFromAddrPort(peer), newFwd.bytes)
 		go newFwd.runForwarder()
 		return &newFwd
 	}
 
 	// re-use existing forwarder
+	u.lru.MoveToFront(fwd.elem)
 	return fwd
 }
 
-// del removes the udpForwarder for peer
-func (u *udpForwarderMap) del(peer *net.UDPAddr) {
+// forward forwards the packet data from peer to the proxy destination using
+// the udpForwarder of the peer
+func (u *udpForwarderMap) forward(peer netip.AddrPort, data []byte) {
+	fwd := u.get(peer)
+	if fwd == nil {
+		// could not create forwarder, drop packet
+		u.drops.Add(1)
+		return
+	}
+	fwd.forward(newUDPPacket(data))
+}
+
+// touch marks fwd as the most recently used forwarder
+func (u *udpForwarderMap) touch(fwd *udpForwarder) {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
-	delete(u.fwds, peer.String())
+	if fwd.elem != nil {
+		u.lru.MoveToFront(fwd.elem)
+	}
+}
+
+// remove removes fwd from the map, the caller must hold the mutex
+func (u *udpForwarderMap) remove(fwd *udpForwarder) {
+	if fwd.elem == nil {
+		// already removed
+		return
+	}
+	u.lru.Remove(fwd.elem)
+	fwd.elem = nil
+	delete(u.fwds, fwd.peer)
+	fwd.member.conns.Add(-1)
+}
+
+// closeWithReason removes fwd and closes its destination socket because of
+// reason, the caller must hold the mutex
+func (u *udpForwarderMap) closeWithReason(fwd *udpForwarder, reason string) {
+	if fwd.closeReason == "" {
+		fwd.closeReason = reason
+	}
+	fwd.dstConn.Close()
+	u.remove(fwd)
+}
+
+// getCloseReason returns the reason for closing fwd with closeWithReason or
+// defaultReason if it was closed otherwise
+func (u *udpForwarderMap) getCloseReason(fwd *udpForwarder,
+	defaultReason string) string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if fwd.closeReason == "" {
+		return defaultReason
+	}
+	return fwd.closeReason
+}
+
+// del removes the udpForwarder fwd
+func (u *udpForwarderMap) del(fwd *udpForwarder) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.remove(fwd)
+}
+
+// count returns the number of udpForwarders in the map
+func (u *udpForwarderMap) count() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return len(u.fwds)
+}
+
+// dropCount returns the number of packets dropped by the udpForwarders
+func (u *udpForwarderMap) dropCount() uint64 {
+	return u.drops.Load()
+}
+
+// closeMember closes the udpForwarders with the destination of member
+// because of reason
+func (u *udpForwarderMap) closeMember(member *poolMember, reason string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, fwd := range u.fwds {
+		if fwd.member == member {
+			u.closeWithReason(fwd, reason)
+		}
+	}
 }
 
 // stopAll stops all udpForwarders in the map
@@ -59,21 +201,22 @@ func (u *udpForwarderMap) stopAll() {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
-	for peer, fwd := range u.fwds {
+	for _, fwd := range u.fwds {
 		// close destination socket and remove element from map
-		fwd.dstConn.Close()
-		delete(u.fwds, peer)
+		u.closeWithReason(fwd, closeReasonStopped)
 	}
 }
 
 // newUDPForwarderMap creates a new udp forwarder for the udp service conn
-func newUDPForwarderMap(srvConn *net.UDPConn,
-	srcAddr, dstAddr *net.UDPAddr) *udpForwarderMap {
+// with the destinations in pool and the service options opts
+func newUDPForwarderMap(srvConn *net.UDPConn, pool *servicePool,
+	opts *serviceOptions) *udpForwarderMap {
 	u := udpForwarderMap{
 		srvConn: srvConn,
-		srcAddr: srcAddr,
-		dstAddr: dstAddr,
-		fwds:    make(map[string]*udpForwarder),
+		pool:    pool,
+		opts:    opts,
+		fwds:    make(map[netip.AddrPort]*udpForwarder),
+		lru:     list.New(),
 	}
 	return &u
 }
@@ -81,88 +224,157 @@ func newUDPForwarderMap(srvConn *net.UDPConn,
 // udpForwarder forwards network traffic between a udp service proxy and
 // its destination
 type udpForwarder struct {
-	fwdMap  *udpForwarderMap
-	srvConn *net.UDPConn
-	dstConn *net.UDPConn
-	peer    *net.UDPAddr
-	srvData chan []byte
-	dstData chan []byte
+	fwdMap      *udpForwarderMap
+	member      *poolMember
+	elem        *list.Element
+	srvConn     *net.UDPConn
+	dstConn     *net.UDPConn
+	peer        netip.AddrPort
+	idleTimeout time.Duration
+	srvData     chan *udpPacket
+	dstData     chan *udpPacket
+	done        chan struct{}
+	drops       atomic.Uint64
+	log         *slog.Logger
+	access      *accessRecord
+	// closeReason is the reason for closing the forwarder with
+	// closeWithReason, it is protected by the mutex of fwdMap
+	closeReason string
+	// bytes counts the forwarded bytes from and to the peer
+	bytes [2]int64
+}
+
+// port returns the port of the udp service of the forwarder
+func (u *udpForwarder) port() int {
+	if addr, ok := u.srvConn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+	return 0
 }
 
 // runForwarder runs the udp forwarder
 func (u *udpForwarder) runForwarder() {
+	defer close(u.done)
 	defer u.dstConn.Close()
-	defer u.fwdMap.del(u.peer)
+	defer u.fwdMap.del(u)
+	reason := closeReasonDestination
+	defer func() {
+		u.member.owner.publishPeer(EventPeerDisconnected, "udp",
+			u.port(), u.member.dstPort,
+			net.UDPAddrFromAddrPort(u.peer), u.bytes)
+		u.access.close(u.bytes, u.fwdMap.getCloseReason(u, reason))
+	}()
 
 	// read data from destination conn to channel
-	go udpReadToChannel(u.dstConn, u.dstData)
+	go udpReadToChannel(u.dstConn, u.dstData, u.log)
 
-	// create ticker for detecting dead connection
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
+	// create timer for detecting dead connection
+	timer := time.NewTimer(u.idleTimeout)
+	defer timer.Stop()
 
 	// start forwarding traffic
-	last := -1
-	pkts := 0
 	for {
 		select {
-		case data, more := <-u.srvData:
+		case pkt, more := <-u.srvData:
 			if !more {
 				// no more data from service connection,
 				// close destination connection and stop
+				reason = closeReasonStopped
 				return
 			}
-			_, err := u.dstConn.Write(data)
+			n, err := u.dstConn.Write(pkt.data())
+			u.bytes[0] += int64(n)
+			pkt.free()
 			if err != nil {
-				log.Printf("error sending packet from %s "+
-					"to %s\n", u.peer,
-					u.dstConn.RemoteAddr())
+				u.log.Debug("Could not send packet to "+
+					"destination", "error", err)
+				reason = closeReasonSendFailed
 				return
 			}
-			pkts++
-		case data, more := <-u.dstData:
+			timer.Reset(u.idleTimeout)
+		case pkt, more := <-u.dstData:
 			if !more {
 				// no more data from destination connection,
 				// stop here
 				return
 			}
-			_, err := u.srvConn.WriteToUDP(data, u.peer)
+			n, err := u.srvConn.WriteToUDPAddrPort(pkt.data(),
+				u.peer)
+			u.bytes[1] += int64(n)
+			pkt.free()
 			if err != nil {
-				log.Printf("error sending packet from %s "+
-					"to %s\n", u.dstConn.RemoteAddr(),
-					u.peer)
-				return
-			}
-			pkts++
-		case <-ticker.C:
-			if last == pkts {
-				// no packets forwarded since last timer tick,
-				// assume connection is dead and stop here
-				log.Printf("Cleaning up udp forwarder "+
-					"between peer %s and %s\n", u.peer,
-					u.dstConn.RemoteAddr())
+				u.log.Debug("Could not send packet to peer",
+					"error", err)
+				reason = closeReasonSendFailed
 				return
 			}
-			last = pkts
+			u.fwdMap.touch(u)
+			timer.Reset(u.idleTimeout)
+		case <-timer.C:
+			// no packets forwarded within idle timeout,
+			// assume connection is dead and stop here
+			u.log.Debug("Cleaning up idle udp session", "drops",
+				u.drops.Load())
+			reason = closeReasonIdle
+			return
 		}
 	}
 }
 
-// forward forwards a packet from the service peer to the proxy destination
-func (u *udpForwarder) forward(b []byte) {
-	u.srvData <- b
+// drop drops the packet pkt and counts it
+func (u *udpForwarder) drop(pkt *udpPacket) {
+	pkt.free()
+	u.drops.Add(1)
+	u.fwdMap.drops.Add(1)
 }
 
-// udpReadToChannel reads data from conn and writes it to channel
-// TODO: use/merge with tcpReadToChannel?
-func udpReadToChannel(conn net.Conn, channel chan<- []byte) {
+// forward queues a packet from the service peer for forwarding to the proxy
+// destination without blocking. If the queue is full, the oldest or the
+// newest packet is dropped depending on the service options
+func (u *udpForwarder) forward(pkt *udpPacket) {
+	for {
+		select {
+		case <-u.done:
+			// forwarder stopped, drop packet
+			u.drop(pkt)
+			return
+		default:
+		}
+		select {
+		case u.srvData <- pkt:
+			return
+		default:
+		}
+
+		// queue is full
+		if !u.fwdMap.opts.dropOldest {
+			u.drop(pkt)
+			return
+		}
+		select {
+		case old := <-u.srvData:
+			u.drop(old)
+		default:
+		}
+	}
+}
+
+// udpReadToChannel reads packets from conn and writes them to channel, log
+// is the logger for dropped packets
+func udpReadToChannel(conn *net.UDPConn, channel chan<- *udpPacket,
+	log *slog.Logger) {
+	buf := make([]byte, udpReadBufferLen)
 	for {
-		buf := make([]byte, 2048)
 		n, err := conn.Read(buf)
 		if err != nil {
 			close(channel)
 			return
 		}
-		channel <- buf[:n]
+		if isTruncated(buf, n) {
+			log.Debug("Dropping truncated udp packet", "addr",
+				conn.RemoteAddr().String())
+			continue
+		}
+		channel <- newUDPPacket(buf[:n])
 	}
 }
@@ -0,0 +1,129 @@
+package pserver
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testUDPForwarderMap creates an udp forwarder map with the service options
+// opts and a destination socket, the caller must close both sockets
+func testUDPForwarderMap(opts *serviceOptions) (*udpForwarderMap,
+	*net.UDPConn, *net.UDPConn) {
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	srvConn, err := net.ListenUDP("udp", &udpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dstConn, err := net.ListenUDP("udp", &udpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool := testServicePool(udpAddr.IP, dstConn.LocalAddr().(*net.UDPAddr),
+		opts)
+	fwds := newUDPForwarderMap(srvConn, pool, opts)
+	return fwds, srvConn, dstConn
+}
+
+func TestUDPForwarderMapMaxSessions(t *testing.T) {
+	fwds, srvConn, dstConn := testUDPForwarderMap(&serviceOptions{
+		maxSessions: 2,
+	})
+	defer srvConn.Close()
+	defer dstConn.Close()
+	defer fwds.stopAll()
+
+	// create forwarders for peers, first peer should be evicted
+	peers := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:1001"),
+		netip.MustParseAddrPort("127.0.0.1:1002"),
+		netip.MustParseAddrPort("127.0.0.1:1003"),
+	}
+	for _, p := range peers {
+		if fwds.get(p) == nil {
+			log.Fatal("could not create forwarder")
+		}
+	}
+	if got, want := fwds.count(), 2; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if fwds.fwds[peers[0]] != nil {
+		t.Errorf("least recently used forwarder not evicted")
+	}
+
+	// use second peer and add first peer again, third peer should be
+	// evicted
+	fwds.get(peers[1])
+	fwds.get(peers[0])
+	if fwds.fwds[peers[2]] != nil {
+		t.Errorf("least recently used forwarder not evicted")
+	}
+	if fwds.fwds[peers[1]] == nil {
+		t.Errorf("recently used forwarder evicted")
+	}
+}
+
+func TestUDPForwarderIdleTimeout(t *testing.T) {
+	fwds, srvConn, dstConn := testUDPForwarderMap(&serviceOptions{
+		idleTimeout: 100 * time.Millisecond,
+	})
+	defer srvConn.Close()
+	defer dstConn.Close()
+
+	// create forwarder and wait for idle timeout
+	fwd := fwds.get(netip.MustParseAddrPort("127.0.0.1:1001"))
+	select {
+	case <-fwd.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarder not stopped after idle timeout")
+	}
+	if got, want := fwds.count(), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestUDPForwarderForward(t *testing.T) {
+	test := func(dropOldest bool, want []byte) {
+		// create forwarder with a full queue that is not running
+		fwds := &udpForwarderMap{
+			opts: &serviceOptions{dropOldest: dropOldest},
+		}
+		fwd := udpForwarder{
+			fwdMap:  fwds,
+			srvData: make(chan *udpPacket, 2),
+			done:    make(chan struct{}),
+		}
+		for i := byte(1); i <= 4; i++ {
+			fwd.forward(newUDPPacket([]byte{i}))
+		}
+
+		// check drop counters and queued packets
+		if got := fwd.drops.Load(); got != 2 {
+			t.Errorf("got %d, want %d", got, 2)
+		}
+		if got := fwds.drops.Load(); got != 2 {
+			t.Errorf("got %d, want %d", got, 2)
+		}
+		got := []byte{}
+		for len(fwd.srvData) > 0 {
+			got = append(got, (<-fwd.srvData).data()...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		// test stopped forwarder
+		close(fwd.done)
+		fwd.forward(newUDPPacket([]byte{5}))
+		if got := fwd.drops.Load(); got != 3 {
+			t.Errorf("got %d, want %d", got, 3)
+		}
+	}
+
+	// test drop newest and drop oldest
+	test(false, []byte{1, 2})
+	test(true, []byte{3, 4})
+}
@@ -0,0 +1,380 @@
+package pserver
+
+import (
+	"container/list"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultUDPNATSockets is the default maximum number of outbound
+	// sockets per destination of an udp nat
+	defaultUDPNATSockets = 256
+)
+
+// udpNATKey identifies a session in the translation table of an udp nat by
+// the port of its outbound socket and its destination address
+type udpNATKey struct {
+	port uint16
+	dst  netip.AddrPort
+}
+
+// udpNATSocket is an unconnected outbound socket of an udp nat
+type udpNATSocket struct {
+	conn *net.UDPConn
+	port uint16
+}
+
+// udpNAT forwards packets between the peers of an udp service and the proxy
+// destinations like a nat. Packets of peers are sent on a bounded set of
+// unconnected outbound sockets per destination, and a translation table maps
+// each peer to the outbound socket and destination of its session and each
+// pair of outbound socket and destination back to the session. A destination
+// only sees the source port of the outbound socket, so each outbound socket
+// serves a single peer per destination at a time. Outbound sockets are
+// created when all sockets of a destination are in use and are reused by
+// later sessions. In contrast to udpForwarderMap, there are no packet queues
+// and forwarding goroutines per peer; each outbound socket is read by a
+// single goroutine and idle sessions are removed by a single goroutine for
+// all sessions
+type udpNAT struct {
+	mutex       sync.Mutex
+	srvConn     *net.UDPConn
+	pool        *servicePool
+	opts        *serviceOptions
+	idleTimeout time.Duration
+	// maxSockets is the maximum number of outbound sockets per member
+	maxSockets int
+	// socks are the outbound sockets of the members
+	socks map[*poolMember][]*udpNATSocket
+	// peers and dsts are the translation table, they map peer addresses
+	// and pairs of outbound socket and destination to sessions
+	peers map[netip.AddrPort]*udpNATSession
+	dsts  map[udpNATKey]*udpNATSession
+	// lru orders the sessions by their last activity, the most recently
+	// used session is at the front
+	lru   *list.List
+	drops atomic.Uint64
+	done  chan struct{}
+	// log is the logger for log messages of the nat
+	log *slog.Logger
+}
+
+// udpNATSession is a session of a peer with a destination in an udp nat
+type udpNATSession struct {
+	member *poolMember
+	sock   *udpNATSocket
+	key    udpNATKey
+	elem   *list.Element
+	peer   netip.AddrPort
+	last   time.Time
+	log    *slog.Logger
+	// bytes counts the bytes forwarded from and to the peer
+	bytes  [2]atomic.Int64
+	access *accessRecord
+}
+
+// unmapAddrPort returns addr with an unmapped IPv4 address
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// socket returns an outbound socket of member that is not used by another
+// session with the destination dst, it creates a new socket if all sockets
+// of member are in use and the maximum number of sockets is not reached.
+// The caller must hold the mutex
+func (u *udpNAT) socket(member *poolMember, dst netip.AddrPort) *udpNATSocket {
+	for _, sock := range u.socks[member] {
+		if u.dsts[udpNATKey{sock.port, dst}] == nil {
+			return sock
+		}
+	}
+	if len(u.socks[member]) >= u.maxSockets {
+		return nil
+	}
+	select {
+	case <-u.done:
+		// nat stopped, do not create new sockets
+		return nil
+	default:
+	}
+	srcAddr, _ := member.udpAddrs()
+	conn, err := net.ListenUDP("udp", srcAddr)
+	if err != nil {
+		member.owner.log().Warn("Could not create udp socket", "error",
+			err)
+		return nil
+	}
+	sock := &udpNATSocket{
+		conn: conn,
+		port: uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+	}
+	u.socks[member] = append(u.socks[member], sock)
+	go u.run(sock)
+	return sock
+}
+
+// pick selects a destination for peer from the pool with an outbound socket
+// that is not used by another session with this destination and returns
+// its member, the outbound socket and the destination address, the caller
+// must hold the mutex
+func (u *udpNAT) pick(peer netip.AddrPort) (*poolMember, *udpNATSocket,
+	netip.AddrPort) {
+	// try each member at most once, the pool strategy selects them
+	for i := u.pool.count(); i > 0; i-- {
+		member := u.pool.pick(peer.Addr().AsSlice())
+		if member == nil {
+			break
+		}
+		_, dstAddr := member.udpAddrs()
+		dst := unmapAddrPort(dstAddr.AddrPort())
+		if sock := u.socket(member, dst); sock != nil {
+			return member, sock, dst
+		}
+	}
+	return nil, nil, netip.AddrPort{}
+}
+
+// get returns the session for peer, the caller must hold the mutex
+func (u *udpNAT) get(peer netip.AddrPort) *udpNATSession {
+	s := u.peers[peer]
+	if s != nil {
+		// re-use existing session
+		s.last = time.Now()
+		u.lru.MoveToFront(s.elem)
+		return s
+	}
+
+	// if the maximum number of sessions is reached, remove the least
+	// recently used session
+	if u.opts.maxSessions > 0 && len(u.peers) >= u.opts.maxSessions {
+		old := u.lru.Back().Value.(*udpNATSession)
+		old.log.Info("Evicting udp session, maximum sessions reached")
+		u.remove(old, closeReasonEvicted)
+	}
+
+	// select a destination and a free outbound socket for this peer
+	member, sock, dst := u.pick(peer)
+	if member == nil {
+		u.log.Debug("No free socket for udp session", "peer",
+			peer.String())
+		return nil
+	}
+
+	// create a new session for this peer
+	s = &udpNATSession{
+		member: member,
+		sock:   sock,
+		key:    udpNATKey{sock.port, dst},
+		peer:   peer,
+		last:   time.Now(),
+	}
+	s.log = member.owner.log().With("protocol", "udp", "port", u.port(),
+		"dest_port", member.dstPort, "peer", peer.String())
+	s.access = member.newAccessRecord("udp", u.port(),
+		net.UDPAddrFromAddrPort(peer))
+	member.conns.Add(1)
+	s.elem = u.lru.PushFront(s)
+	u.peers[peer] = s
+	u.dsts[s.key] = s
+	s.log.Debug("New udp session", "sessions", len(u.peers))
+	member.owner.publishPeer(EventPeerConnected, "udp", u.port(),
+		member.dstPort, net.UDPAddrFromAddrPort(peer), [2]int64{})
+	return s
+}
+
+// remove removes session s because of reason, the caller must hold the mutex
+func (u *udpNAT) remove(s *udpNATSession, reason string) {
+	if s.elem == nil {
+		// already removed
+		return
+	}
+	u.lru.Remove(s.elem)
+	s.elem = nil
+	delete(u.peers, s.peer)
+	delete(u.dsts, s.key)
+	s.member.conns.Add(-1)
+	bytes := [2]int64{s.bytes[0].Load(), s.bytes[1].Load()}
+	s.member.owner.publishPeer(EventPeerDisconnected, "udp", u.port(),
+		s.member.dstPort, net.UDPAddrFromAddrPort(s.peer), bytes)
+	s.access.close(bytes, reason)
+}
+
+// port returns the port of the udp service
+func (u *udpNAT) port() int {
+	return u.srvConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// forward forwards the packet data from peer to the proxy destination
+func (u *udpNAT) forward(peer netip.AddrPort, data []byte) {
+	u.mutex.Lock()
+	s := u.get(peer)
+	u.mutex.Unlock()
+	if s == nil {
+		// could not create session, drop packet
+		u.drops.Add(1)
+		return
+	}
+	if _, err := s.sock.conn.WriteToUDPAddrPort(data,
+		s.key.dst); err != nil {
+		s.log.Debug("Could not send packet to destination", "error",
+			err)
+		u.drops.Add(1)
+		return
+	}
+	s.bytes[0].Add(int64(len(data)))
+}
+
+// reply forwards the packet data from the proxy destination to the peer of
+// the session with key
+func (u *udpNAT) reply(key udpNATKey, data []byte) {
+	u.mutex.Lock()
+	s := u.dsts[key]
+	if s == nil {
+		// no session with this socket and destination, drop packet
+		u.mutex.Unlock()
+		u.drops.Add(1)
+		return
+	}
+	s.last = time.Now()
+	u.lru.MoveToFront(s.elem)
+	u.mutex.Unlock()
+
+	if _, err := u.srvConn.WriteToUDPAddrPort(data, s.peer); err != nil {
+		s.log.Debug("Could not send packet to peer", "error", err)
+		u.drops.Add(1)
+		return
+	}
+	s.bytes[1].Add(int64(len(data)))
+}
+
+// run reads packets from the outbound socket sock and forwards packets from
+// the proxy destinations to the peers until the socket is closed
+func (u *udpNAT) run(sock *udpNATSocket) {
+	buf := make([]byte, udpReadBufferLen)
+	for {
+		n, addr, err := sock.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		addr = unmapAddrPort(addr)
+		if isTruncated(buf, n) {
+			u.log.Debug("Dropping truncated udp packet", "addr",
+				addr.String())
+			u.drops.Add(1)
+			continue
+		}
+		u.reply(udpNATKey{sock.port, addr}, buf[:n])
+	}
+}
+
+// cleanup periodically removes sessions without traffic within the idle
+// timeout until the nat is stopped
+func (u *udpNAT) cleanup() {
+	ticker := time.NewTicker(u.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-u.done:
+			return
+		}
+
+		// remove idle sessions starting with the least recently used
+		u.mutex.Lock()
+		for u.lru.Len() > 0 {
+			s := u.lru.Back().Value.(*udpNATSession)
+			if time.Since(s.last) < u.idleTimeout {
+				break
+			}
+			s.log.Debug("Cleaning up idle udp session")
+			u.remove(s, closeReasonIdle)
+		}
+		u.mutex.Unlock()
+	}
+}
+
+// count returns the number of active sessions
+func (u *udpNAT) count() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return len(u.peers)
+}
+
+// dropCount returns the number of dropped packets
+func (u *udpNAT) dropCount() uint64 {
+	return u.drops.Load()
+}
+
+// closeMember closes the sessions and the outbound sockets of member because
+// of reason
+func (u *udpNAT) closeMember(member *poolMember, reason string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, s := range u.peers {
+		if s.member == member {
+			u.remove(s, reason)
+		}
+	}
+	for _, sock := range u.socks[member] {
+		sock.conn.Close()
+	}
+	delete(u.socks, member)
+}
+
+// stopAll stops all sessions and the nat
+func (u *udpNAT) stopAll() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	select {
+	case <-u.done:
+	default:
+		close(u.done)
+	}
+	for _, s := range u.peers {
+		u.remove(s, closeReasonStopped)
+	}
+	for member, socks := range u.socks {
+		for _, sock := range socks {
+			sock.conn.Close()
+		}
+		delete(u.socks, member)
+	}
+}
+
+// newUDPNAT creates a new udp nat for the udp service conn with the
+// destinations in pool, the service options opts and the logger log. The
+// outbound sockets are bound to the source address of the destinations
+func newUDPNAT(srvConn *net.UDPConn, pool *servicePool,
+	opts *serviceOptions, log *slog.Logger) *udpNAT {
+	idleTimeout := opts.idleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	maxSockets := opts.natSockets
+	if maxSockets == 0 {
+		maxSockets = defaultUDPNATSockets
+	}
+	u := udpNAT{
+		srvConn:     srvConn,
+		pool:        pool,
+		opts:        opts,
+		idleTimeout: idleTimeout,
+		maxSockets:  maxSockets,
+		socks:       make(map[*poolMember][]*udpNATSocket),
+		peers:       make(map[netip.AddrPort]*udpNATSession),
+		dsts:        make(map[udpNATKey]*udpNATSession),
+		lru:         list.New(),
+		done:        make(chan struct{}),
+		log:         log,
+	}
+	go u.cleanup()
+	return &u
+}
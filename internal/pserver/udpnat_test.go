@@ -0,0 +1,220 @@
+package pserver
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testUDPNATPool creates a service pool with the service options opts and n
+// destination sockets as members, the caller must close the sockets
+func testUDPNATPool(opts *serviceOptions, n int) (*servicePool,
+	[]*net.UDPConn) {
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	var pool *servicePool
+	var dstConns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		dstConn, err := net.ListenUDP("udp", &udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dstConns = append(dstConns, dstConn)
+		member := testPoolMember(udpAddr.IP,
+			dstConn.LocalAddr().(*net.UDPAddr))
+		if pool == nil {
+			pool = newServicePool("", opts, member)
+			continue
+		}
+		pool.add(member)
+	}
+	return pool, dstConns
+}
+
+// testUDPNAT creates an udp nat with the service options opts and n
+// destination sockets, the caller must stop the nat and close all sockets
+func testUDPNAT(opts *serviceOptions, n int) (*udpNAT, *net.UDPConn,
+	[]*net.UDPConn) {
+	srvConn, err := net.ListenUDP("udp",
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool, dstConns := testUDPNATPool(opts, n)
+	nat := newUDPNAT(srvConn, pool, opts, slog.Default())
+	return nat, srvConn, dstConns
+}
+
+// testCloseUDPConns closes all udp sockets in conns
+func testCloseUDPConns(conns []*net.UDPConn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func TestUDPNATMaxSessions(t *testing.T) {
+	nat, srvConn, dstConns := testUDPNAT(&serviceOptions{maxSessions: 2},
+		1)
+	defer srvConn.Close()
+	defer testCloseUDPConns(dstConns)
+	defer nat.stopAll()
+
+	// create sessions for peers, first peer should be evicted
+	peers := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:1001"),
+		netip.MustParseAddrPort("127.0.0.1:1002"),
+		netip.MustParseAddrPort("127.0.0.1:1003"),
+	}
+	for _, p := range peers {
+		nat.forward(p, []byte{1})
+	}
+	if got, want := nat.count(), 2; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if nat.peers[peers[0]] != nil {
+		t.Errorf("least recently used session not evicted")
+	}
+
+	// check the packets arrived from two outbound sockets, the socket of
+	// the evicted session is reused
+	ports := make(map[int]bool)
+	buf := make([]byte, 16)
+	for range peers {
+		dstConns[0].SetReadDeadline(time.Now().Add(time.Second))
+		_, addr, err := dstConns[0].ReadFromUDP(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ports[addr.Port] = true
+	}
+	if got, want := len(ports), 2; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestUDPNATMaxSockets(t *testing.T) {
+	nat, srvConn, dstConns := testUDPNAT(&serviceOptions{natSockets: 1},
+		1)
+	defer srvConn.Close()
+	defer testCloseUDPConns(dstConns)
+	defer nat.stopAll()
+
+	// second peer cannot use the only socket of the destination
+	nat.forward(netip.MustParseAddrPort("127.0.0.1:1001"), []byte{1})
+	nat.forward(netip.MustParseAddrPort("127.0.0.1:1002"), []byte{2})
+	if got, want := nat.count(), 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := nat.dropCount(), uint64(1); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestUDPNATReplies(t *testing.T) {
+	nat, srvConn, dstConns := testUDPNAT(&serviceOptions{}, 1)
+	defer srvConn.Close()
+	defer testCloseUDPConns(dstConns)
+	defer nat.stopAll()
+
+	// create peers and send a packet from each peer to the destination
+	var peers []*net.UDPConn
+	for i := 0; i < 10; i++ {
+		peer, err := net.ListenUDP("udp",
+			&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer peer.Close()
+		peers = append(peers, peer)
+		nat.forward(peer.LocalAddr().(*net.UDPAddr).AddrPort(),
+			[]byte{byte(i)})
+	}
+	if got, want := nat.count(), len(peers); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	// echo packets at the destination
+	buf := make([]byte, 16)
+	for range peers {
+		dstConns[0].SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := dstConns[0].ReadFromUDP(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dstConns[0].WriteToUDP(buf[:n], addr)
+	}
+
+	// check that each peer received its reply
+	for i, peer := range peers {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		want := []byte{byte(i)}
+		if got := buf[:n]; !bytes.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestUDPNATIdleTimeout(t *testing.T) {
+	nat, srvConn, dstConns := testUDPNAT(&serviceOptions{
+		idleTimeout: 100 * time.Millisecond,
+		natSockets:  1,
+	}, 1)
+	defer srvConn.Close()
+	defer testCloseUDPConns(dstConns)
+	defer nat.stopAll()
+
+	// create session and wait for idle timeout
+	nat.forward(netip.MustParseAddrPort("127.0.0.1:1001"), []byte{1})
+	if got, want := nat.count(), 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	for i := 0; i < 100 && nat.count() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := nat.count(), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	// socket is free for the next peer
+	nat.forward(netip.MustParseAddrPort("127.0.0.1:1002"), []byte{1})
+	if got, want := nat.count(), 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestUDPNATPeerEvents(t *testing.T) {
+	nat, srvConn, dstConns := testUDPNAT(&serviceOptions{}, 1)
+	defer srvConn.Close()
+	defer testCloseUDPConns(dstConns)
+	defer nat.stopAll()
+
+	// subscribe to the events of the destination's owner
+	var b eventBus
+	ch := b.subscribe(nil)
+	nat.pool.members[0].owner = &client{events: &b}
+
+	// create and stop session
+	peer := netip.MustParseAddrPort("127.0.0.1:1001")
+	nat.forward(peer, []byte{1, 2, 3})
+	nat.stopAll()
+
+	// check connected and disconnected events with byte counts
+	for _, want := range []Event{
+		{Type: EventPeerConnected},
+		{Type: EventPeerDisconnected, BytesFromPeer: 3},
+	} {
+		e := <-ch
+		if e.Type != want.Type || e.Protocol != "udp" ||
+			e.Peer != peer.String() ||
+			e.BytesFromPeer != want.BytesFromPeer {
+			t.Errorf("got %+v, want %+v", e, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package pserver
+
+import (
+	"sync"
+)
+
+const (
+	// udpReadBufferLen is the length of buffers for reading udp packets.
+	// It is larger than the maximum udp payload, so reading a packet that
+	// fills the whole buffer means the packet has been truncated
+	udpReadBufferLen = 65536
+	// udpSmallPacketLen is the length of buffers for small udp packets
+	udpSmallPacketLen = 2048
+)
+
+var (
+	// udpSmallPackets is a pool of udp packets with small buffers
+	udpSmallPackets = sync.Pool{
+		New: func() any {
+			return &udpPacket{buf: make([]byte, udpSmallPacketLen)}
+		},
+	}
+	// udpLargePackets is a pool of udp packets with large buffers
+	udpLargePackets = sync.Pool{
+		New: func() any {
+			return &udpPacket{buf: make([]byte, udpReadBufferLen)}
+		},
+	}
+)
+
+// udpPacket stores an udp packet in a pooled buffer
+type udpPacket struct {
+	buf []byte
+	n   int
+}
+
+// data returns the data of the udp packet
+func (u *udpPacket) data() []byte {
+	return u.buf[:u.n]
+}
+
+// free returns the udp packet to its pool, it must not be used afterwards
+func (u *udpPacket) free() {
+	if len(u.buf) == udpSmallPacketLen {
+		udpSmallPackets.Put(u)
+		return
+	}
+	udpLargePackets.Put(u)
+}
+
+// newUDPPacket returns an udp packet from a pool that contains a copy of data
+func newUDPPacket(data []byte) *udpPacket {
+	var p *udpPacket
+	if len(data) <= udpSmallPacketLen {
+		p = udpSmallPackets.Get().(*udpPacket)
+	} else {
+		p = udpLargePackets.Get().(*udpPacket)
+	}
+	p.n = copy(p.buf, data)
+	return p
+}
+
+// isTruncated checks if an udp packet with length n read into buf has been
+// truncated
+func isTruncated(buf []byte, n int) bool {
+	return n >= len(buf)
+}
@@ -0,0 +1,39 @@
+package pserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewUDPPacket(t *testing.T) {
+	for _, test := range []struct {
+		size   int
+		bufLen int
+	}{
+		{0, udpSmallPacketLen},
+		{udpSmallPacketLen, udpSmallPacketLen},
+		{udpSmallPacketLen + 1, udpReadBufferLen},
+		{udpReadBufferLen - 1, udpReadBufferLen},
+	} {
+		data := bytes.Repeat([]byte{1}, test.size)
+		p := newUDPPacket(data)
+		if !bytes.Equal(p.data(), data) {
+			t.Errorf("got %d bytes, want %d bytes", len(p.data()),
+				len(data))
+		}
+		if len(p.buf) != test.bufLen {
+			t.Errorf("got %d, want %d", len(p.buf), test.bufLen)
+		}
+		p.free()
+	}
+}
+
+func TestIsTruncated(t *testing.T) {
+	buf := make([]byte, udpReadBufferLen)
+	if isTruncated(buf, 65507) {
+		t.Errorf("got true, want false")
+	}
+	if !isTruncated(buf, udpReadBufferLen) {
+		t.Errorf("got false, want true")
+	}
+}
@@ -1,20 +1,24 @@
 package pserver
 
 import (
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
-)
 
-var (
-	// udpServices stores all active udp services identified by port
-	udpServices udpServiceMap
+	"github.com/hwipl/service-proxy/internal/network"
 )
 
-// udpServiceMap stores active udp services identified by port
+// udpServiceMap stores the active udp services of a control server
+// identified by port
 type udpServiceMap struct {
 	m sync.Mutex
 	u map[int]*udpService
+	// standby stores the standby services of ports
+	standby standbyQueue
+	// logger is the logger for log messages of the services
+	logger *sharedLogger
 }
 
 // add adds the service entry identified by port to the udpServiceMap and
@@ -33,6 +37,14 @@ func (u *udpServiceMap) add(port int, service *udpService) bool {
 	return false
 }
 
+// count returns the number of active services in the udpServiceMap
+func (u *udpServiceMap) count() int {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	return len(u.u)
+}
+
 // del removes the service identified by port from the udpServiceMap
 func (u *udpServiceMap) del(port int) {
 	u.m.Lock()
@@ -41,6 +53,124 @@ func (u *udpServiceMap) del(port int) {
 	delete(u.u, port)
 }
 
+// joinOrQueue adds member to the pool of the service identified by port, if
+// the service exists and its pool has the name pool, and returns the service.
+// If the service exists with another pool, member is queued as standby with
+// the service options opts and its position in the standby queue is returned.
+// If the service does not exist, it returns nil and 0
+func (u *udpServiceMap) joinOrQueue(port int, pool string, member *poolMember,
+	opts *serviceOptions) (*udpService, int) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	s := u.u[port]
+	if s == nil {
+		return nil, 0
+	}
+	if pool != "" && s.pool.name == pool {
+		s.pool.add(member)
+		return s, 0
+	}
+	if u.standby == nil {
+		u.standby = make(standbyQueue)
+	}
+	return nil, u.standby.push(port, &standbyService{
+		pool:   pool,
+		member: member,
+		opts:   opts,
+	})
+}
+
+// leave removes the pool member or the standby service of owner from the
+// service identified by port. It returns the service and the removed member
+// or, if owner has a standby service, nil and the removed member. If the
+// service has no remaining members, it is replaced by the next standby
+// service, if there is one, that is returned as next and must be started
+func (u *udpServiceMap) leave(port int, owner *client) (s *udpService,
+	m *poolMember, next *udpService) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if standby := u.standby.remove(port, owner); standby != nil {
+		return nil, standby.member, nil
+	}
+	s = u.u[port]
+	if s == nil {
+		return nil, nil, nil
+	}
+	m, remaining := s.pool.remove(owner)
+	if m == nil || remaining > 0 {
+		return s, m, nil
+	}
+	return s, m, u.promote(s)
+}
+
+// fail removes the service s that could not be started and returns the next
+// standby service, if there is one, that replaces it and must be started
+func (u *udpServiceMap) fail(s *udpService) *udpService {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	return u.promote(s)
+}
+
+// promote replaces the service s with the next standby service and returns
+// it; if there is no standby service, s is removed and nil is returned. The
+// caller must hold the mutex
+func (u *udpServiceMap) promote(s *udpService) *udpService {
+	port := s.srvAddr.Port
+	standby := u.standby.pop(port)
+	if standby == nil {
+		delete(u.u, port)
+		return nil
+	}
+	next := newUDPService(u, s.srvAddr, newStandbyPool(standby),
+		standby[0].opts)
+	u.u[port] = next
+	return next
+}
+
+// standbyCount returns the number of standby services on port
+func (u *udpServiceMap) standbyCount(port int) int {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	return u.standby.count(port)
+}
+
+// stats returns the statistics of the active services ordered by port
+func (u *udpServiceMap) stats() []UDPServiceStats {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	var stats []UDPServiceStats
+	for port, s := range u.u {
+		stats = append(stats, UDPServiceStats{
+			Port:     port,
+			Sessions: s.sessionCount(),
+			Drops:    s.dropCount(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Port < stats[j].Port
+	})
+	return stats
+}
+
+// sessionStats returns the number of active sessions and the number of
+// dropped packets of all services
+func (u *udpServiceMap) sessionStats() (int, uint64) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	n, drops := 0, uint64(0)
+	for _, s := range u.u {
+		n += s.sessionCount()
+		drops += s.dropCount()
+	}
+	return n, drops
+}
+
 // get gets the service identified by port from the udpServiceMap
 func (u *udpServiceMap) get(port int) *udpService {
 	u.m.Lock()
@@ -49,66 +179,206 @@ func (u *udpServiceMap) get(port int) *udpService {
 	return u.u[port]
 }
 
+// udpSessions forwards packets between the peers of an udp service and the
+// proxy destination and manages the sessions of the peers
+type udpSessions interface {
+	// forward forwards the packet data from peer to the destination
+	forward(peer netip.AddrPort, data []byte)
+	// count returns the number of active sessions
+	count() int
+	// dropCount returns the number of dropped packets
+	dropCount() uint64
+	// closeMember closes the sessions with the destination of member
+	// because of reason, so their peers select a new destination
+	closeMember(member *poolMember, reason string)
+	// stopAll stops all sessions
+	stopAll()
+}
+
+// newUDPSessions creates udp sessions for the udp service conn with the
+// destinations in pool, the service options opts and the logger log
+func newUDPSessions(conn *net.UDPConn, pool *servicePool,
+	opts *serviceOptions, log *slog.Logger) udpSessions {
+	if opts.udpNAT {
+		return newUDPNAT(conn, pool, opts, log)
+	}
+	return newUDPForwarderMap(conn, pool, opts)
+}
+
 // udpService stores udp service proxy information
 type udpService struct {
-	srvAddr *net.UDPAddr
-	conn    *net.UDPConn
-	srcAddr *net.UDPAddr
-	dstAddr *net.UDPAddr
-	fwds    *udpForwarderMap
+	services *udpServiceMap
+	srvAddr  *net.UDPAddr
+	conn     *net.UDPConn
+	pool     *servicePool
+	opts     *serviceOptions
+
+	// mutex protects fwds, which is set when the service is started
+	mutex sync.Mutex
+	fwds  udpSessions
 }
 
 // runService runs the udp service proxy
 func (u *udpService) runService() {
 	defer u.conn.Close()
-	u.fwds = newUDPForwarderMap(u.conn, u.srcAddr, u.dstAddr)
+	buf := make([]byte, udpReadBufferLen)
 	for {
 		// read packet from socket
-		buf := make([]byte, 2048)
-		n, addr, err := u.conn.ReadFromUDP(buf)
+		n, addr, err := u.conn.ReadFromUDPAddrPort(buf)
 		if err != nil {
 			return
 		}
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if isTruncated(buf, n) {
+			u.services.logger.Debug("Dropping truncated udp "+
+				"packet", "peer", addr.String())
+			continue
+		}
 
-		// get forwarder for peer address and forward packet
-		fwd := u.fwds.get(addr)
-		fwd.forward(buf[:n])
+		// forward packet in the session of the peer
+		u.fwds.forward(addr, buf[:n])
 	}
 }
 
 // stopService stops the udp service proxy
 func (u *udpService) stopService() {
 	u.conn.Close()
-	u.fwds.stopAll()
+	u.sessions().stopAll()
+}
+
+// sessions returns the sessions of the udp service or nil if the service is
+// not started
+func (u *udpService) sessions() udpSessions {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.fwds
 }
 
-// runUDPService runs an udp service proxy that listens on srvAddr and forwards
-// incomming packets to dstAddr
-func runUDPService(srvAddr, srcAddr, dstAddr *net.UDPAddr) *udpService {
-	// create service
-	srv := udpService{
-		srvAddr: srvAddr,
-		srcAddr: srcAddr,
-		dstAddr: dstAddr,
+// closeMember closes the sessions of the udp service with the destination of
+// member because of reason
+func (u *udpService) closeMember(member *poolMember, reason string) {
+	if s := u.sessions(); s != nil {
+		s.closeMember(member, reason)
 	}
+}
 
-	if udpServices.add(srvAddr.Port, &srv) {
-		// create udp listener/udp conn
-		conn, err := net.ListenUDP("udp", srvAddr)
-		if err != nil {
-			log.Printf("Could not create udp service %s<->%s: %s\n",
-				srvAddr, dstAddr, err)
-			udpServices.del(srvAddr.Port)
-			return nil
-		}
-		srv.conn = conn
+// sessionCount returns the number of active sessions of the udp service
+func (u *udpService) sessionCount() int {
+	if s := u.sessions(); s != nil {
+		return s.count()
+	}
+	return 0
+}
 
-		// run service
-		go srv.runService()
-		return &srv
+// dropCount returns the number of packets dropped by the udp service
+func (u *udpService) dropCount() uint64 {
+	if s := u.sessions(); s != nil {
+		return s.dropCount()
 	}
+	return 0
+}
 
-	log.Printf("Could not create udp service %s<->%s: service already "+
-		"active\n", srvAddr, dstAddr)
+// startService creates the socket of the udp service proxy and runs it
+func (u *udpService) startService() error {
+	conn, err := net.ListenUDP("udp", u.srvAddr)
+	if err != nil {
+		return err
+	}
+	log := u.services.logger.get().With("protocol", "udp", "port",
+		conn.LocalAddr().(*net.UDPAddr).Port)
+	u.conn = conn
+	u.mutex.Lock()
+	u.fwds = newUDPSessions(conn, u.pool, u.opts, log)
+	u.mutex.Unlock()
+	go u.runService()
 	return nil
 }
+
+// startStandbyUDPService starts the udp service srv that replaced a stopped
+// service and tells the owners of its members that they are active. If the
+// service cannot be started, its owners are told that their services are
+// removed and the next standby service is started
+func startStandbyUDPService(srv *udpService) {
+	for srv != nil {
+		port := srv.srvAddr.Port
+		log := srv.services.logger.get().With("protocol", "udp",
+			"port", port)
+		log.Info("Promoting standby service", "members",
+			srv.pool.count(), "standby",
+			srv.services.standbyCount(port))
+		if err := srv.startService(); err != nil {
+			log.Warn("Could not start standby service", "error",
+				err)
+			srv.pool.notify(network.MessageDel, network.ProtocolUDP,
+				port)
+			srv.pool.stopHealthChecks()
+			srv = srv.services.fail(srv)
+			continue
+		}
+		log.Info("Standby service is active")
+		srv.pool.notify(network.MessageActive, network.ProtocolUDP,
+			port)
+		return
+	}
+}
+
+// newUDPService creates a new udp service proxy in services on srvAddr with
+// the destinations in pool and the service options opts
+func newUDPService(services *udpServiceMap, srvAddr *net.UDPAddr,
+	pool *servicePool, opts *serviceOptions) *udpService {
+	return &udpService{
+		services: services,
+		srvAddr:  srvAddr,
+		pool:     pool,
+		opts:     opts,
+	}
+}
+
+// runUDPService runs an udp service proxy in services that listens on srvAddr
+// and forwards incomming packets to the destination of member using the
+// service options opts. If pool is not empty and the service is already
+// running with the same pool name, member joins the pool of the running
+// service. If the service is already running with another pool, member is
+// queued as standby and standby is true
+func runUDPService(services *udpServiceMap, srvAddr *net.UDPAddr,
+	pool string, member *poolMember, opts *serviceOptions) (
+	srv *udpService, standby bool) {
+	srv = newUDPService(services, srvAddr, newServicePool(pool, opts,
+		member), opts)
+	log := member.owner.log().With("protocol", "udp", "port",
+		srvAddr.Port, "dest_port", member.dstPort)
+
+	for {
+		if services.add(srvAddr.Port, srv) {
+			// create udp listener/udp conn and run service
+			if err := srv.startService(); err != nil {
+				log.Warn("Could not create service", "error",
+					err)
+				srv.pool.remove(member.owner)
+				srv.pool.notify(network.MessageDel,
+					network.ProtocolUDP, srvAddr.Port)
+				srv.pool.stopHealthChecks()
+				startStandbyUDPService(services.fail(srv))
+				return nil, false
+			}
+			return srv, false
+		}
+
+		// service already active, try joining its pool or queue as
+		// standby
+		s, n := services.joinOrQueue(srvAddr.Port, pool, member,
+			opts)
+		if s != nil {
+			log.Info("Joined pool of service", "pool", pool,
+				"members", s.pool.count())
+			return s, false
+		}
+		if n > 0 {
+			log.Info("Queued service as standby", "standby", n)
+			return nil, true
+		}
+
+		// service stopped in the meantime, try again
+	}
+}
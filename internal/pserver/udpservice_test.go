@@ -0,0 +1,431 @@
+package pserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testUDPEchoServer creates an udp server that echoes all packets, the
+// caller must close the socket
+func testUDPEchoServer() *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, udpReadBufferLen)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// testUDPService creates an udp service with the service options opts and a
+// destination that echoes packets and returns a peer connected to the service
+// and a function that stops everything
+func testUDPService(opts *serviceOptions) (*net.UDPConn, func()) {
+	// create destination that echoes packets
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	dstConn := testUDPEchoServer()
+
+	// create service
+	member := testPoolMember(udpAddr.IP, dstConn.LocalAddr().(*net.UDPAddr))
+	srv, _ := runUDPService(&udpServiceMap{}, &udpAddr, "", member, opts)
+	if srv == nil {
+		log.Fatal("could not create udp service")
+	}
+
+	// create peer
+	peer, err := net.DialUDP("udp", &udpAddr,
+		srv.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop := func() {
+		peer.Close()
+		srv.stopService()
+		dstConn.Close()
+	}
+	return peer, stop
+}
+
+// testUDPEcho sends data to the peer connection and reads the reply into buf
+func testUDPEcho(peer *net.UDPConn, data, buf []byte) (int, error) {
+	if _, err := peer.Write(data); err != nil {
+		return 0, err
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	return peer.Read(buf)
+}
+
+func TestUDPServiceLargePackets(t *testing.T) {
+	for _, mode := range []string{"socket", "nat"} {
+		opts := &serviceOptions{}
+		opts.set("mode", mode)
+		peer, stop := testUDPService(opts)
+
+		// test a small packet and packets larger than small buffers up
+		// to the maximum size
+		buf := make([]byte, udpReadBufferLen)
+		for _, size := range []int{64, udpSmallPacketLen + 1, 32768,
+			65507} {
+			want := bytes.Repeat([]byte{1, 2, 3, 4}, size/4+1)
+			want = want[:size]
+			n, err := testUDPEcho(peer, want, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := buf[:n]
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: got %d bytes, want %d bytes",
+					mode, len(got), len(want))
+			}
+		}
+		stop()
+	}
+}
+
+func TestUDPServiceDialError(t *testing.T) {
+	// create service with a source address that cannot be used to
+	// create destination sockets
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	member := testPoolMember(net.IPv4(192, 0, 2, 1), &udpAddr)
+	var services udpServiceMap
+	srv, _ := runUDPService(&services, &udpAddr, "", member,
+		&serviceOptions{})
+	if srv == nil {
+		log.Fatal("could not create udp service")
+	}
+	defer srv.stopService()
+
+	// send packet to service and check that it is dropped
+	peer, err := net.DialUDP("udp", &udpAddr,
+		srv.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := peer.Write([]byte{1, 2, 3}); err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < 100 && srv.dropCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := srv.dropCount(), uint64(1); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := srv.sessionCount(), 0; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	// check drops in the statistics of the running service
+	want := []UDPServiceStats{{Drops: 1}}
+	if got := services.stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, got := services.sessionStats(); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+func TestUDPSessionsCloseMember(t *testing.T) {
+	srvConn, err := net.ListenUDP("udp",
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srvConn.Close()
+
+	for _, mode := range []string{"socket", "nat"} {
+		// create sessions with a pool of two destinations
+		opts := &serviceOptions{}
+		opts.set("mode", mode)
+		pool, dstConns := testUDPNATPool(opts, 2)
+		for _, m := range pool.members {
+			m.owner = &client{}
+		}
+		sessions := newUDPSessions(srvConn, pool, opts,
+			slog.Default())
+
+		// create session of peer with the first destination
+		peer := netip.MustParseAddrPort("127.0.0.1:1001")
+		sessions.forward(peer, []byte{1})
+		first, second := pool.members[0], pool.members[1]
+		if got, want := first.conns.Load(), int64(1); got != want {
+			t.Errorf("%s: got %d, want %d", mode, got, want)
+		}
+
+		// remove first destination, the peer gets a new session with
+		// the second destination
+		pool.remove(first.owner)
+		sessions.closeMember(first, closeReasonRemoved)
+		if got, want := sessions.count(), 0; got != want {
+			t.Errorf("%s: got %d, want %d", mode, got, want)
+		}
+		sessions.forward(peer, []byte{2})
+		if got, want := second.conns.Load(), int64(1); got != want {
+			t.Errorf("%s: got %d, want %d", mode, got, want)
+		}
+
+		sessions.stopAll()
+		testCloseUDPConns(dstConns)
+	}
+}
+
+func TestUDPServiceMapStats(t *testing.T) {
+	// create destination and service
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	dstConn, err := net.ListenUDP("udp", &udpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dstConn.Close()
+	srvConn, err := net.ListenUDP("udp", &udpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srvAddr := srvConn.LocalAddr().(*net.UDPAddr)
+	srvConn.Close()
+	var services udpServiceMap
+	member := testPoolMember(udpAddr.IP, dstConn.LocalAddr().(*net.UDPAddr))
+	srv, _ := runUDPService(&services, srvAddr, "", member,
+		&serviceOptions{})
+	if srv == nil {
+		log.Fatal("could not create udp service")
+	}
+	defer srv.stopService()
+
+	// send packet from peer and wait until it reaches the destination
+	peer, err := net.DialUDP("udp", &udpAddr, srvAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := peer.Write([]byte{1}); err != nil {
+		log.Fatal(err)
+	}
+	dstConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := dstConn.ReadFromUDP(make([]byte, 16)); err != nil {
+		log.Fatal(err)
+	}
+
+	// check statistics of the running service
+	want := []UDPServiceStats{{
+		Port:     srvAddr.Port,
+		Sessions: 1,
+	}}
+	if got := services.stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, _ := services.sessionStats(); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+// testUDPServiceAlloc forwards packets between a peer and a destination that
+// echoes packets like the previous udp service and forwarder, that read each
+// packet into a new buffer of 2048 bytes and passed it over a channel, for
+// comparison in benchmarks. It returns the peer and a function that stops
+// everything
+func testUDPServiceAlloc() (*net.UDPConn, func()) {
+	// create destination that echoes packets, service socket and
+	// destination socket
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	echo := testUDPEchoServer()
+	srvConn, err := net.ListenUDP("udp", &udpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dstConn, err := net.DialUDP("udp", &udpAddr,
+		echo.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// read packets into new buffers and forward them over channels
+	type packet struct {
+		data []byte
+		addr *net.UDPAddr
+	}
+	srvData := make(chan packet)
+	dstData := make(chan []byte)
+	go func() {
+		for {
+			buf := make([]byte, 2048)
+			n, addr, err := srvConn.ReadFromUDP(buf)
+			if err != nil {
+				close(srvData)
+				return
+			}
+			srvData <- packet{buf[:n], addr}
+		}
+	}()
+	go func() {
+		for {
+			buf := make([]byte, 2048)
+			n, err := dstConn.Read(buf)
+			if err != nil {
+				close(dstData)
+				return
+			}
+			dstData <- buf[:n]
+		}
+	}()
+	go func() {
+		var peer *net.UDPAddr
+		for {
+			select {
+			case p, more := <-srvData:
+				if !more {
+					return
+				}
+				peer = p.addr
+				dstConn.Write(p.data)
+			case data, more := <-dstData:
+				if !more {
+					return
+				}
+				srvConn.WriteToUDP(data, peer)
+			}
+		}
+	}()
+
+	// create peer
+	peer, err := net.DialUDP("udp", &udpAddr,
+		srvConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop := func() {
+		peer.Close()
+		srvConn.Close()
+		dstConn.Close()
+		echo.Close()
+	}
+	return peer, stop
+}
+
+// benchmarkUDPService benchmarks forwarding packets of size bytes from a peer
+// to a destination and back through an udp service created with newService
+func benchmarkUDPService(b *testing.B, size int,
+	newService func() (*net.UDPConn, func())) {
+	peer, stop := newService()
+	defer stop()
+
+	// send packets to service and wait for replies
+	data := make([]byte, size)
+	buf := make([]byte, udpReadBufferLen)
+	b.SetBytes(int64(2 * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := testUDPEcho(peer, data, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != size {
+			b.Fatalf("got %d bytes, want %d", n, size)
+		}
+	}
+}
+
+// BenchmarkUDPService benchmarks the udp service with pooled buffers and, for
+// comparison, the previous udp service with a new buffer for each packet,
+// that only supports packets up to 2048 bytes
+func BenchmarkUDPService(b *testing.B) {
+	services := []struct {
+		name       string
+		maxSize    int
+		newService func() (*net.UDPConn, func())
+	}{
+		{"pooled", udpReadBufferLen, func() (*net.UDPConn, func()) {
+			return testUDPService(&serviceOptions{})
+		}},
+		{"alloc", 2048, testUDPServiceAlloc},
+	}
+	for _, s := range services {
+		for _, size := range []int{64, 1400, 32768} {
+			if size > s.maxSize {
+				continue
+			}
+			name := fmt.Sprintf("%s/%d", s.name, size)
+			b.Run(name, func(b *testing.B) {
+				benchmarkUDPService(b, size, s.newService)
+			})
+		}
+	}
+}
+
+// benchmarkUDPSessions benchmarks creating sessions for new peers in the
+// session mode
+func benchmarkUDPSessions(b *testing.B, mode string) {
+	// create service socket
+	udpAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	srvConn, err := net.ListenUDP("udp", &udpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srvConn.Close()
+
+	// create sessions of all peers with a single destination; limit the
+	// sessions to keep the number of sockets low
+	opts := &serviceOptions{maxSessions: 100}
+	opts.set("mode", mode)
+	pool, dstConns := testUDPNATPool(opts, 1)
+	defer testCloseUDPConns(dstConns)
+
+	// discard log messages of evicted sessions
+	var logger sharedLogger
+	logger.set(slog.NewTextHandler(io.Discard, nil), nil)
+	pool.members[0].owner = &client{logger: &logger}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	sessions := newUDPSessions(srvConn, pool, opts, logger.get())
+	defer sessions.stopAll()
+
+	// send a packet from a new peer in each iteration
+	data := []byte{1}
+	ip := netip.MustParseAddr("127.0.0.1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peer := netip.AddrPortFrom(ip, uint16(i%65535+1))
+		sessions.forward(peer, data)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "peers/s")
+
+	// measure memory of active sessions
+	time.Sleep(100 * time.Millisecond)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	mem := after.HeapInuse + after.StackInuse -
+		before.HeapInuse - before.StackInuse
+	b.ReportMetric(float64(mem)/float64(sessions.count()), "B/session")
+}
+
+func BenchmarkUDPSessions(b *testing.B) {
+	for _, mode := range []string{"socket", "nat"} {
+		b.Run(mode, func(b *testing.B) {
+			benchmarkUDPSessions(b, mode)
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Package server provides a service-proxy server that can be embedded in Go
+// programs
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/pserver"
+)
+
+var (
+	// ErrServerStarted is returned if a server is started more than once
+	ErrServerStarted = pserver.ErrServerStarted
+	// ErrServerClosed is returned if a server is started after it has
+	// been shut down
+	ErrServerClosed = pserver.ErrServerClosed
+)
+
+// Logger is a logger for log messages, e.g., a *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+	Println(v ...any)
+}
+
+// Identity is the identity of a client
+type Identity = pserver.Identity
+
+// Authenticator authenticates clients and returns their identities
+type Authenticator = pserver.Authenticator
+
+// Authorizer authorizes service registrations of clients
+type Authorizer = pserver.Authorizer
+
+// PortAllocator allocates ports for service registrations without port
+type PortAllocator = pserver.PortAllocator
+
+// UDPServiceStats are the runtime statistics of an udp service
+type UDPServiceStats = pserver.UDPServiceStats
+
+// Options are the options of a server. The entries of the lists use the
+// same format as the command line arguments of service-proxy
+type Options struct {
+	// Addr is the address the server listens on for control connections,
+	// e.g., ":32323"; if the port is 0, a free port is chosen
+	Addr string
+	// WebSocketAddr is the address of the http listener the server
+	// accepts websocket control connections on; if it is empty,
+	// websockets are not used
+	WebSocketAddr string
+	// TLSConfig is the tls configuration of the server; if it is nil,
+	// tls is not used
+	TLSConfig *tls.Config
+	// AllowedIPs are the IPs and networks the server accepts control
+	// connections from, e.g., "10.0.0.0/8"; if it is empty, no
+	// connections are accepted
+	AllowedIPs []string
+	// AllowedPorts are the protocol and port (range) pairs that are
+	// allowed in service registrations, e.g., "tcp:1024-65535"
+	AllowedPorts []string
+	// ServiceOptions are the service options for protocols and port
+	// ranges, e.g., "tcp:8000-8080:idle=5m"
+	ServiceOptions []string
+	// ForwardIPs are the IPs and networks clients can reach with local
+	// forwards through the server
+	ForwardIPs []string
+	// ForwardPorts are the protocol and port (range) pairs clients can
+	// reach with local forwards through the server
+	ForwardPorts []string
+	// ForwardPolicies are the forward policies of clients, e.g.,
+	// "alice=10.0.0.1;tcp:22"
+	ForwardPolicies []string
+	// Authenticator authenticates clients; if it is nil, clients are
+	// authenticated by AllowedIPs and identified by the common names of
+	// their tls certificates
+	Authenticator Authenticator
+	// Authorizer authorizes service registrations; if it is nil, the
+	// ports in AllowedPorts are allowed
+	Authorizer Authorizer
+	// AuthHook is the url of an http endpoint, e.g.,
+	// "http://127.0.0.1:8000/authz", or a command that authorizes service
+	// registrations after Authorizer; if it is empty, no hook is used.
+	// Requests contain the identity and control connection address of
+	// the client, the protocol and the ports of the registration
+	AuthHook string
+	// AuthHookCache is the time decisions of AuthHook are cached, unless
+	// the hook sets a ttl in its response; if it is 0, decisions are not
+	// cached
+	AuthHookCache time.Duration
+	// AuthHookFailOpen specifies if registrations are allowed if AuthHook
+	// fails; by default they are denied
+	AuthHookFailOpen bool
+	// EventsAddr is the address of the http listener that serves live
+	// events at the path "/events", e.g., "127.0.0.1:8081"; if it is
+	// empty, events are not served
+	EventsAddr string
+	// EventWebhooks are the urls events of clients and services are sent
+	// to as http POST requests, e.g., "https://example.com/hook"
+	EventWebhooks []string
+	// EventWebhookSecret is the secret of the HMAC-SHA256 signature of
+	// events sent to EventWebhooks; if it is empty, events are not signed
+	EventWebhookSecret string
+	// EventCommand is a command that is run in a shell for each event of
+	// clients and services with the event as JSON on stdin
+	EventCommand string
+	// PortAllocator allocates ports for service registrations with port
+	// 0; if it is nil, the first free port in AllowedPorts is used
+	PortAllocator PortAllocator
+	// Logger is the logger for log messages of the server; if it is nil,
+	// the default slog logger is used
+	Logger Logger
+	// LogHandler is the handler for structured log messages; it replaces
+	// Logger if it is not nil
+	LogHandler slog.Handler
+	// AccessLog is the writer for the access log with a JSON record for
+	// each peer connection and udp session of services; if it is nil, no
+	// access log is written
+	AccessLog io.Writer
+}
+
+// Server is a service-proxy server
+type Server struct {
+	s *pserver.Server
+}
+
+// Start creates the listeners of the server and runs it in the background
+// until it is shut down or ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	return s.s.Start(ctx)
+}
+
+// Shutdown shuts down the server and stops the services of its clients. It
+// waits until all clients are stopped or ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.s.Shutdown(ctx)
+}
+
+// Addr returns the address of the server's listener for control connections
+// or nil if the server is not started
+func (s *Server) Addr() net.Addr {
+	return s.s.Addr()
+}
+
+// WebSocketAddr returns the address of the server's listener for websocket
+// control connections or nil if there is none
+func (s *Server) WebSocketAddr() net.Addr {
+	return s.s.WebSocketAddr()
+}
+
+// EventsAddr returns the address of the server's listener for live events or
+// nil if there is none
+func (s *Server) EventsAddr() net.Addr {
+	return s.s.EventsAddr()
+}
+
+// UDPServices returns the statistics of the active udp services of the
+// server ordered by port, e.g., the number of active sessions of peers and
+// dropped packets
+func (s *Server) UDPServices() []UDPServiceStats {
+	return s.s.UDPServices()
+}
+
+// New creates a new server with options opts
+func New(opts *Options) (*Server, error) {
+	addr, err := net.ResolveTCPAddr("tcp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var wsAddr *net.TCPAddr
+	if opts.WebSocketAddr != "" {
+		wsAddr, err = net.ResolveTCPAddr("tcp", opts.WebSocketAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var eventsAddr *net.TCPAddr
+	if opts.EventsAddr != "" {
+		eventsAddr, err = net.ResolveTCPAddr("tcp", opts.EventsAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := pserver.NewServer(&pserver.Config{
+		Addr:               addr,
+		WebSocketAddr:      wsAddr,
+		TLSConfig:          opts.TLSConfig,
+		AllowedIPs:         strings.Join(opts.AllowedIPs, ","),
+		AllowedPorts:       strings.Join(opts.AllowedPorts, ","),
+		ServiceOptions:     strings.Join(opts.ServiceOptions, ","),
+		ForwardIPs:         strings.Join(opts.ForwardIPs, ","),
+		ForwardPorts:       strings.Join(opts.ForwardPorts, ","),
+		ForwardPolicies:    strings.Join(opts.ForwardPolicies, ","),
+		Authenticator:      opts.Authenticator,
+		Authorizer:         opts.Authorizer,
+		AuthHook:           opts.AuthHook,
+		AuthHookCache:      opts.AuthHookCache,
+		AuthHookFailOpen:   opts.AuthHookFailOpen,
+		EventWebhooks:      strings.Join(opts.EventWebhooks, ","),
+		EventWebhookSecret: opts.EventWebhookSecret,
+		EventCommand:       opts.EventCommand,
+		EventsAddr:         eventsAddr,
+		PortAllocator:      opts.PortAllocator,
+		Logger:             opts.Logger,
+		LogHandler:         opts.LogHandler,
+		AccessLog:          opts.AccessLog,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Server{s: s}, nil
+}
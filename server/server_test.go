@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hwipl/service-proxy/internal/pclient"
+)
+
+// testLogger is a logger that stores log messages for tests
+type testLogger struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+// Printf stores a log message
+func (l *testLogger) Printf(format string, v ...any) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	fmt.Fprintf(&l.b, format, v...)
+}
+
+// Println stores a log message
+func (l *testLogger) Println(v ...any) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	fmt.Fprintln(&l.b, v...)
+}
+
+// String returns the stored log messages
+func (l *testLogger) String() string {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.b.String()
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, opts := range []*Options{
+		{Addr: "invalid"},
+		{AllowedIPs: []string{"invalid"}},
+		{AllowedPorts: []string{"tcp:invalid"}},
+		{AllowedPorts: []string{"sctp:1024"}},
+		{ServiceOptions: []string{"tcp:idle"}},
+		{ForwardIPs: []string{"invalid"}},
+		{ForwardPorts: []string{"tcp"}},
+		{ForwardPolicies: []string{"alice"}},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("got nil, want error for %+v", opts)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	// start echo server as destination of the service
+	dest, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 52536,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// start server on a free port
+	logger := &testLogger{}
+	s, err := New(&Options{
+		Addr:         "127.0.0.1:0",
+		AllowedIPs:   []string{"127.0.0.1"},
+		AllowedPorts: []string{"tcp:52535"},
+		Logger:       logger,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.Addr() != nil {
+		t.Errorf("got %v, want nil", s.Addr())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != ErrServerStarted {
+		t.Errorf("got %v, want %v", err, ErrServerStarted)
+	}
+	addr := s.Addr().(*net.TCPAddr)
+	if addr.Port == 0 {
+		t.Errorf("got %d, want free port", addr.Port)
+	}
+
+	// register service and test it
+	go pclient.RunControlClient(&pclient.Config{
+		ServerAddr: addr.String(),
+		Services:   "tcp:52535:52536",
+	})
+	time.Sleep(1 * time.Second)
+	conn, err := net.Dial("tcp", "127.0.0.1:52535")
+	if err != nil {
+		log.Fatal(err)
+	}
+	want := []byte("hello")
+	conn.Write(want)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	conn.Close()
+
+	// shut down server and check that service is stopped
+	ctx, cancel := context.WithTimeout(context.Background(),
+		5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:52535"); err == nil {
+		conn.Close()
+		t.Errorf("got nil, want error")
+	}
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Errorf("got nil, want error")
+	}
+	if err := s.Start(context.Background()); err != ErrServerClosed {
+		t.Errorf("got %v, want %v", err, ErrServerClosed)
+	}
+
+	// check log messages
+	for _, want := range []string{
+		"Starting server",
+		"Adding new service for client",
+		"Removing a service for client",
+	} {
+		if !strings.Contains(logger.String(), want) {
+			t.Errorf("got %s, want %s", logger.String(), want)
+		}
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	s, err := New(&Options{
+		Addr:       "127.0.0.1:0",
+		AllowedIPs: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	addr := s.Addr().String()
+
+	// cancel context and check that server is shut down
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("got nil, want error")
+	}
+}
+
+// testAuth is an authenticator and authorizer for tests
+type testAuth struct {
+	m  sync.Mutex
+	id *Identity
+}
+
+// Authenticate identifies all clients as "test"
+func (a *testAuth) Authenticate(conn net.Conn,
+	state *tls.ConnectionState) (*Identity, error) {
+	return &Identity{Name: "test", Addr: conn.RemoteAddr()}, nil
+}
+
+// Authorize allows only destination port 80 and stores the identity
+func (a *testAuth) Authorize(id *Identity, protocol string, port,
+	destPort uint16) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.id = id
+	if destPort != 80 {
+		return errors.New("destination port not allowed")
+	}
+	return nil
+}
+
+func TestServerAuth(t *testing.T) {
+	auth := &testAuth{}
+	s, err := New(&Options{
+		Addr:          "127.0.0.1:0",
+		AllowedPorts:  []string{"tcp:52541"},
+		Authenticator: auth,
+		Authorizer:    auth,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		5*time.Second)
+	defer cancel()
+	defer s.Shutdown(ctx)
+
+	// connect client without allowed IPs and register services
+	c, err := pclient.Connect(ctx, &pclient.Config{
+		ServerAddr: s.Addr().String(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	spec := &pclient.ServiceSpec{Protocol: "tcp", Port: 52541,
+		DestPort: 8080}
+	if _, err := c.Register(spec); !errors.Is(err, pclient.ErrRejected) {
+		t.Errorf("got %v, want %v", err, pclient.ErrRejected)
+	}
+	spec.DestPort = 80
+	if _, err := c.Register(spec); err != nil {
+		t.Error(err)
+	}
+	auth.m.Lock()
+	if auth.id == nil || auth.id.Name != "test" {
+		t.Errorf("got %v, want test", auth.id)
+	}
+	auth.m.Unlock()
+}
+
+func TestServerEvents(t *testing.T) {
+	// start webhook that passes event types to events
+	events := make(chan string, 16)
+	hook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var e struct{ Type string }
+			json.NewDecoder(r.Body).Decode(&e)
+			events <- e.Type
+		}))
+	defer hook.Close()
+
+	// start server
+	s, err := New(&Options{
+		Addr:          "127.0.0.1:0",
+		AllowedIPs:    []string{"127.0.0.1"},
+		AllowedPorts:  []string{"tcp:52542"},
+		EventWebhooks: []string{hook.URL},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		5*time.Second)
+	defer cancel()
+	defer s.Shutdown(ctx)
+
+	// connect client, register service and disconnect
+	c, err := pclient.Connect(ctx, &pclient.Config{
+		ServerAddr: s.Addr().String(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = c.Register(&pclient.ServiceSpec{Protocol: "tcp", Port: 52542,
+		DestPort: 80})
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.Close()
+
+	// check events
+	for _, want := range []string{
+		"client.connected",
+		"service.added",
+		"service.removed",
+		"client.disconnected",
+	} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("got no event, want %s", want)
+		}
+	}
+}